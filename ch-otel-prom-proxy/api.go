@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+type apiErrorType string
+
+const (
+	errorBadData  apiErrorType = "bad_data"
+	errorExec     apiErrorType = "execution"
+	errorCanceled apiErrorType = "canceled"
+	errorTimeout  apiErrorType = "timeout"
+	errorInternal apiErrorType = "internal"
+	// errorUnavailable is for queries the limiter turned away.
+	errorUnavailable apiErrorType = "unavailable"
+)
+
+const maxAPIWarnings = 10
+
+type apiError struct {
+	typ apiErrorType
+	err error
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s: %s", e.typ, e.err)
+}
+
+type apiResponse struct {
+	Status    string       `json:"status"`
+	Data      interface{}  `json:"data,omitempty"`
+	ErrorType apiErrorType `json:"errorType,omitempty"`
+	Error     string       `json:"error,omitempty"`
+	Warnings  []string     `json:"warnings,omitempty"`
+	Infos     []string     `json:"infos,omitempty"`
+}
+
+type queryData struct {
+	ResultType parser.ValueType `json:"resultType"`
+	Result     parser.Value     `json:"result"`
+}
+
+// newEngine returns a PromQL engine loading at most maxSamples samples per
+// query. Each tenant has its own.
+func newEngine(maxSamples int) *promql.Engine {
+	return promql.NewEngine(promql.EngineOpts{
+		MaxSamples:           maxSamples,
+		Timeout:              queryTimeout,
+		LookbackDelta:        queryLookbackDelta,
+		EnableAtModifier:     true,
+		EnableNegativeOffset: true,
+	})
+}
+
+func handleQuery(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	ts := time.Now()
+	if v := r.FormValue("time"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			writeAPIError(w, &apiError{errorBadData, fmt.Errorf("invalid parameter \"time\": %w", err)})
+			return
+		}
+		ts = t
+	}
+
+	qry, err := tenantFrom(ctx).engine.NewInstantQuery(ctx, chQueryable{}, nil, r.FormValue("query"), ts)
+	if err != nil {
+		writeAPIError(w, &apiError{errorBadData, err})
+		return
+	}
+	runQuery(ctx, w, qry, r.FormValue("query"))
+}
+
+func handleQueryRange(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	start, err := parseTime(r.FormValue("start"))
+	if err != nil {
+		writeAPIError(w, &apiError{errorBadData, fmt.Errorf("invalid parameter \"start\": %w", err)})
+		return
+	}
+	end, err := parseTime(r.FormValue("end"))
+	if err != nil {
+		writeAPIError(w, &apiError{errorBadData, fmt.Errorf("invalid parameter \"end\": %w", err)})
+		return
+	}
+	if end.Before(start) {
+		writeAPIError(w, &apiError{errorBadData, errors.New("end timestamp must not be before start time")})
+		return
+	}
+	step, err := parseDuration(r.FormValue("step"))
+	if err != nil {
+		writeAPIError(w, &apiError{errorBadData, fmt.Errorf("invalid parameter \"step\": %w", err)})
+		return
+	}
+	if step <= 0 {
+		writeAPIError(w, &apiError{errorBadData, errors.New("zero or negative query resolution step widths are not accepted. Try a positive integer")})
+		return
+	}
+	// Same guard as Prometheus against queries returning too many points.
+	if end.Sub(start)/step > 11000 {
+		writeAPIError(w, &apiError{errorBadData, errors.New("exceeded maximum resolution of 11,000 points per timeseries. Try decreasing the query resolution (?step=XX)")})
+		return
+	}
+
+	qry, err := tenantFrom(ctx).engine.NewRangeQuery(ctx, chQueryable{}, nil, r.FormValue("query"), start, end, step)
+	if err != nil {
+		writeAPIError(w, &apiError{errorBadData, err})
+		return
+	}
+	runQuery(ctx, w, qry, r.FormValue("query"))
+}
+
+func runQuery(ctx context.Context, w http.ResponseWriter, qry promql.Query, qs string) {
+	defer qry.Close()
+
+	res := qry.Exec(ctx)
+	if res.Err != nil {
+		writeAPIError(w, queryError(res.Err))
+		return
+	}
+
+	warnings, infos := res.Warnings.AsStrings(qs, maxAPIWarnings, maxAPIWarnings)
+	writeAPIResponse(w, apiResponse{
+		Status:   "success",
+		Data:     queryData{ResultType: res.Value.Type(), Result: res.Value},
+		Warnings: warnings,
+		Infos:    infos,
+	})
+}
+
+func queryError(err error) *apiError {
+	var (
+		canceled promql.ErrQueryCanceled
+		timeout  promql.ErrQueryTimeout
+		storErr  promql.ErrStorage
+		overload *overloadError
+		limitErr *limitError
+	)
+	switch {
+	case errors.As(err, &overload),
+		errors.As(err, &storErr) && errors.As(storErr.Err, &overload):
+		return &apiError{errorUnavailable, overload}
+	case errors.As(err, &limitErr),
+		errors.As(err, &storErr) && errors.As(storErr.Err, &limitErr):
+		return &apiError{errorExec, limitErr}
+	case errors.As(err, &canceled), errors.Is(err, context.Canceled):
+		return &apiError{errorCanceled, err}
+	case errors.As(err, &timeout), errors.Is(err, context.DeadlineExceeded):
+		return &apiError{errorTimeout, err}
+	case errors.As(err, &storErr):
+		return &apiError{errorInternal, err}
+	}
+	return &apiError{errorExec, err}
+}
+
+func writeAPIResponse(w http.ResponseWriter, resp apiResponse) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("api response marshal error: %v", err)
+		http.Error(w, "failed json marshal", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+func writeAPIError(w http.ResponseWriter, apiErr *apiError) {
+	code := http.StatusInternalServerError
+	switch apiErr.typ {
+	case errorBadData:
+		code = http.StatusBadRequest
+	case errorExec:
+		code = http.StatusUnprocessableEntity
+	case errorCanceled:
+		code = 499
+	case errorTimeout, errorUnavailable:
+		code = http.StatusServiceUnavailable
+	}
+	var overload *overloadError
+	if errors.As(apiErr.err, &overload) {
+		code = overload.status
+		overload.writeHeaders(w)
+	}
+
+	b, err := json.Marshal(apiResponse{Status: "error", ErrorType: apiErr.typ, Error: apiErr.err.Error()})
+	if err != nil {
+		http.Error(w, "failed json marshal", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(b)
+}
+
+// parseTime accepts the same formats as the Prometheus HTTP API: Unix
+// seconds with optional fraction, or RFC 3339.
+func parseTime(s string) (time.Time, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(t)
+		return time.Unix(int64(sec), int64(math.Round(frac*1e3))*int64(time.Millisecond)).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if d, err := strconv.ParseFloat(s, 64); err == nil {
+		ts := d * float64(time.Second)
+		if ts > float64(math.MaxInt64) || ts < float64(math.MinInt64) {
+			return 0, fmt.Errorf("cannot parse %q to a valid duration. It overflows int64", s)
+		}
+		return time.Duration(ts), nil
+	}
+	if d, err := model.ParseDuration(s); err == nil {
+		return time.Duration(d), nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+}
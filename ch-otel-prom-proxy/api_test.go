@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// gaugeClickHouse serves cpu, a gauge of two hosts with a point every 15s
+// from 0 to 300s; host b reads twice host a.
+func gaugeClickHouse() *fakeClickHouse {
+	return newFakeClickHouse(func(query string, args []interface{}) (fakeResult, error) {
+		if strings.Contains(query, "GROUP BY MetricName") {
+			return catalogRows(map[string][][]interface{}{
+				"otel_metrics_gauge": {{"cpu", "", uint8(0)}},
+			})(query, args)
+		}
+		var rows [][]interface{}
+		for ts := int64(0); ts <= 300; ts += 15 {
+			for i, host := range []string{"a", "b"} {
+				rows = append(rows, []interface{}{"cpu", map[string]string{"host": host}, ts * 1e9, float64(ts * int64(i+1)), uint32(0)})
+			}
+		}
+		return fakeResult{columns: []string{"MetricName", "Labels", "ts_ns", "SumValue", "Flags"}, rows: rows}, nil
+	})
+}
+
+// apiResult is the part of a query API response the tests look at.
+type apiResult struct {
+	Status string `json:"status"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+			Value  []interface{}     `json:"value"`
+			Values [][]interface{}   `json:"values"`
+		} `json:"result"`
+	} `json:"data"`
+	Error    string   `json:"error"`
+	Warnings []string `json:"warnings"`
+}
+
+func serveAPI(t *testing.T, h http.HandlerFunc, r *http.Request) apiResult {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h(w, r)
+	var res apiResult
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("decode %s: %v", w.Body, err)
+	}
+	if w.Code != http.StatusOK || res.Status != "success" {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	return res
+}
+
+func TestHandleQueryEndToEnd(t *testing.T) {
+	applyTestConfig(t, nil)
+	ctx := gaugeClickHouse().context(defaultConfig().Limits)
+
+	form := url.Values{"query": {"max by (host) (cpu)"}, "time": {"150"}}
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/query?"+form.Encode(), nil).WithContext(ctx)
+	res := serveAPI(t, handleQuery, r)
+	if res.Data.ResultType != "vector" {
+		t.Fatalf("got result type %q, want vector", res.Data.ResultType)
+	}
+	got := map[string]interface{}{}
+	for _, s := range res.Data.Result {
+		got[s.Metric["host"]] = s.Value[1]
+	}
+	if want := map[string]interface{}{"a": "150", "b": "300"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestHandleQueryRangeEndToEnd(t *testing.T) {
+	applyTestConfig(t, nil)
+	ctx := gaugeClickHouse().context(defaultConfig().Limits)
+
+	form := url.Values{"query": {"sum(cpu)"}, "start": {"60"}, "end": {"120"}, "step": {"30"}}
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/query_range?"+form.Encode(), nil).WithContext(ctx)
+	res := serveAPI(t, handleQueryRange, r)
+	if res.Data.ResultType != "matrix" || len(res.Data.Result) != 1 {
+		t.Fatalf("got %s of %d series, want one series", res.Data.ResultType, len(res.Data.Result))
+	}
+	want := [][]interface{}{{60.0, "180"}, {90.0, "270"}, {120.0, "360"}}
+	if got := res.Data.Result[0].Values; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestHandleQueryPartialResponseWarning(t *testing.T) {
+	applyTestConfig(t, nil)
+	limits := defaultConfig().Limits
+	limits.MaxRows, limits.PartialResponse = 10, true
+	ctx := gaugeClickHouse().context(limits)
+
+	form := url.Values{"query": {"count(cpu)"}, "time": {"300"}}
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/query?"+form.Encode(), nil).WithContext(ctx)
+	res := serveAPI(t, handleQuery, r)
+	if len(res.Warnings) != 1 || !strings.Contains(res.Warnings[0], "limit of 10 rows") {
+		t.Errorf("got warnings %q, want the row limit", res.Warnings)
+	}
+}
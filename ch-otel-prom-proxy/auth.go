@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Client certificate policies, named as in the Prometheus web config.
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+var tlsVersions = map[string]uint16{
+	"":      tls.VersionTLS12,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// tlsConfig returns the TLS config to listen with, or nil to serve plain
+// HTTP.
+func (c webConfig) tlsConfig() (*tls.Config, error) {
+	if c.TLSCertFile == "" && c.TLSKeyFile == "" {
+		if c.ClientCAFile != "" {
+			return nil, errors.New("client_ca_file needs tls_cert_file and tls_key_file")
+		}
+		return nil, nil
+	}
+	if c.TLSCertFile == "" || c.TLSKeyFile == "" {
+		return nil, errors.New("tls_cert_file and tls_key_file must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	clientAuth, ok := clientAuthTypes[c.ClientAuthType]
+	if !ok {
+		return nil, fmt.Errorf("unknown client_auth_type %q", c.ClientAuthType)
+	}
+	minVersion, ok := tlsVersions[c.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown tls_min_version %q", c.TLSMinVersion)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   clientAuth,
+		MinVersion:   minVersion,
+	}
+
+	if c.ClientCAFile != "" {
+		pool, err := loadCertPool(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		// Without a policy, a CA file means client certificates are wanted.
+		if c.ClientAuthType == "" {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert {
+		return nil, fmt.Errorf("client_auth_type %s needs client_ca_file", c.ClientAuthType)
+	}
+	return cfg, nil
+}
+
+// tlsConfig returns the TLS config to connect to ClickHouse with, or nil for
+// plain connections.
+func (c clickHouseTLSConfig) tlsConfig() (*tls.Config, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	cfg := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		pool, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// authenticator checks the credentials of every request against the basic
+// auth users and bearer tokens of the web config, and the bearer tokens of
+// the tenants. With none configured, requests pass unchecked.
+type authenticator struct {
+	users  map[string]string
+	tokens []string
+
+	// bcrypt is slow on purpose; remember credentials already checked so a
+	// dashboard refresh does not pay for it on every request.
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]bool
+}
+
+// maxVerifiedCredentials bounds the remembered credentials; the cache starts
+// over once full.
+const maxVerifiedCredentials = 1024
+
+func newAuthenticator(c *config) *authenticator {
+	tokens := slices.Clone(c.Web.BearerTokens)
+	if c.Tenancy.Enabled {
+		for _, t := range c.Tenancy.Tenants {
+			tokens = append(tokens, t.BearerTokens...)
+		}
+	}
+	return &authenticator{
+		users:    c.Web.BasicAuthUsers,
+		tokens:   tokens,
+		verified: map[[sha256.Size]byte]bool{},
+	}
+}
+
+// bearerToken returns the bearer token r carries, if any.
+func bearerToken(r *http.Request) (string, bool) {
+	return strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// tokenIn reports whether token is one of tokens, in constant time.
+func tokenIn(token string, tokens []string) bool {
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *authenticator) wrap(next http.Handler) http.Handler {
+	if len(a.users) == 0 && len(a.tokens) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.authenticate(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(a.users) > 0 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="ch-otel-prom-proxy"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+func (a *authenticator) authenticate(r *http.Request) bool {
+	if token, ok := bearerToken(r); ok {
+		return tokenIn(token, a.tokens)
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, ok := a.users[user]
+	if !ok {
+		// Spend the same time as for a known user so user names cannot be
+		// probed.
+		bcrypt.CompareHashAndPassword([]byte(dummyBcryptHash), []byte(pass))
+		return false
+	}
+
+	key := sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + pass))
+	a.mu.Lock()
+	ok = a.verified[key]
+	a.mu.Unlock()
+	if ok {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+		return false
+	}
+	a.mu.Lock()
+	if len(a.verified) >= maxVerifiedCredentials {
+		a.verified = map[[sha256.Size]byte]bool{}
+	}
+	a.verified[key] = true
+	a.mu.Unlock()
+	return true
+}
+
+// dummyBcryptHash is the bcrypt hash of an arbitrary password, at the default
+// cost.
+const dummyBcryptHash = "$2a$10$QOauhQNbBCuQDKes6eFzPeMqBSjb7Mr5DUmpZ/VcEd00UAV/LDeSi"
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthenticatorBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := defaultConfig()
+	c.Web.BasicAuthUsers = map[string]string{"alice": string(hash)}
+	c.Web.BearerTokens = []string{"token"}
+	a := newAuthenticator(c)
+	h := a.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tc := range []struct {
+		name       string
+		user, pass string
+		bearer     string
+		want       int
+	}{
+		{name: "right password", user: "alice", pass: "secret", want: http.StatusOK},
+		{name: "wrong password", user: "alice", pass: "guess", want: http.StatusUnauthorized},
+		{name: "unknown user", user: "bob", pass: "secret", want: http.StatusUnauthorized},
+		{name: "bearer token", bearer: "token", want: http.StatusOK},
+		{name: "wrong bearer token", bearer: "guess", want: http.StatusUnauthorized},
+		{name: "no credentials", want: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			switch {
+			case tc.user != "":
+				r.SetBasicAuth(tc.user, tc.pass)
+			case tc.bearer != "":
+				r.Header.Set("Authorization", "Bearer "+tc.bearer)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Errorf("got status %d, want %d", w.Code, tc.want)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("a rejected request got no basic auth challenge")
+			}
+		})
+	}
+}
+
+func TestAuthenticatorCredentialCache(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := defaultConfig()
+	c.Web.BasicAuthUsers = map[string]string{"alice": string(hash)}
+	a := newAuthenticator(c)
+	request := func(pass string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.SetBasicAuth("alice", pass)
+		return r
+	}
+
+	if a.authenticate(request("guess")) || len(a.verified) != 0 {
+		t.Fatalf("a wrong password was accepted or remembered: %d remembered", len(a.verified))
+	}
+	for i := 0; i < 2; i++ {
+		if !a.authenticate(request("secret")) {
+			t.Fatal("the right password was rejected")
+		}
+		if len(a.verified) != 1 {
+			t.Fatalf("got %d remembered credentials, want 1", len(a.verified))
+		}
+	}
+
+	// A remembered credential no longer passes once the user's hash changes.
+	other, err := bcrypt.GenerateFromPassword([]byte("changed"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.users["alice"] = string(other)
+	if a.authenticate(request("secret")) {
+		t.Error("the old password passed after the hash changed")
+	}
+
+	// A full cache starts over.
+	a.users["alice"] = string(hash)
+	a.verified = map[[sha256.Size]byte]bool{}
+	for i := 0; i < maxVerifiedCredentials; i++ {
+		a.verified[sha256.Sum256([]byte{byte(i), byte(i >> 8)})] = true
+	}
+	if !a.authenticate(request("secret")) {
+		t.Fatal("the right password was rejected")
+	}
+	if len(a.verified) != 1 {
+		t.Errorf("got %d remembered credentials after the cache filled up, want 1", len(a.verified))
+	}
+}
+
+// writeTestCert writes a self-signed certificate and its key to dir and
+// returns their paths.
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ch-otel-prom-proxy test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestWebTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeTestCert(t, dir)
+	notPEM := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(notPEM, []byte("no certificates here"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		web     webConfig
+		plain   bool
+		auth    tls.ClientAuthType
+		withCAs bool
+		min     uint16
+		wantErr bool
+	}{
+		{name: "plain HTTP", plain: true},
+		{name: "server certificate only", web: webConfig{TLSCertFile: cert, TLSKeyFile: key}, auth: tls.NoClientCert, min: tls.VersionTLS12},
+		{name: "TLS 1.3", web: webConfig{TLSCertFile: cert, TLSKeyFile: key, TLSMinVersion: "TLS13"}, auth: tls.NoClientCert, min: tls.VersionTLS13},
+		{name: "client CA without a policy", web: webConfig{TLSCertFile: cert, TLSKeyFile: key, ClientCAFile: cert}, auth: tls.RequireAndVerifyClientCert, withCAs: true, min: tls.VersionTLS12},
+		{name: "client CA verified if given", web: webConfig{TLSCertFile: cert, TLSKeyFile: key, ClientCAFile: cert, ClientAuthType: "VerifyClientCertIfGiven"}, auth: tls.VerifyClientCertIfGiven, withCAs: true, min: tls.VersionTLS12},
+		{name: "any client certificate", web: webConfig{TLSCertFile: cert, TLSKeyFile: key, ClientAuthType: "RequireAnyClientCert"}, auth: tls.RequireAnyClientCert, min: tls.VersionTLS12},
+		{name: "verify without a client CA", web: webConfig{TLSCertFile: cert, TLSKeyFile: key, ClientAuthType: "RequireAndVerifyClientCert"}, wantErr: true},
+		{name: "client CA without a certificate", web: webConfig{ClientCAFile: cert}, wantErr: true},
+		{name: "certificate without a key", web: webConfig{TLSCertFile: cert}, wantErr: true},
+		{name: "client CA file without certificates", web: webConfig{TLSCertFile: cert, TLSKeyFile: key, ClientCAFile: notPEM}, wantErr: true},
+		{name: "unknown policy", web: webConfig{TLSCertFile: cert, TLSKeyFile: key, ClientAuthType: "Sometimes"}, wantErr: true},
+		{name: "unknown version", web: webConfig{TLSCertFile: cert, TLSKeyFile: key, TLSMinVersion: "TLS10"}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := tc.web.tlsConfig()
+			if tc.wantErr {
+				if err == nil {
+					t.Error("want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.plain {
+				if cfg != nil {
+					t.Error("got a TLS config, want plain HTTP")
+				}
+				return
+			}
+			if cfg.ClientAuth != tc.auth {
+				t.Errorf("got client auth %v, want %v", cfg.ClientAuth, tc.auth)
+			}
+			if (cfg.ClientCAs != nil) != tc.withCAs {
+				t.Errorf("got client CAs %v, want them: %v", cfg.ClientCAs != nil, tc.withCAs)
+			}
+			if cfg.MinVersion != tc.min {
+				t.Errorf("got min version %x, want %x", cfg.MinVersion, tc.min)
+			}
+			if len(cfg.Certificates) != 1 {
+				t.Errorf("got %d certificates, want 1", len(cfg.Certificates))
+			}
+		})
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	prompb "github.com/prometheus/prometheus/prompb"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// resultCache is nil unless the cache is enabled.
+var resultCache *queryCache
+
+// queryCache keeps what the query handlers returned for recent queries, so
+// that dashboards refreshing the same panels only read from ClickHouse the
+// points that arrived since.
+//
+// An entry holds the series of one metric type for one set of matchers over
+// a single extent of time, along with the per-series state the handler had
+// at its end. A query inside the extent is answered from it; a query
+// reaching past it extends the extent forward, reading only the new slice.
+// Points newer than maxFreshness are always read and never kept, as late
+// points may still land there.
+type queryCache struct {
+	maxSize      int64
+	ttl          time.Duration
+	maxFreshness time.Duration
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+func newQueryCache(c cacheConfig) *queryCache {
+	return &queryCache{
+		maxSize:      int64(c.MaxSizeBytes),
+		ttl:          time.Duration(c.TTL),
+		maxFreshness: time.Duration(c.MaxFreshness),
+		lru:          list.New(),
+		entries:      map[string]*list.Element{},
+	}
+}
+
+// cacheEntry is the cached result of one key. mu is held while the entry is
+// read or extended, so concurrent requests for the same key wait for the
+// first to read ClickHouse rather than all reading it.
+type cacheEntry struct {
+	key     string
+	created time.Time
+
+	mu             sync.Mutex
+	startMs, endMs int64
+	series         []*cachedSeries
+	index          map[uint64][]*cachedSeries
+	state          *seriesState
+	samples        int
+	size           int64
+
+	// reported is the size the cache accounts e for, guarded by the
+	// cache's mu.
+	reported int64
+}
+
+type cachedSeries struct {
+	labels     []prompb.Label
+	samples    []prompb.Sample
+	histograms []prompb.Histogram
+}
+
+// Rough memory costs used to keep the cache within its budget.
+const (
+	cachedSeriesOverhead = 256
+	cachedLabelOverhead  = 32
+)
+
+func (e *cacheEntry) get(ls []prompb.Label) *cachedSeries {
+	ls = append([]prompb.Label(nil), ls...)
+	sortLabels(ls)
+	fp := fingerprint(ls)
+	for _, s := range e.index[fp] {
+		if labelsEqual(s.labels, ls) {
+			return s
+		}
+	}
+
+	s := &cachedSeries{labels: ls}
+	e.index[fp] = append(e.index[fp], s)
+	e.series = append(e.series, s)
+	e.size += cachedSeriesOverhead
+	for _, l := range ls {
+		e.size += int64(cachedLabelOverhead + len(l.Name) + len(l.Value))
+	}
+	return s
+}
+
+func (e *cacheEntry) addSample(ls []prompb.Label, sample prompb.Sample) {
+	s := e.get(ls)
+	s.samples = append(s.samples, sample)
+	e.samples++
+	e.size += sampleBytes
+}
+
+func (e *cacheEntry) addHistogram(ls []prompb.Label, h prompb.Histogram) {
+	s := e.get(ls)
+	s.histograms = append(s.histograms, h)
+	e.samples++
+	e.size += int64(h.Size())
+}
+
+// reset empties e so that it covers nothing yet, starting at startMs.
+func (e *cacheEntry) reset(q *prompb.Query) {
+	e.startMs, e.endMs = q.StartTimestampMs, q.StartTimestampMs-1
+	e.series, e.index = nil, map[uint64][]*cachedSeries{}
+	e.state = newSeriesState(q)
+	e.samples, e.size = 0, 0
+}
+
+// trim drops the points before startMs.
+func (e *cacheEntry) trim(startMs int64) {
+	e.size, e.samples = 0, 0
+	series := e.series[:0]
+	e.index = map[uint64][]*cachedSeries{}
+	for _, s := range e.series {
+		i := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].Timestamp >= startMs })
+		s.samples = append([]prompb.Sample(nil), s.samples[i:]...)
+		i = sort.Search(len(s.histograms), func(i int) bool { return s.histograms[i].Timestamp >= startMs })
+		s.histograms = append([]prompb.Histogram(nil), s.histograms[i:]...)
+		if len(s.samples) == 0 && len(s.histograms) == 0 {
+			continue
+		}
+
+		series = append(series, s)
+		fp := fingerprint(s.labels)
+		e.index[fp] = append(e.index[fp], s)
+		e.size += cachedSeriesOverhead
+		for _, l := range s.labels {
+			e.size += int64(cachedLabelOverhead + len(l.Name) + len(l.Value))
+		}
+		e.size += int64(len(s.samples) * sampleBytes)
+		for _, h := range s.histograms {
+			e.size += int64(h.Size())
+		}
+		e.samples += len(s.samples) + len(s.histograms)
+	}
+	e.series = series
+	e.startMs = startMs
+}
+
+// replay hands app the cached points inside [startMs, endMs].
+func (e *cacheEntry) replay(startMs, endMs int64, app seriesAppender) {
+	in := func(t int64) bool { return t >= startMs && t <= endMs }
+	for _, s := range e.series {
+		for _, sample := range s.samples {
+			if in(sample.Timestamp) {
+				app.addSample(append([]prompb.Label(nil), s.labels...), sample)
+			}
+		}
+		for _, h := range s.histograms {
+			if in(h.Timestamp) {
+				app.addHistogram(append([]prompb.Label(nil), s.labels...), h)
+			}
+		}
+	}
+}
+
+// entry returns the entry for key, locked, making a new one if there is none
+// or it has expired.
+func (c *queryCache) entry(key string) *cacheEntry {
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if ok && time.Since(el.Value.(*cacheEntry).created) > c.ttl {
+		c.removeLocked(el)
+		ok = false
+	}
+	if ok {
+		c.lru.MoveToFront(el)
+	} else {
+		el = c.lru.PushFront(&cacheEntry{key: key, created: time.Now()})
+		c.entries[key] = el
+	}
+	e := el.Value.(*cacheEntry)
+	c.mu.Unlock()
+
+	e.mu.Lock()
+	return e
+}
+
+// resize accounts for the current size of e, which the caller holds, and
+// evicts the least recently used entries until the cache fits its budget.
+func (c *queryCache) resize(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[e.key]
+	if !ok || el.Value != e {
+		return
+	}
+	c.size += e.size - e.reported
+	e.reported = e.size
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+// remove drops e, unless it has been replaced already.
+func (c *queryCache) remove(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok && el.Value == e {
+		c.removeLocked(el)
+	}
+}
+
+func (c *queryCache) removeLocked(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	c.lru.Remove(el)
+	delete(c.entries, e.key)
+	c.size -= e.reported
+}
+
+// cacheKey identifies the results of handler type t for q, leaving out its
+// time range.
+func cacheKey(ctx context.Context, t metricType, q *prompb.Query) string {
+	ms := make([]string, 0, len(q.Matchers))
+	for _, m := range q.Matchers {
+		ms = append(ms, fmt.Sprintf("%s %s %q", m.Name, m.Type, m.Value))
+	}
+	sort.Strings(ms)
+	ms = slices.Compact(ms)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\x00%s\x00%d", tenantFrom(ctx).id, t, rowLimit(ctx))
+	// Downsampled results hold one point per step bucket, so they only
+	// serve queries whose buckets have the same width and edges.
+	if mode := pushdownMode(q, t); mode != downsampleNone {
+		step := q.Hints.StepMs
+		fmt.Fprintf(&b, "\x00%d/%d/%d", mode, step, pushdownBucketEnd(q)%step)
+	}
+	for _, m := range ms {
+		b.WriteString("\x00")
+		b.WriteString(m)
+	}
+	return b.String()
+}
+
+// runQueryHandler runs h for q, through the result cache when it is enabled.
+// Whatever h has to read is split into shards.
+func runQueryHandler(ctx context.Context, t metricType, h queryHandler, q *prompb.Query, app seriesAppender) error {
+	sharded := func(ctx context.Context, q *prompb.Query, app seriesAppender) error {
+		return runSharded(ctx, h, q, app)
+	}
+	if resultCache == nil {
+		return sharded(ctx, q, app)
+	}
+	return resultCache.query(ctx, t, sharded, q, app)
+}
+
+// query answers q from the cache as far as it can, reading the rest with h.
+func (c *queryCache) query(ctx context.Context, t metricType, h queryHandler, q *prompb.Query, app seriesAppender) error {
+	now := time.Now().UnixMilli()
+	endMs := q.EndTimestampMs
+	if endMs == 0 {
+		endMs = now
+	}
+	cacheEnd := min(endMs, now-c.maxFreshness.Milliseconds())
+	if cacheEnd < q.StartTimestampMs {
+		c.record(ctx, "bypass")
+		return h(ctx, q, app)
+	}
+
+	e := c.entry(cacheKey(ctx, t, q))
+	result := "hit"
+	if e.state == nil || q.StartTimestampMs < e.startMs || q.StartTimestampMs > e.endMs+1 {
+		e.reset(q)
+		result = "miss"
+	} else if unused := q.StartTimestampMs - e.startMs; unused > cacheEnd-q.StartTimestampMs {
+		// Panels over shorter ranges share the entry; only drop the head
+		// once it outweighs the part still asked for.
+		e.trim(q.StartTimestampMs)
+	}
+
+	if cacheEnd > e.endMs {
+		if result == "hit" {
+			result = "partial"
+		}
+		slice := *q
+		slice.StartTimestampMs, slice.EndTimestampMs = e.endMs+1, cacheEnd
+		sliceCtx, cut := withTruncation(withSeriesState(ctx, e.state))
+		if err := h(sliceCtx, &slice, e); err != nil {
+			e.mu.Unlock()
+			c.remove(e)
+			return err
+		}
+		e.endMs = cacheEnd
+		// A slice cut short by the row limit would leave a hole in the
+		// extent.
+		if cut.Load() {
+			c.remove(e)
+		}
+	}
+	c.resize(e)
+	c.record(ctx, result)
+
+	e.replay(q.StartTimestampMs, cacheEnd, app)
+	if endMs <= cacheEnd {
+		e.mu.Unlock()
+		return nil
+	}
+	// The fresh points go on from the cached state without changing it,
+	// as they are read again next time.
+	state := e.state.clone()
+	e.mu.Unlock()
+
+	fresh := *q
+	fresh.StartTimestampMs = cacheEnd + 1
+	return h(withSeriesState(ctx, state), &fresh, app)
+}
+
+func (c *queryCache) record(ctx context.Context, result string) {
+	telemetry.cacheRequests.Add(ctx, 1, metric.WithAttributes(attribute.String("result", result)))
+}
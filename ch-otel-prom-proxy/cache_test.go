@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+// fakeHandler serves a point per minute for two series, recording the ranges
+// it is asked for.
+type fakeHandler struct {
+	reads    [][2]int64
+	truncate bool
+	err      error
+}
+
+func (f *fakeHandler) handle(ctx context.Context, q *prompb.Query, app seriesAppender) error {
+	f.reads = append(f.reads, [2]int64{q.StartTimestampMs, q.EndTimestampMs})
+	if f.err != nil {
+		return f.err
+	}
+	for ts := (q.StartTimestampMs + 59999) / 60000 * 60000; ts <= q.EndTimestampMs; ts += 60000 {
+		for _, host := range []string{"a", "b"} {
+			ls := []prompb.Label{{Name: "__name__", Value: "m"}, {Name: "host", Value: host}}
+			app.addSample(ls, prompb.Sample{Timestamp: ts, Value: float64(ts / 60000)})
+		}
+	}
+	if f.truncate {
+		markTruncated(ctx)
+	}
+	return nil
+}
+
+func TestQueryCache(t *testing.T) {
+	const minute = int64(time.Minute / time.Millisecond)
+	now := time.Now().UnixMilli()
+	base := now/minute*minute - 10*60*minute
+	ctx := withTenant(context.Background(), newTenant("", nil, "otel_metrics", nil, limitsConfig{}))
+
+	c := newQueryCache(cacheConfig{
+		Enabled:      true,
+		MaxSizeBytes: 1 << 20,
+		TTL:          model.Duration(time.Hour),
+		MaxFreshness: model.Duration(5 * time.Minute),
+	})
+	f := &fakeHandler{}
+	m := func(minutes int64) int64 { return base + minutes*minute }
+	matchers := []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "m"}}
+	// query runs [start, end] minutes after base through the cache and
+	// checks the result against reading everything.
+	query := func(start, end int64) {
+		t.Helper()
+		q := &prompb.Query{StartTimestampMs: m(start), EndTimestampMs: m(end), Matchers: matchers}
+		got, _ := newSeriesSet(q.Matchers)
+		if err := c.query(ctx, metricTypeGauge, f.handle, q, got); err != nil {
+			t.Fatal(err)
+		}
+		want, _ := newSeriesSet(q.Matchers)
+		if err := (&fakeHandler{}).handle(ctx, q, want); err != nil {
+			t.Fatal(err)
+		}
+		if g, w := fmt.Sprint(got.series()), fmt.Sprint(want.series()); g != w {
+			t.Errorf("[%d, %d]: cached result differs\ngot:  %s\nwant: %s", start, end, g, w)
+		}
+	}
+	expectReads := func(what string, want ...[2]int64) {
+		t.Helper()
+		if !reflect.DeepEqual(f.reads, want) {
+			t.Errorf("%s: read %v, want %v", what, f.reads, want)
+		}
+		f.reads = nil
+	}
+
+	query(0, 60)
+	expectReads("miss", [2]int64{m(0), m(60)})
+
+	query(0, 60)
+	expectReads("hit")
+
+	query(10, 70)
+	expectReads("extended", [2]int64{m(60) + 1, m(70)})
+
+	// The head is trimmed once it outweighs the part still asked for.
+	query(50, 80)
+	expectReads("trimmed", [2]int64{m(70) + 1, m(80)})
+	e := c.entry(cacheKey(ctx, metricTypeGauge, &prompb.Query{Matchers: matchers}))
+	if e.startMs != m(50) {
+		t.Errorf("entry starts %d minutes after base, want 50", (e.startMs-base)/minute)
+	}
+	e.mu.Unlock()
+
+	query(40, 80)
+	expectReads("before the extent", [2]int64{m(40), m(80)})
+
+	// Points within max_freshness of now are read every time and never
+	// kept.
+	query(590, 600)
+	if len(f.reads) != 2 || f.reads[0][0] != m(590) || f.reads[1][0] != f.reads[0][1]+1 || f.reads[1][1] != m(600) || f.reads[1][0] < m(594) {
+		t.Errorf("fresh miss: read %v, want [590, now-5m] then the rest up to 600", f.reads)
+	}
+	fresh := f.reads[1]
+	f.reads = nil
+	query(590, 600)
+	// Now may have moved on since, leaving the cache a millisecond or two
+	// more to read before the fresh points.
+	contiguous := len(f.reads) > 0 && f.reads[0][0] >= fresh[0] && f.reads[len(f.reads)-1][1] == m(600)
+	for i := 1; contiguous && i < len(f.reads); i++ {
+		contiguous = f.reads[i][0] == f.reads[i-1][1]+1
+	}
+	if !contiguous {
+		t.Errorf("fresh hit: read %v, want only the fresh points", f.reads)
+	}
+	f.reads = nil
+
+	// A slice cut short by the row limit is not kept.
+	f.truncate = true
+	query(100, 120)
+	f.truncate = false
+	query(100, 120)
+	expectReads("truncated", [2]int64{m(100), m(120)}, [2]int64{m(100), m(120)})
+
+	f.err = errors.New("boom")
+	q := &prompb.Query{StartTimestampMs: m(100), EndTimestampMs: m(130), Matchers: matchers}
+	if err := c.query(ctx, metricTypeGauge, f.handle, q, &seriesSet{}); err != f.err {
+		t.Errorf("got %v, want the handler's error", err)
+	}
+	f.err = nil
+	f.reads = nil
+	query(100, 130)
+	expectReads("after an error", [2]int64{m(100), m(130)})
+}
+
+func TestQueryCacheEviction(t *testing.T) {
+	now := time.Now().UnixMilli()
+	ctx := withTenant(context.Background(), newTenant("", nil, "otel_metrics", nil, limitsConfig{}))
+	c := newQueryCache(cacheConfig{
+		Enabled:      true,
+		MaxSizeBytes: 4096,
+		TTL:          model.Duration(time.Hour),
+	})
+	f := &fakeHandler{}
+	for _, name := range []string{"a", "b", "c"} {
+		q := &prompb.Query{
+			StartTimestampMs: now - int64(5*time.Hour/time.Millisecond),
+			EndTimestampMs:   now - int64(4*time.Hour/time.Millisecond),
+			Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: name}},
+		}
+		if err := c.query(ctx, metricTypeGauge, f.handle, q, &seriesSet{index: map[uint64][]*prompb.TimeSeries{}}); err != nil {
+			t.Fatal(err)
+		}
+		if c.size > c.maxSize {
+			t.Errorf("cache holds %d bytes, over its %d", c.size, c.maxSize)
+		}
+	}
+	if c.lru.Len() != 1 || len(c.entries) != 1 {
+		t.Errorf("cache holds %d entries, want only the latest", c.lru.Len())
+	}
+}
+
+func TestCacheKeyPushdown(t *testing.T) {
+	pushdownEnabled, queryLookbackDelta = true, 5*time.Minute
+	t.Cleanup(func() { pushdownEnabled = false })
+	ctx := withTenant(context.Background(), newTenant("", nil, "otel_metrics", nil, limitsConfig{}))
+
+	const minute = int64(time.Minute / time.Millisecond)
+	// query selects cpu over a window w evaluated every step from first to
+	// last.
+	query := func(first, last, w, step int64, fn string) *prompb.Query {
+		h := &prompb.ReadHints{StartMs: first - w + 1, EndMs: last, StepMs: step, RangeMs: w, Func: fn}
+		return &prompb.Query{
+			StartTimestampMs: h.StartMs,
+			EndTimestampMs:   h.EndMs,
+			Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "cpu"}},
+			Hints:            h,
+		}
+	}
+	key := func(q *prompb.Query) string { return cacheKey(ctx, metricTypeGauge, q) }
+
+	base := query(60*minute, 120*minute, 10*minute, minute, "max_over_time")
+	if pushdownMode(base, metricTypeGauge) == downsampleNone {
+		t.Fatal("the base query is not downsampled")
+	}
+	// Queries sharing the bucket grid share results whatever their range.
+	if later := query(90*minute, 180*minute, 10*minute, minute, "max_over_time"); key(later) != key(base) {
+		t.Errorf("queries on the same buckets got different keys %q and %q", key(base), key(later))
+	}
+	for name, q := range map[string]*prompb.Query{
+		"another step": query(60*minute, 120*minute, 10*minute, 2*minute, "max_over_time"),
+		"another mode": query(60*minute, 120*minute, 10*minute, minute, "min_over_time"),
+		"raw":          query(60*minute, 120*minute, 10*minute, minute, "rate"),
+	} {
+		if key(q) == key(base) {
+			t.Errorf("%s: shares the key %q of the base query", name, key(base))
+		}
+	}
+}
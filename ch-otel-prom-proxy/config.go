@@ -0,0 +1,668 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// config is the proxy configuration. Settings come from, in increasing order
+// of precedence: the defaults, the YAML file given with -config.file,
+// environment variables and command-line flags.
+type config struct {
+	ClickHouse clickHouseConfig `yaml:"clickhouse"`
+	Tables     tablesConfig     `yaml:"tables"`
+	Query      queryConfig      `yaml:"query"`
+	Cache      cacheConfig      `yaml:"cache"`
+	Limits     limitsConfig     `yaml:"limits"`
+	Web        webConfig        `yaml:"web"`
+	Labels     labelsConfig     `yaml:"labels"`
+	Tenancy    tenancyConfig    `yaml:"tenancy"`
+	Telemetry  telemetryConfig  `yaml:"telemetry"`
+}
+
+type clickHouseConfig struct {
+	Address  string              `yaml:"address"`
+	Database string              `yaml:"database"`
+	Username string              `yaml:"username"`
+	Password string              `yaml:"password"`
+	TLS      clickHouseTLSConfig `yaml:"tls"`
+	// PingInterval is how often ClickHouse is pinged to tell whether the
+	// proxy is ready.
+	PingInterval model.Duration `yaml:"ping_interval"`
+}
+
+// clickHouseTLSConfig secures the native protocol connection, which
+// ClickHouse serves on port 9440 by default.
+type clickHouseTLSConfig struct {
+	Enabled            bool   `yaml:"enabled"`
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// tablesConfig names the table each metric type is stored in.
+type tablesConfig struct {
+	Sum                  string `yaml:"sum"`
+	Gauge                string `yaml:"gauge"`
+	Histogram            string `yaml:"histogram"`
+	ExponentialHistogram string `yaml:"exponential_histogram"`
+	Summary              string `yaml:"summary"`
+}
+
+type queryConfig struct {
+	Timeout              model.Duration `yaml:"timeout"`
+	LookbackDelta        model.Duration `yaml:"lookback_delta"`
+	MetadataDefaultRange model.Duration `yaml:"metadata_default_range"`
+	MetricCatalogTTL     model.Duration `yaml:"metric_catalog_ttl"`
+	// MetricCatalogRange is how far back the catalog looks for metric
+	// names. Older names are still read, but only as they are stored.
+	MetricCatalogRange model.Duration `yaml:"metric_catalog_range"`
+	Pushdown           bool           `yaml:"pushdown"`
+	// RemoteReadExemplars adds exemplars to SAMPLES remote-read responses,
+	// at the cost of a second scan per metric type. The query_exemplars
+	// API reads them either way.
+	RemoteReadExemplars bool `yaml:"remote_read_exemplars"`
+	// ReadConcurrency is how many queries of one remote-read request run
+	// at once.
+	ReadConcurrency int `yaml:"read_concurrency"`
+	// ShardInterval splits queries over longer ranges into shards aligned
+	// to it, read in parallel; zero turns sharding off. The tables are
+	// partitioned by day, so a shard reads a single partition.
+	ShardInterval model.Duration `yaml:"shard_interval"`
+	// MaxConcurrency bounds the ClickHouse queries running at once across
+	// all requests; zero means no bound. Up to MaxQueued more wait for
+	// QueueTimeout before being turned away.
+	MaxConcurrency int            `yaml:"max_concurrency"`
+	MaxQueued      int            `yaml:"max_queued"`
+	QueueTimeout   model.Duration `yaml:"queue_timeout"`
+}
+
+// cacheConfig controls the cache of query results.
+type cacheConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MaxSizeBytes bounds the estimated memory held by cached series.
+	MaxSizeBytes int            `yaml:"max_size_bytes"`
+	TTL          model.Duration `yaml:"ttl"`
+	// MaxFreshness is how far back from now points are never cached, as
+	// late or out-of-order points may still arrive there.
+	MaxFreshness model.Duration `yaml:"max_freshness"`
+}
+
+// limitsConfig caps the work done per query. Zero means no limit. Queries
+// over a limit fail, unless PartialResponse lets them return what they have
+// with a warning.
+type limitsConfig struct {
+	MaxRows            int  `yaml:"max_rows"`
+	MaxStreamedRows    int  `yaml:"max_streamed_rows"`
+	MaxSamples         int  `yaml:"max_samples"`
+	MetadataLimit      int  `yaml:"metadata_limit"`
+	MaxSeriesPerQuery  int  `yaml:"max_series_per_query"`
+	MaxSamplesPerQuery int  `yaml:"max_samples_per_query"`
+	MaxBytesPerQuery   int  `yaml:"max_bytes_per_query"`
+	PartialResponse    bool `yaml:"partial_response"`
+}
+
+type webConfig struct {
+	ListenAddress  string `yaml:"listen_address"`
+	TLSCertFile    string `yaml:"tls_cert_file"`
+	TLSKeyFile     string `yaml:"tls_key_file"`
+	TLSMinVersion  string `yaml:"tls_min_version"`
+	ClientCAFile   string `yaml:"client_ca_file"`
+	ClientAuthType string `yaml:"client_auth_type"`
+	// BasicAuthUsers maps user names to bcrypt password hashes.
+	BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+	BearerTokens   []string          `yaml:"bearer_tokens"`
+	// DrainDelay is how long the proxy keeps serving after SIGTERM with
+	// /-/ready failing, so load balancers stop sending it requests before
+	// it stops listening.
+	DrainDelay model.Duration `yaml:"drain_delay"`
+	// ShutdownTimeout is how long in-flight requests may run after SIGTERM
+	// before their queries are cancelled.
+	ShutdownTimeout model.Duration `yaml:"shutdown_timeout"`
+}
+
+// labelsConfig controls how OTel attributes are mapped to labels.
+type labelsConfig struct {
+	PromoteResourceAttributes []string `yaml:"promote_resource_attributes"`
+	TargetInfo                bool     `yaml:"target_info"`
+	TranslateNames            bool     `yaml:"translate_names"`
+}
+
+// telemetryConfig controls how the proxy reports its own metrics.
+type telemetryConfig struct {
+	MetricsPath string     `yaml:"metrics_path"`
+	OTLP        otlpConfig `yaml:"otlp"`
+}
+
+// otlpConfig pushes the proxy's metrics to an OTLP gRPC endpoint.
+type otlpConfig struct {
+	Enabled  bool           `yaml:"enabled"`
+	Endpoint string         `yaml:"endpoint"`
+	Insecure bool           `yaml:"insecure"`
+	Interval model.Duration `yaml:"interval"`
+}
+
+// tenancyConfig splits the proxy between tenants, named by a request header
+// or the basic-auth user.
+type tenancyConfig struct {
+	Enabled       bool                    `yaml:"enabled"`
+	Header        string                  `yaml:"header"`
+	FromBasicAuth bool                    `yaml:"from_basic_auth"`
+	DefaultTenant string                  `yaml:"default_tenant"`
+	Tenants       map[string]tenantConfig `yaml:"tenants"`
+}
+
+// tenantConfig isolates one tenant. Anything left out is taken from the
+// top-level settings.
+type tenantConfig struct {
+	Database       string                  `yaml:"database,omitempty"`
+	ResourceFilter *resourceFilter         `yaml:"resource_filter,omitempty"`
+	ClickHouse     *tenantClickHouseConfig `yaml:"clickhouse,omitempty"`
+	Limits         tenantLimitsConfig      `yaml:"limits,omitempty"`
+	// BearerTokens authenticate requests as this tenant, which they then
+	// cannot change with the tenant header.
+	BearerTokens []string `yaml:"bearer_tokens,omitempty"`
+}
+
+// resourceFilter restricts a tenant to the rows whose resource attribute has
+// the given value. Points the tenant writes get the attribute set.
+type resourceFilter struct {
+	Attribute string `yaml:"attribute"`
+	Value     string `yaml:"value"`
+}
+
+type tenantClickHouseConfig struct {
+	Address  string `yaml:"address"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type tenantLimitsConfig struct {
+	MaxRows            *int  `yaml:"max_rows,omitempty"`
+	MaxStreamedRows    *int  `yaml:"max_streamed_rows,omitempty"`
+	MaxSamples         *int  `yaml:"max_samples,omitempty"`
+	MetadataLimit      *int  `yaml:"metadata_limit,omitempty"`
+	MaxSeriesPerQuery  *int  `yaml:"max_series_per_query,omitempty"`
+	MaxSamplesPerQuery *int  `yaml:"max_samples_per_query,omitempty"`
+	MaxBytesPerQuery   *int  `yaml:"max_bytes_per_query,omitempty"`
+	PartialResponse    *bool `yaml:"partial_response,omitempty"`
+}
+
+// apply returns base with the limits set in l replaced.
+func (l tenantLimitsConfig) apply(base limitsConfig) limitsConfig {
+	for _, f := range []struct {
+		v   *int
+		out *int
+	}{
+		{l.MaxRows, &base.MaxRows},
+		{l.MaxStreamedRows, &base.MaxStreamedRows},
+		{l.MaxSamples, &base.MaxSamples},
+		{l.MetadataLimit, &base.MetadataLimit},
+		{l.MaxSeriesPerQuery, &base.MaxSeriesPerQuery},
+		{l.MaxSamplesPerQuery, &base.MaxSamplesPerQuery},
+		{l.MaxBytesPerQuery, &base.MaxBytesPerQuery},
+	} {
+		if f.v != nil {
+			*f.out = *f.v
+		}
+	}
+	if l.PartialResponse != nil {
+		base.PartialResponse = *l.PartialResponse
+	}
+	return base
+}
+
+func defaultConfig() *config {
+	return &config{
+		ClickHouse: clickHouseConfig{
+			Address:  "clickhouse-server:9000",
+			Database: "otel_metrics",
+			Username: "otel_user",
+			Password: "otel_pass",
+
+			PingInterval: model.Duration(10 * time.Second),
+		},
+		Tables: tablesConfig{
+			Sum:                  "otel_metrics_sum",
+			Gauge:                "otel_metrics_gauge",
+			Histogram:            "otel_metrics_histogram",
+			ExponentialHistogram: "otel_metrics_exponential_histogram",
+			Summary:              "otel_metrics_summary",
+		},
+		Query: queryConfig{
+			Timeout:              model.Duration(30 * time.Second),
+			LookbackDelta:        model.Duration(5 * time.Minute),
+			MetadataDefaultRange: model.Duration(time.Hour),
+			MetricCatalogTTL:     model.Duration(time.Minute),
+			MetricCatalogRange:   model.Duration(24 * time.Hour),
+			ReadConcurrency:      4,
+			ShardInterval:        model.Duration(24 * time.Hour),
+			MaxConcurrency:       32,
+			MaxQueued:            256,
+			QueueTimeout:         model.Duration(10 * time.Second),
+		},
+		Cache: cacheConfig{
+			MaxSizeBytes: 256 << 20,
+			TTL:          model.Duration(10 * time.Minute),
+			MaxFreshness: model.Duration(10 * time.Minute),
+		},
+		Limits: limitsConfig{
+			MaxRows:       20000,
+			MaxSamples:    50000000,
+			MetadataLimit: 10000,
+		},
+		Web: webConfig{
+			ListenAddress:   ":9364",
+			DrainDelay:      model.Duration(5 * time.Second),
+			ShutdownTimeout: model.Duration(30 * time.Second),
+		},
+		Tenancy: tenancyConfig{
+			Header: "X-Scope-OrgID",
+		},
+		Telemetry: telemetryConfig{
+			MetricsPath: "/metrics",
+			OTLP: otlpConfig{
+				Interval: model.Duration(time.Minute),
+			},
+		},
+	}
+}
+
+// setting binds one config field to a command-line flag, an environment
+// variable, or both.
+type setting struct {
+	flag  string
+	env   string
+	help  string
+	value flag.Value
+}
+
+func (c *config) settings() []setting {
+	return []setting{
+		{"clickhouse.address", "CLICKHOUSE_ADDR", "ClickHouse native protocol address.", (*stringValue)(&c.ClickHouse.Address)},
+		{"clickhouse.database", "CLICKHOUSE_DB", "ClickHouse database holding the metric tables.", (*stringValue)(&c.ClickHouse.Database)},
+		{"clickhouse.username", "CLICKHOUSE_USER", "ClickHouse user.", (*stringValue)(&c.ClickHouse.Username)},
+		{"", "CLICKHOUSE_PASS", "", (*stringValue)(&c.ClickHouse.Password)},
+		{"clickhouse.tls.enabled", "CLICKHOUSE_SECURE", "Connect to ClickHouse over TLS.", (*boolValue)(&c.ClickHouse.TLS.Enabled)},
+		{"clickhouse.tls.ca-file", "CLICKHOUSE_TLS_CA_FILE", "CA certificates to verify ClickHouse with.", (*stringValue)(&c.ClickHouse.TLS.CAFile)},
+		{"clickhouse.tls.cert-file", "CLICKHOUSE_TLS_CERT_FILE", "Client certificate to present to ClickHouse.", (*stringValue)(&c.ClickHouse.TLS.CertFile)},
+		{"clickhouse.tls.key-file", "CLICKHOUSE_TLS_KEY_FILE", "Key of the client certificate.", (*stringValue)(&c.ClickHouse.TLS.KeyFile)},
+		{"clickhouse.tls.server-name", "CLICKHOUSE_TLS_SERVER_NAME", "Server name to verify ClickHouse's certificate against.", (*stringValue)(&c.ClickHouse.TLS.ServerName)},
+		{"clickhouse.tls.insecure-skip-verify", "CLICKHOUSE_TLS_INSECURE_SKIP_VERIFY", "Do not verify ClickHouse's certificate.", (*boolValue)(&c.ClickHouse.TLS.InsecureSkipVerify)},
+		{"clickhouse.ping-interval", "CLICKHOUSE_PING_INTERVAL", "How often ClickHouse is pinged for the readiness check.", &c.ClickHouse.PingInterval},
+
+		{"tables.sum", "CLICKHOUSE_TABLE", "Table of sum metrics.", (*stringValue)(&c.Tables.Sum)},
+		{"tables.gauge", "CLICKHOUSE_GAUGE_TABLE", "Table of gauge metrics.", (*stringValue)(&c.Tables.Gauge)},
+		{"tables.histogram", "CLICKHOUSE_HISTOGRAM_TABLE", "Table of histogram metrics.", (*stringValue)(&c.Tables.Histogram)},
+		{"tables.exponential-histogram", "CLICKHOUSE_EXP_HISTOGRAM_TABLE", "Table of exponential histogram metrics.", (*stringValue)(&c.Tables.ExponentialHistogram)},
+		{"tables.summary", "CLICKHOUSE_SUMMARY_TABLE", "Table of summary metrics.", (*stringValue)(&c.Tables.Summary)},
+
+		{"query.timeout", "QUERY_TIMEOUT", "Timeout of a request, including every ClickHouse query it runs.", &c.Query.Timeout},
+		{"query.lookback-delta", "QUERY_LOOKBACK_DELTA", "How far back PromQL looks for the latest sample of a series.", &c.Query.LookbackDelta},
+		{"query.metadata-default-range", "METADATA_DEFAULT_RANGE", "Range searched by metadata endpoints when none is given.", &c.Query.MetadataDefaultRange},
+		{"query.metric-catalog-ttl", "METRIC_CATALOG_TTL", "How long the list of known metrics is cached.", &c.Query.MetricCatalogTTL},
+		{"query.metric-catalog-range", "METRIC_CATALOG_RANGE", "How far back the list of known metrics looks for metric names.", &c.Query.MetricCatalogRange},
+		{"query.pushdown", "PUSHDOWN_ENABLED", "Downsample points in ClickHouse when the query allows it.", (*boolValue)(&c.Query.Pushdown)},
+		{"query.remote-read-exemplars", "REMOTE_READ_EXEMPLARS", "Return exemplars in remote-read responses.", (*boolValue)(&c.Query.RemoteReadExemplars)},
+		{"query.read-concurrency", "READ_CONCURRENCY", "Queries of one remote-read request run at once.", (*intValue)(&c.Query.ReadConcurrency)},
+		{"query.shard-interval", "QUERY_SHARD_INTERVAL", "Split queries into shards of this much time, read in parallel; 0 to disable.", &c.Query.ShardInterval},
+		{"query.max-concurrency", "MAX_CONCURRENT_QUERIES", "ClickHouse queries run at once across all requests; 0 for no limit.", (*intValue)(&c.Query.MaxConcurrency)},
+		{"query.max-queued", "MAX_QUEUED_QUERIES", "ClickHouse queries waiting for a slot before new ones are turned away.", (*intValue)(&c.Query.MaxQueued)},
+		{"query.queue-timeout", "QUERY_QUEUE_TIMEOUT", "How long a ClickHouse query waits for a slot.", &c.Query.QueueTimeout},
+
+		{"cache.enabled", "CACHE_ENABLED", "Cache query results so refreshes only read new points.", (*boolValue)(&c.Cache.Enabled)},
+		{"cache.max-size-bytes", "CACHE_MAX_SIZE_BYTES", "Memory budget of the query result cache.", (*intValue)(&c.Cache.MaxSizeBytes)},
+		{"cache.ttl", "CACHE_TTL", "How long cached results are reused before being read again in full.", &c.Cache.TTL},
+		{"cache.max-freshness", "CACHE_MAX_FRESHNESS", "Points newer than this are never cached.", &c.Cache.MaxFreshness},
+
+		{"limits.max-rows", "MAX_ROWS", "Maximum rows read per query, across its shards.", (*intValue)(&c.Limits.MaxRows)},
+		{"limits.max-streamed-rows", "MAX_STREAMED_ROWS", "Maximum rows read per streamed remote-read query.", (*intValue)(&c.Limits.MaxStreamedRows)},
+		{"limits.max-samples", "QUERY_MAX_SAMPLES", "Maximum samples a PromQL query may load.", (*intValue)(&c.Limits.MaxSamples)},
+		{"limits.metadata-limit", "METADATA_LIMIT", "Maximum results of a metadata query.", (*intValue)(&c.Limits.MetadataLimit)},
+		{"limits.max-series-per-query", "MAX_SERIES_PER_QUERY", "Maximum series a query may return.", (*intValue)(&c.Limits.MaxSeriesPerQuery)},
+		{"limits.max-samples-per-query", "MAX_SAMPLES_PER_QUERY", "Maximum samples a query may return.", (*intValue)(&c.Limits.MaxSamplesPerQuery)},
+		{"limits.max-bytes-per-query", "MAX_BYTES_PER_QUERY", "Maximum estimated bytes of the series a query may return.", (*intValue)(&c.Limits.MaxBytesPerQuery)},
+		{"limits.partial-response", "PARTIAL_RESPONSE", "Return what a query read before hitting a limit, with a warning, instead of failing it.", (*boolValue)(&c.Limits.PartialResponse)},
+
+		{"web.listen-address", "PROXY_LISTEN", "Address to listen on.", (*stringValue)(&c.Web.ListenAddress)},
+		{"web.tls-cert-file", "TLS_CERT_FILE", "TLS certificate to serve with.", (*stringValue)(&c.Web.TLSCertFile)},
+		{"web.tls-key-file", "TLS_KEY_FILE", "TLS key to serve with.", (*stringValue)(&c.Web.TLSKeyFile)},
+		{"web.tls-min-version", "TLS_MIN_VERSION", "Oldest TLS version accepted: TLS12 or TLS13.", (*stringValue)(&c.Web.TLSMinVersion)},
+		{"web.client-ca-file", "TLS_CLIENT_CA_FILE", "CA certificates to verify client certificates with.", (*stringValue)(&c.Web.ClientCAFile)},
+		{"web.client-auth-type", "TLS_CLIENT_AUTH_TYPE", "Client certificate policy, such as RequireAndVerifyClientCert.", (*stringValue)(&c.Web.ClientAuthType)},
+		{"web.drain-delay", "DRAIN_DELAY", "How long the proxy keeps serving, not ready, after SIGTERM.", &c.Web.DrainDelay},
+		{"web.shutdown-timeout", "SHUTDOWN_TIMEOUT", "How long in-flight requests may finish after SIGTERM.", &c.Web.ShutdownTimeout},
+
+		{"labels.promote-resource-attributes", "PROMOTE_RESOURCE_ATTRIBUTES", "Comma-separated resource attributes to turn into labels.", (*listValue)(&c.Labels.PromoteResourceAttributes)},
+		{"labels.target-info", "TARGET_INFO_ENABLED", "Synthesize the target_info series.", (*boolValue)(&c.Labels.TargetInfo)},
+		{"labels.translate-names", "TRANSLATE_NAMES", "Translate OTel names to Prometheus conventions and add job, instance and otel_scope_* labels.", (*boolValue)(&c.Labels.TranslateNames)},
+
+		{"tenancy.enabled", "TENANCY_ENABLED", "Serve the tenants of the config file, each isolated from the others.", (*boolValue)(&c.Tenancy.Enabled)},
+		{"tenancy.header", "TENANT_HEADER", "Request header naming the tenant.", (*stringValue)(&c.Tenancy.Header)},
+		{"tenancy.default-tenant", "DEFAULT_TENANT", "Tenant of requests that do not name one.", (*stringValue)(&c.Tenancy.DefaultTenant)},
+
+		{"telemetry.metrics-path", "TELEMETRY_METRICS_PATH", "Path serving the proxy's own metrics.", (*stringValue)(&c.Telemetry.MetricsPath)},
+		{"telemetry.otlp.enabled", "TELEMETRY_OTLP_ENABLED", "Push the proxy's own metrics over OTLP gRPC.", (*boolValue)(&c.Telemetry.OTLP.Enabled)},
+		{"telemetry.otlp.endpoint", "TELEMETRY_OTLP_ENDPOINT", "OTLP gRPC endpoint; defaults to OTEL_EXPORTER_OTLP_ENDPOINT.", (*stringValue)(&c.Telemetry.OTLP.Endpoint)},
+		{"telemetry.otlp.insecure", "TELEMETRY_OTLP_INSECURE", "Push over plaintext gRPC.", (*boolValue)(&c.Telemetry.OTLP.Insecure)},
+		{"telemetry.otlp.interval", "TELEMETRY_OTLP_INTERVAL", "How often to push.", &c.Telemetry.OTLP.Interval},
+	}
+}
+
+// registerFlags adds a flag to fs for every setting that has one. The flags
+// write straight into c.
+func (c *config) registerFlags(fs *flag.FlagSet) {
+	for _, s := range c.settings() {
+		if s.flag == "" {
+			continue
+		}
+		help := s.help
+		if s.env != "" {
+			help += " Env: " + s.env + "."
+		}
+		fs.Var(s.value, s.flag, help)
+	}
+}
+
+// load completes c, whose flags in fs have already been parsed, from the
+// config file and the environment, then validates it.
+func (c *config) load(file string, fs *flag.FlagSet) error {
+	// The file and environment are applied over the parsed flags, so note
+	// which flags were given to apply them again last.
+	explicit := map[string]string{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = f.Value.String() })
+
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := yaml.UnmarshalStrict(b, c); err != nil {
+			return fmt.Errorf("parsing %s: %w", file, err)
+		}
+	}
+
+	if err := c.loadEnv(); err != nil {
+		return err
+	}
+
+	for name, v := range explicit {
+		if f := fs.Lookup(name); f != nil {
+			if err := f.Value.Set(v); err != nil {
+				return fmt.Errorf("flag -%s: %w", name, err)
+			}
+		}
+	}
+
+	return c.validate()
+}
+
+func (c *config) loadEnv() error {
+	// CLICKHOUSE_HOST and CLICKHOUSE_PORT, as set by the Dockerfile, make up
+	// an address; CLICKHOUSE_ADDR wins over both.
+	host, port := os.Getenv("CLICKHOUSE_HOST"), os.Getenv("CLICKHOUSE_PORT")
+	if host != "" || port != "" {
+		h, p, err := net.SplitHostPort(c.ClickHouse.Address)
+		if err != nil {
+			h, p = c.ClickHouse.Address, "9000"
+		}
+		if host != "" {
+			h = host
+		}
+		if port != "" {
+			p = port
+		}
+		c.ClickHouse.Address = net.JoinHostPort(h, p)
+	}
+
+	for _, s := range c.settings() {
+		if s.env == "" {
+			continue
+		}
+		if v := os.Getenv(s.env); v != "" {
+			if err := s.value.Set(v); err != nil {
+				return fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+	return nil
+}
+
+var identifierRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validate reports every problem with c at once.
+func (c *config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	// Database and table names are written into queries as they are.
+	identifier := func(field, name string) {
+		check(identifierRE.MatchString(name), "%s: %q is not a valid ClickHouse identifier", field, name)
+	}
+
+	check(c.ClickHouse.Address != "", "clickhouse.address must be set")
+	identifier("clickhouse.database", c.ClickHouse.Database)
+
+	identifier("tables.sum", c.Tables.Sum)
+	identifier("tables.gauge", c.Tables.Gauge)
+	identifier("tables.histogram", c.Tables.Histogram)
+	identifier("tables.exponential_histogram", c.Tables.ExponentialHistogram)
+	identifier("tables.summary", c.Tables.Summary)
+
+	check(c.Query.Timeout > 0, "query.timeout must be positive")
+	check(c.Query.LookbackDelta > 0, "query.lookback_delta must be positive")
+	check(c.Query.MetadataDefaultRange > 0, "query.metadata_default_range must be positive")
+	check(c.Query.MetricCatalogTTL >= 0, "query.metric_catalog_ttl must not be negative")
+	check(c.Query.MetricCatalogRange > 0, "query.metric_catalog_range must be positive")
+	check(c.Query.ReadConcurrency > 0, "query.read_concurrency must be positive")
+	check(c.Query.ShardInterval >= 0, "query.shard_interval must not be negative")
+	check(c.Query.MaxConcurrency >= 0, "query.max_concurrency must not be negative")
+	if c.Query.MaxConcurrency > 0 {
+		check(c.Query.MaxQueued >= 0, "query.max_queued must not be negative")
+		check(c.Query.QueueTimeout > 0, "query.queue_timeout must be positive")
+	}
+
+	if c.Cache.Enabled {
+		check(c.Cache.MaxSizeBytes > 0, "cache.max_size_bytes must be positive")
+		check(c.Cache.TTL > 0, "cache.ttl must be positive")
+		check(c.Cache.MaxFreshness >= 0, "cache.max_freshness must not be negative")
+	}
+
+	check(c.Limits.MaxRows >= 0, "limits.max_rows must not be negative")
+	check(c.Limits.MaxStreamedRows >= 0, "limits.max_streamed_rows must not be negative")
+	check(c.Limits.MaxSamples >= 0, "limits.max_samples must not be negative")
+	check(c.Limits.MetadataLimit >= 0, "limits.metadata_limit must not be negative")
+	check(c.Limits.MaxSeriesPerQuery >= 0, "limits.max_series_per_query must not be negative")
+	check(c.Limits.MaxSamplesPerQuery >= 0, "limits.max_samples_per_query must not be negative")
+	check(c.Limits.MaxBytesPerQuery >= 0, "limits.max_bytes_per_query must not be negative")
+
+	check(c.ClickHouse.PingInterval > 0, "clickhouse.ping_interval must be positive")
+	check(c.Web.ListenAddress != "", "web.listen_address must be set")
+	check(c.Web.DrainDelay >= 0, "web.drain_delay must not be negative")
+	check(c.Web.ShutdownTimeout >= 0, "web.shutdown_timeout must not be negative")
+	if _, err := c.Web.tlsConfig(); err != nil {
+		errs = append(errs, fmt.Errorf("web TLS: %w", err))
+	}
+	for user, hash := range c.Web.BasicAuthUsers {
+		_, err := bcrypt.Cost([]byte(hash))
+		check(err == nil, "web.basic_auth_users.%s: not a bcrypt hash: %v", user, err)
+	}
+	for _, token := range c.Web.BearerTokens {
+		check(token != "", "web.bearer_tokens must not contain empty tokens")
+	}
+	if _, err := c.ClickHouse.TLS.tlsConfig(); err != nil {
+		errs = append(errs, fmt.Errorf("clickhouse TLS: %w", err))
+	}
+
+	for _, attr := range c.Labels.PromoteResourceAttributes {
+		check(strings.TrimSpace(attr) != "", "labels.promote_resource_attributes must not contain empty names")
+	}
+
+	check(strings.HasPrefix(c.Telemetry.MetricsPath, "/"), "telemetry.metrics_path must start with /")
+	check(!c.Telemetry.OTLP.Enabled || c.Telemetry.OTLP.Interval > 0, "telemetry.otlp.interval must be positive")
+
+	if c.Tenancy.Enabled {
+		check(c.Tenancy.Header != "" || c.Tenancy.FromBasicAuth || c.Tenancy.DefaultTenant != "", "tenancy needs a header, from_basic_auth or a default_tenant")
+		check(len(c.Tenancy.Tenants) > 0, "tenancy.tenants must not be empty")
+		// An unverified basic-auth user is whatever the client claims.
+		check(!c.Tenancy.FromBasicAuth || len(c.Web.BasicAuthUsers) > 0, "tenancy.from_basic_auth needs web.basic_auth_users")
+		// A header the client sets must not pick another tenant than the
+		// user it logged in as.
+		check(!c.Tenancy.FromBasicAuth || c.Tenancy.Header == "", `tenancy.header and tenancy.from_basic_auth cannot both be set; set header to ""`)
+		if id := c.Tenancy.DefaultTenant; id != "" {
+			_, ok := c.Tenancy.Tenants[id]
+			check(ok, "tenancy.default_tenant %q is not a configured tenant", id)
+		}
+		for id, t := range c.Tenancy.Tenants {
+			if t.Database != "" {
+				identifier(fmt.Sprintf("tenancy.tenants.%s.database", id), t.Database)
+			}
+			if f := t.ResourceFilter; f != nil {
+				check(f.Attribute != "", "tenancy.tenants.%s.resource_filter.attribute must be set", id)
+			}
+			for _, token := range t.BearerTokens {
+				check(token != "", "tenancy.tenants.%s.bearer_tokens must not contain empty tokens", id)
+				check(!slices.Contains(c.Web.BearerTokens, token), "tenancy.tenants.%s.bearer_tokens must not repeat web.bearer_tokens", id)
+				for other, o := range c.Tenancy.Tenants {
+					check(other >= id || !slices.Contains(o.BearerTokens, token), "tenancy.tenants.%s.bearer_tokens must not repeat the tokens of %s", id, other)
+				}
+			}
+			for _, v := range []*int{t.Limits.MaxRows, t.Limits.MaxStreamedRows, t.Limits.MaxSamples, t.Limits.MetadataLimit,
+				t.Limits.MaxSeriesPerQuery, t.Limits.MaxSamplesPerQuery, t.Limits.MaxBytesPerQuery} {
+				check(v == nil || *v >= 0, "tenancy.tenants.%s.limits must not be negative", id)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// apply makes c the configuration the proxy runs with.
+func (c *config) apply() {
+	chDatabase = c.ClickHouse.Database
+
+	chTable = c.Tables.Sum
+	chGaugeTable = c.Tables.Gauge
+	chHistogramTable = c.Tables.Histogram
+	chExponentialHistogramTable = c.Tables.ExponentialHistogram
+	chSummaryTable = c.Tables.Summary
+
+	queryTimeout = time.Duration(c.Query.Timeout)
+	queryLookbackDelta = time.Duration(c.Query.LookbackDelta)
+	metadataDefaultRange = time.Duration(c.Query.MetadataDefaultRange)
+	metricCatalogTTL = time.Duration(c.Query.MetricCatalogTTL)
+	metricCatalogRange = time.Duration(c.Query.MetricCatalogRange)
+	pushdownEnabled = c.Query.Pushdown
+	remoteReadExemplars = c.Query.RemoteReadExemplars
+	readConcurrency = c.Query.ReadConcurrency
+	shardInterval = time.Duration(c.Query.ShardInterval)
+
+	clickHouseLimiter = nil
+	if c.Query.MaxConcurrency > 0 {
+		clickHouseLimiter = newQueryLimiter(c.Query.MaxConcurrency, c.Query.MaxQueued, time.Duration(c.Query.QueueTimeout))
+	}
+
+	resultCache = nil
+	if c.Cache.Enabled {
+		resultCache = newQueryCache(c.Cache)
+	}
+
+	listenAddr = c.Web.ListenAddress
+
+	promoteResourceAttrs = nil
+	for _, attr := range c.Labels.PromoteResourceAttributes {
+		promoteResourceAttrs = append(promoteResourceAttrs, strings.TrimSpace(attr))
+	}
+	targetInfoEnabled = c.Labels.TargetInfo
+	translateNames = c.Labels.TranslateNames
+}
+
+type stringValue string
+
+func (v *stringValue) Set(s string) error { *v = stringValue(s); return nil }
+func (v *stringValue) String() string     { return string(*v) }
+
+type intValue int
+
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*v = intValue(n)
+	return nil
+}
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+
+type boolValue bool
+
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*v = boolValue(b)
+	return nil
+}
+func (v *boolValue) String() string   { return strconv.FormatBool(bool(*v)) }
+func (v *boolValue) IsBoolFlag() bool { return true }
+
+// listValue is a comma-separated list.
+type listValue []string
+
+func (v *listValue) Set(s string) error {
+	*v = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*v = append(*v, item)
+		}
+	}
+	return nil
+}
+func (v *listValue) String() string { return strings.Join(*v, ",") }
+
+// String renders c as YAML with the password masked, for -check-config.
+func (c *config) String() string {
+	masked := *c
+	if masked.ClickHouse.Password != "" {
+		masked.ClickHouse.Password = "<secret>"
+	}
+	masked.Web.BearerTokens = nil
+	for range c.Web.BearerTokens {
+		masked.Web.BearerTokens = append(masked.Web.BearerTokens, "<secret>")
+	}
+	masked.Tenancy.Tenants = map[string]tenantConfig{}
+	for id, t := range c.Tenancy.Tenants {
+		if len(t.BearerTokens) > 0 {
+			t.BearerTokens = slices.Repeat([]string{"<secret>"}, len(t.BearerTokens))
+		}
+		if t.ClickHouse != nil && t.ClickHouse.Password != "" {
+			ch := *t.ClickHouse
+			ch.Password = "<secret>"
+			t.ClickHouse = &ch
+		}
+		masked.Tenancy.Tenants[id] = t
+	}
+	b, err := yaml.Marshal(&masked)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// loadTestConfig loads a config the way main does, from yaml, the
+// environment set by the caller and args.
+func loadTestConfig(t *testing.T, yaml string, args ...string) (*config, error) {
+	t.Helper()
+	file := ""
+	if yaml != "" {
+		file = filepath.Join(t.TempDir(), "config.yml")
+		if err := os.WriteFile(file, []byte(yaml), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := defaultConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c.registerFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return c, c.load(file, fs)
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	t.Setenv("READ_CONCURRENCY", "3")
+	t.Setenv("MAX_ROWS", "20")
+	c, err := loadTestConfig(t, `
+query:
+  read_concurrency: 2
+  lookback_delta: 2m
+limits:
+  max_rows: 10
+  max_samples: 7
+`, "-limits.max-rows=30", "-query.pushdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		what      string
+		got, want interface{}
+	}{
+		{"file over default", c.Query.LookbackDelta, model.Duration(2 * time.Minute)},
+		{"file alone", c.Limits.MaxSamples, 7},
+		{"env over file", c.Query.ReadConcurrency, 3},
+		{"flag over env and file", c.Limits.MaxRows, 30},
+		{"flag over default", c.Query.Pushdown, true},
+		{"default", c.Query.MetricCatalogTTL, defaultConfig().Query.MetricCatalogTTL},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.what, tc.got, tc.want)
+		}
+	}
+}
+
+func TestConfigClickHouseAddressFromEnv(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		yaml string
+		want string
+	}{
+		{"default", nil, "", "clickhouse-server:9000"},
+		{"host", map[string]string{"CLICKHOUSE_HOST": "ch"}, "", "ch:9000"},
+		{"port", map[string]string{"CLICKHOUSE_PORT": "9440"}, "", "clickhouse-server:9440"},
+		{"host over file", map[string]string{"CLICKHOUSE_HOST": "ch"}, "clickhouse:\n  address: file:9001\n", "ch:9001"},
+		{"address wins", map[string]string{"CLICKHOUSE_HOST": "ch", "CLICKHOUSE_ADDR": "addr:1"}, "", "addr:1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, k := range []string{"CLICKHOUSE_HOST", "CLICKHOUSE_PORT", "CLICKHOUSE_ADDR"} {
+				t.Setenv(k, tc.env[k])
+			}
+			c, err := loadTestConfig(t, tc.yaml)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.ClickHouse.Address != tc.want {
+				t.Errorf("got %q, want %q", c.ClickHouse.Address, tc.want)
+			}
+		})
+	}
+}
+
+func TestConfigRejectsUnknownFields(t *testing.T) {
+	if _, err := loadTestConfig(t, "query:\n  read_concurency: 2\n"); err == nil {
+		t.Error("a misspelt field must fail")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := defaultConfig().validate(); err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		modify func(c *config)
+		want   []string
+	}{
+		{"table names are identifiers", func(c *config) { c.Tables.Sum = "sum; DROP TABLE x" }, []string{"tables.sum"}},
+		{"timeouts", func(c *config) { c.Query.Timeout = 0 }, []string{"query.timeout"}},
+		{"queue only checked with a limit", func(c *config) { c.Query.QueueTimeout = 0; c.Query.MaxConcurrency = 0 }, nil},
+		{"queue timeout", func(c *config) { c.Query.QueueTimeout = 0 }, []string{"query.queue_timeout"}},
+		{"negative limits", func(c *config) { c.Limits.MaxRows, c.Limits.MaxSamples = -1, -1 }, []string{"limits.max_rows", "limits.max_samples"}},
+		{"bcrypt hashes", func(c *config) { c.Web.BasicAuthUsers = map[string]string{"u": "plain"} }, []string{"not a bcrypt hash"}},
+		{"metrics path", func(c *config) { c.Telemetry.MetricsPath = "metrics" }, []string{"metrics_path"}},
+		{"tenancy without tenants", func(c *config) { c.Tenancy.Enabled = true }, []string{"tenancy.tenants"}},
+		{"unknown default tenant", func(c *config) {
+			c.Tenancy.Enabled, c.Tenancy.DefaultTenant = true, "x"
+			c.Tenancy.Tenants = map[string]tenantConfig{"a": {}}
+		}, []string{`default_tenant "x"`}},
+		{"tenant tokens shared", func(c *config) {
+			c.Tenancy.Enabled = true
+			c.Tenancy.Tenants = map[string]tenantConfig{"a": {BearerTokens: []string{"t"}}, "b": {BearerTokens: []string{"t"}}}
+		}, []string{"tenancy.tenants.b.bearer_tokens must not repeat the tokens of a"}},
+		{"every problem at once", func(c *config) { c.Web.ListenAddress, c.Query.ReadConcurrency = "", 0 }, []string{"web.listen_address", "query.read_concurrency"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := defaultConfig()
+			tc.modify(c)
+			err := c.validate()
+			if len(tc.want) == 0 {
+				if err != nil {
+					t.Fatalf("got %v, want no error", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("got no error, want %q", tc.want)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTenantLimitsApply(t *testing.T) {
+	rows, partial := 5, true
+	base := limitsConfig{MaxRows: 100, MaxSamples: 200}
+	got := tenantLimitsConfig{MaxRows: &rows, PartialResponse: &partial}.apply(base)
+	want := limitsConfig{MaxRows: 5, MaxSamples: 200, PartialResponse: true}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+type metricType int
+
+const (
+	metricTypeSum metricType = iota
+	metricTypeGauge
+	metricTypeHistogram
+	metricTypeExponentialHistogram
+	metricTypeSummary
+)
+
+func (t metricType) String() string {
+	switch t {
+	case metricTypeSum:
+		return "sum"
+	case metricTypeGauge:
+		return "gauge"
+	case metricTypeHistogram:
+		return "histogram"
+	case metricTypeExponentialHistogram:
+		return "exponential_histogram"
+	case metricTypeSummary:
+		return "summary"
+	}
+	return fmt.Sprintf("metricType(%d)", int(t))
+}
+
+// table returns the ClickHouse table holding metrics of this type.
+func (t metricType) table() string {
+	switch t {
+	case metricTypeSum:
+		return chTable
+	case metricTypeGauge:
+		return chGaugeTable
+	case metricTypeHistogram:
+		return chHistogramTable
+	case metricTypeExponentialHistogram:
+		return chExponentialHistogramTable
+	case metricTypeSummary:
+		return chSummaryTable
+	}
+	return ""
+}
+
+// nameSuffixes lists the suffixes appended to MetricName for the series a
+// metric of this type is exposed as.
+func (t metricType) nameSuffixes() []string {
+	switch t {
+	case metricTypeHistogram:
+		return histogramSuffixes
+	case metricTypeSummary:
+		return summarySuffixes
+	}
+	return []string{""}
+}
+
+// nameExprs returns the ClickHouse expressions for every __name__ a row of
+// this type is exposed under.
+func (t metricType) nameExprs() []string {
+	var out []string
+	for _, suffix := range t.nameSuffixes() {
+		if suffix == "" {
+			out = append(out, "MetricName")
+			continue
+		}
+		out = append(out, fmt.Sprintf("concat(MetricName, '%s')", suffix))
+	}
+	return out
+}
+
+// syntheticLabel is the label the proxy adds to sub-series of this type, or
+// an empty string if there is none.
+func (t metricType) syntheticLabel() string {
+	switch t {
+	case metricTypeHistogram:
+		return "le"
+	case metricTypeSummary:
+		return "quantile"
+	}
+	return ""
+}
+
+type queryHandler func(ctx context.Context, q *prompb.Query, app seriesAppender) error
+
+var (
+	allMetricTypes = []metricType{
+		metricTypeSum,
+		metricTypeGauge,
+		metricTypeHistogram,
+		metricTypeExponentialHistogram,
+		metricTypeSummary,
+	}
+
+	queryHandlers = map[metricType]queryHandler{
+		metricTypeSum:                  ProcessQuerySum,
+		metricTypeGauge:                ProcessQueryGauge,
+		metricTypeHistogram:            ProcessQuery,
+		metricTypeExponentialHistogram: processQueryExponentialHistogram,
+		metricTypeSummary:              processQuerySummary,
+	}
+
+	// Suffixes Prometheus uses for the sub-series of a classic histogram.
+	histogramSuffixes = []string{"_bucket", "_sum", "_count"}
+
+	// Summaries expose their quantiles under the bare name.
+	summarySuffixes = []string{"", "_sum", "_count"}
+)
+
+// metricCatalog caches which metric names live in which table, so that a
+// query can be routed to the right handler without probing every table.
+// Each tenant has its own.
+type metricCatalog struct {
+	mu      sync.Mutex
+	snap    *catalogSnapshot
+	updated time.Time
+	// refreshing is closed when the refresh in flight, if any, is done.
+	refreshing chan struct{}
+	err        error
+}
+
+// catalogSnapshot is one refresh of the catalog. It is never modified once
+// built, so callers can hold on to it without locking.
+type catalogSnapshot struct {
+	// types are the metric types whose tables could be read.
+	types []metricType
+	names map[string]*catalogEntry
+	// exposed maps the raw name of every series a metric is read as, such as
+	// MetricName + "_bucket", to the name the proxy exposes it under.
+	exposed map[string]string
+}
+
+type catalogEntry struct {
+	types     []metricType
+	unit      string
+	monotonic bool
+}
+
+// lookup returns the catalog of the tenant in ctx. Once the catalog is older
+// than metricCatalogTTL, one refresh runs in the background and callers keep
+// getting the stale copy meanwhile; only the very first lookup waits for
+// ClickHouse.
+func (c *metricCatalog) lookup(ctx context.Context) (*catalogSnapshot, error) {
+	c.mu.Lock()
+	snap := c.snap
+	if snap != nil && time.Since(c.updated) < metricCatalogTTL {
+		c.mu.Unlock()
+		return snap, nil
+	}
+	refreshing := c.refreshing
+	if refreshing == nil {
+		refreshing = make(chan struct{})
+		c.refreshing = refreshing
+		go c.refresh(tenantFrom(ctx), refreshing)
+	}
+	c.mu.Unlock()
+
+	if snap != nil {
+		return snap, nil
+	}
+	if err := waitFor(ctx, refreshing); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.snap == nil {
+		return nil, c.err
+	}
+	return c.snap, nil
+}
+
+// refresh scans the metric tables of t and closes done once the catalog is
+// updated. It runs outside any request, so that a client going away does not
+// cancel a scan other requests are waiting for.
+func (c *metricCatalog) refresh(t *tenant, done chan struct{}) {
+	ctx, cancel := context.WithTimeout(withTenant(context.Background(), t), queryTimeout)
+	defer cancel()
+	snap, err := scanCatalog(ctx)
+
+	c.mu.Lock()
+	if err != nil {
+		if c.snap != nil {
+			log.Printf("metric catalog refresh error, keeping stale entries: %v", err)
+		}
+		c.err = err
+	} else {
+		c.snap, c.updated, c.err = snap, time.Now(), nil
+	}
+	c.refreshing = nil
+	c.mu.Unlock()
+	close(done)
+}
+
+// scanCatalog lists the metrics written to each table within
+// metricCatalogRange. A table that cannot be read, such as one that was
+// never created, is taken to hold no metrics; only when no table can be read
+// does the scan fail.
+func scanCatalog(ctx context.Context) (*catalogSnapshot, error) {
+	var types []metricType
+	names := map[string]*catalogEntry{}
+	var firstErr error
+	for _, t := range allMetricTypes {
+		found, err := scanCatalogTable(ctx, t)
+		if err != nil {
+			log.Printf("metric catalog: skipping %s metrics: %v", t, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		types = append(types, t)
+		for name, f := range found {
+			e := names[name]
+			if e == nil {
+				e = &catalogEntry{}
+				names[name] = e
+			}
+			e.types = append(e.types, t)
+			if f.unit != "" {
+				e.unit = f.unit
+			}
+			e.monotonic = e.monotonic || f.monotonic
+		}
+	}
+	if len(types) == 0 {
+		return nil, firstErr
+	}
+
+	exposed := map[string]string{}
+	for name, e := range names {
+		for _, t := range e.types {
+			base := name
+			if translateNames {
+				base = normalizeMetricName(name, e.unit, t, e.monotonic)
+			}
+			for _, suffix := range t.nameSuffixes() {
+				exposed[name+suffix] = base + suffix
+			}
+		}
+	}
+	return &catalogSnapshot{types: types, names: names, exposed: exposed}, nil
+}
+
+// scanCatalogTable returns the metrics of type t written within
+// metricCatalogRange. The TimeUnix condition keeps ClickHouse to the latest
+// partitions.
+func scanCatalogTable(ctx context.Context, t metricType) (map[string]*catalogEntry, error) {
+	monotonic := "toUInt8(0)"
+	if t == metricTypeSum {
+		monotonic = "toUInt8(max(IsMonotonic))"
+	}
+	query := fmt.Sprintf(`SELECT MetricName, any(MetricUnit), %s FROM %s
+WHERE TimeUnix >= now64(9) - toIntervalSecond(?)
+GROUP BY MetricName`, monotonic, tableRef(ctx, t.table()))
+	rows, err := queryContext(ctx, query, int64(metricCatalogRange/time.Second))
+	if err != nil {
+		return nil, fmt.Errorf("ClickHouse query error: %w", err)
+	}
+	defer rows.Close()
+
+	found := map[string]*catalogEntry{}
+	for rows.Next() {
+		var name, unit string
+		var monotonic uint8
+		if err := rows.Scan(&name, &unit, &monotonic); err != nil {
+			logScanError(ctx, err)
+			continue
+		}
+		found[name] = &catalogEntry{unit: unit, monotonic: monotonic != 0}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ClickHouse query error: %w", err)
+	}
+	return found, nil
+}
+
+// resolveMetricTypes works out which metric types can answer q by checking
+// its __name__ matchers against the exposed names in the catalog. Queries
+// without a __name__ matcher, or whose names the catalog does not know, fan
+// out to every type whose table could be read.
+func resolveMetricTypes(ctx context.Context, q *prompb.Query) ([]metricType, error) {
+	var nameMatchers []*prompb.LabelMatcher
+	for _, m := range q.Matchers {
+		if m.Name == "__name__" {
+			nameMatchers = append(nameMatchers, m)
+		}
+	}
+	lms, err := toLabelMatchers(nameMatchers)
+	if err != nil {
+		return nil, err
+	}
+	nameMatches := func(name string) bool {
+		for _, lm := range lms {
+			if !lm.Matches(name) {
+				return false
+			}
+		}
+		return true
+	}
+
+	snap, err := tenantFrom(ctx).catalog.lookup(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(nameMatchers) == 0 {
+		return snap.types, nil
+	}
+
+	seen := map[metricType]bool{}
+	for name, e := range snap.names {
+		for _, t := range e.types {
+			if seen[t] {
+				continue
+			}
+			// Classic histograms and summaries are matched through the
+			// names of their sub-series.
+			for _, suffix := range t.nameSuffixes() {
+				if nameMatches(snap.exposed[name+suffix]) {
+					seen[t] = true
+					break
+				}
+			}
+		}
+	}
+
+	if len(seen) == 0 {
+		// The metric may have been last written before metricCatalogRange.
+		return snap.types, nil
+	}
+	var out []metricType
+	for _, t := range allMetricTypes {
+		if seen[t] {
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
+
+// dispatchQuery runs q against every handler whose metric type matches it,
+// feeding all of their series into app. The rows of every handler and shard
+// count against one row limit.
+func dispatchQuery(ctx context.Context, q *prompb.Query, app seriesAppender) error {
+	ctx = withRowBudget(ctx)
+	ctx, limited, err := newLimitingAppender(ctx, q, app)
+	if err != nil {
+		return err
+	}
+	if limited == nil {
+		return dispatch(ctx, q, app)
+	}
+	defer limited.cancel(nil)
+	err = dispatch(ctx, q, limited)
+	// Going over a limit cancels the query, so its error is the one to
+	// report.
+	if limited.err != nil {
+		return limited.err
+	}
+	return err
+}
+
+func dispatch(ctx context.Context, q *prompb.Query, app seriesAppender) error {
+	qt, exposed, err := translateQuery(ctx, q)
+	if err != nil {
+		return err
+	}
+	app = newTranslatingAppender(app, exposed)
+
+	types, err := resolveMetricTypes(ctx, q)
+	if err != nil {
+		return err
+	}
+
+	targetInfo, err := wantsTargetInfo(q)
+	if err != nil {
+		return err
+	}
+	if targetInfo {
+		if err := processQueryTargetInfo(ctx, qt, app); err != nil {
+			return fmt.Errorf("%s query: %w", targetInfoMetric, err)
+		}
+	}
+
+	for _, t := range types {
+		if err := runQueryHandler(ctx, t, queryHandlers[t], qt, app); err != nil {
+			return fmt.Errorf("%s query: %w", t, err)
+		}
+	}
+	return nil
+}
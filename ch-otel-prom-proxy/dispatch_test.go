@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+// catalogRows answers catalog scans with the metrics of each table, failing
+// for the tables in missing.
+func catalogRows(metrics map[string][][]interface{}, missing ...string) func(string, []interface{}) (fakeResult, error) {
+	return func(query string, args []interface{}) (fakeResult, error) {
+		for _, table := range missing {
+			if strings.Contains(query, "."+table+"\n") {
+				return fakeResult{}, fmt.Errorf("Table otel_metrics.%s does not exist", table)
+			}
+		}
+		for table, rows := range metrics {
+			if strings.Contains(query, "."+table+"\n") {
+				return fakeResult{columns: []string{"MetricName", "unit", "monotonic"}, rows: rows}, nil
+			}
+		}
+		return fakeResult{columns: []string{"MetricName", "unit", "monotonic"}}, nil
+	}
+}
+
+func TestMetricCatalogRefresh(t *testing.T) {
+	applyTestConfig(t, nil)
+	f := newFakeClickHouse(catalogRows(map[string][][]interface{}{
+		"otel_metrics_sum":   {{"http.requests", "", uint8(1)}},
+		"otel_metrics_gauge": {{"cpu", "1", uint8(0)}},
+		"otel_metrics_summary": {
+			{"cpu", "", uint8(0)},
+			{"rpc.duration", "ms", uint8(0)},
+		},
+	}, "otel_metrics_histogram"))
+	ctx := f.context(limitsConfig{})
+
+	snap, err := tenantFrom(ctx).catalog.lookup(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The missing histogram table holds no metrics rather than failing the
+	// catalog.
+	wantTypes := []metricType{metricTypeSum, metricTypeGauge, metricTypeExponentialHistogram, metricTypeSummary}
+	if !reflect.DeepEqual(snap.types, wantTypes) {
+		t.Errorf("got types %v, want %v", snap.types, wantTypes)
+	}
+	want := map[string]catalogEntry{
+		"http.requests": {types: []metricType{metricTypeSum}, monotonic: true},
+		"cpu":           {types: []metricType{metricTypeGauge, metricTypeSummary}, unit: "1"},
+		"rpc.duration":  {types: []metricType{metricTypeSummary}, unit: "ms"},
+	}
+	if len(snap.names) != len(want) {
+		t.Errorf("got %d names, want %d", len(snap.names), len(want))
+	}
+	for name, w := range want {
+		if e := snap.names[name]; e == nil || !reflect.DeepEqual(*e, w) {
+			t.Errorf("%s: got %+v, want %+v", name, e, w)
+		}
+	}
+	for _, q := range f.queryLog() {
+		if !strings.Contains(q, "WHERE TimeUnix >= now64(9) - toIntervalSecond(?)") {
+			t.Errorf("catalog scan is not bounded in time: %s", q)
+		}
+	}
+
+	g := newFakeClickHouse(catalogRows(nil, "otel_metrics_sum", "otel_metrics_gauge", "otel_metrics_histogram",
+		"otel_metrics_exponential_histogram", "otel_metrics_summary"))
+	ctx = g.context(limitsConfig{})
+	if _, err := tenantFrom(ctx).catalog.lookup(ctx); err == nil {
+		t.Error("a catalog with no readable table must fail")
+	}
+}
+
+func TestMetricCatalogServesStaleEntriesWhileRefreshing(t *testing.T) {
+	applyTestConfig(t, nil)
+	var mu sync.Mutex
+	name, release := "a", make(chan struct{})
+	f := newFakeClickHouse(func(query string, args []interface{}) (fakeResult, error) {
+		mu.Lock()
+		n := name
+		mu.Unlock()
+		if n == "b" {
+			<-release
+		}
+		return fakeResult{columns: []string{"MetricName", "unit", "monotonic"}, rows: [][]interface{}{{n, "", uint8(0)}}}, nil
+	})
+	ctx := f.context(limitsConfig{})
+	c := tenantFrom(ctx).catalog
+
+	if snap, err := c.lookup(ctx); err != nil || snap.names["a"] == nil {
+		t.Fatalf("first lookup: got %v, %v", snap, err)
+	}
+	scans := len(f.queryLog())
+
+	mu.Lock()
+	name = "b"
+	mu.Unlock()
+	c.mu.Lock()
+	c.updated = time.Time{}
+	c.mu.Unlock()
+	for i := 0; i < 3; i++ {
+		snap, err := c.lookup(ctx)
+		if err != nil || snap.names["a"] == nil {
+			t.Fatalf("lookup during a refresh: got %v, %v, want the stale catalog", snap, err)
+		}
+	}
+	close(release)
+	waitForRefresh(c)
+	if n := len(f.queryLog()) - scans; n != len(allMetricTypes) {
+		t.Errorf("refresh ran %d scans, want one per table", n)
+	}
+	if snap, err := c.lookup(ctx); err != nil || snap.names["b"] == nil {
+		t.Errorf("after the refresh: got %v, %v", snap, err)
+	}
+}
+
+func TestMetricCatalogFailedRefreshKeepsStaleEntries(t *testing.T) {
+	applyTestConfig(t, nil)
+	var mu sync.Mutex
+	var fail error
+	f := newFakeClickHouse(func(query string, args []interface{}) (fakeResult, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return fakeResult{columns: []string{"MetricName", "unit", "monotonic"}, rows: [][]interface{}{{"a", "", uint8(0)}}}, fail
+	})
+	ctx := f.context(limitsConfig{})
+	c := tenantFrom(ctx).catalog
+	if _, err := c.lookup(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	fail = errors.New("connection refused")
+	mu.Unlock()
+	c.mu.Lock()
+	c.updated = time.Time{}
+	c.mu.Unlock()
+	c.lookup(ctx)
+	waitForRefresh(c)
+	if c.err == nil {
+		t.Error("the failed refresh was not recorded")
+	}
+	// The stale catalog is served, and another refresh tried.
+	if snap, err := c.lookup(ctx); err != nil || snap.names["a"] == nil {
+		t.Errorf("got %v, %v, want the stale catalog", snap, err)
+	}
+	waitForRefresh(c)
+}
+
+// waitForRefresh waits for the refresh of c in flight, if any.
+func waitForRefresh(c *metricCatalog) {
+	c.mu.Lock()
+	refreshing := c.refreshing
+	c.mu.Unlock()
+	if refreshing != nil {
+		<-refreshing
+	}
+}
+
+func TestResolveMetricTypes(t *testing.T) {
+	applyTestConfig(t, nil)
+	f := newFakeClickHouse(catalogRows(map[string][][]interface{}{
+		"otel_metrics_sum":       {{"requests", "", uint8(1)}},
+		"otel_metrics_gauge":     {{"cpu", "", uint8(0)}, {"temp", "", uint8(0)}},
+		"otel_metrics_histogram": {{"latency", "", uint8(0)}},
+		"otel_metrics_summary":   {{"rpc", "", uint8(0)}},
+	}, "otel_metrics_exponential_histogram"))
+	ctx := f.context(limitsConfig{})
+	readable := []metricType{metricTypeSum, metricTypeGauge, metricTypeHistogram, metricTypeSummary}
+
+	for _, tc := range []struct {
+		name     string
+		matchers []*prompb.LabelMatcher
+		want     []metricType
+	}{
+		{"one gauge", []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "cpu"}}, []metricType{metricTypeGauge}},
+		{"regex over two types", []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "cpu|requests"}}, []metricType{metricTypeSum, metricTypeGauge}},
+		{"histogram by its _bucket series", []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "latency_bucket"}}, []metricType{metricTypeHistogram}},
+		{"histogram by its bare name", []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "latency"}}, readable},
+		{"summary by its bare name", []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "rpc"}}, []metricType{metricTypeSummary}},
+		{"summary by its _count series", []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "rpc_count"}}, []metricType{metricTypeSummary}},
+		{"unknown name", []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "gone"}}, readable},
+		{"no name matcher", []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "host", Value: "a"}}, readable},
+		{"negative name matcher", []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_NEQ, Name: "__name__", Value: "cpu"}}, readable},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := resolveMetricTypes(ctx, &prompb.Query{Matchers: tc.matchers})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	if _, err := resolveMetricTypes(ctx, &prompb.Query{Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "("}}}); err == nil {
+		t.Error("an invalid regex must fail")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	prompb "github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// exemplarAppender receives the exemplars decoded from ClickHouse rows.
+type exemplarAppender interface {
+	addExemplar(ls []prompb.Label, e prompb.Exemplar)
+}
+
+// queryExemplars feeds the exemplars stored for the series selected by q into
+// app. Exemplars are only read from rows that have any, so this is a separate
+// pass rather than extra columns on every sample query. Its rows count
+// against the row budget of ctx. Summaries carry no exemplars in the OTel
+// data model and are skipped.
+func queryExemplars(ctx context.Context, q *prompb.Query, app exemplarAppender) error {
+	ctx = withRowBudget(ctx)
+	types, err := resolveMetricTypes(ctx, q)
+	if err != nil {
+		return err
+	}
+	qt, exposed, err := translateQuery(ctx, q)
+	if err != nil {
+		return err
+	}
+	if translateNames {
+		app = &translatingAppender{exemplars: app, exposed: exposed}
+	}
+
+	for _, t := range types {
+		if t == metricTypeSummary {
+			continue
+		}
+		if err := queryExemplarsOf(ctx, t, qt, app); err != nil {
+			return fmt.Errorf("%s exemplars: %w", t, err)
+		}
+	}
+	return nil
+}
+
+func queryExemplarsOf(ctx context.Context, t metricType, q *prompb.Query, app exemplarAppender) error {
+	where, args, err := metadataWhere(t, q)
+	if err != nil {
+		return err
+	}
+	bounds := "[]"
+	if t == metricTypeHistogram {
+		bounds = "ExplicitBounds"
+	}
+
+	query := fmt.Sprintf(`
+SELECT
+  MetricName,
+  %s AS Labels,
+  %s AS bounds,
+  Exemplars.FilteredAttributes,
+  arrayMap(t -> toUnixTimestamp64Nano(t), Exemplars.TimeUnix) AS exemplar_ts_ns,
+  Exemplars.Value,
+  Exemplars.SpanId,
+  Exemplars.TraceId
+FROM %s
+WHERE %s AND notEmpty(Exemplars.Value)
+ORDER BY TimeUnix
+%s
+`, labelsExpr(), bounds, tableRef(ctx, t.table()), where, limitClause(ctx))
+
+	rows, err := queryLimited(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("ClickHouse query error: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var metricName string
+		var attributes map[string]string
+		var explicitBounds []float64
+		var filtered []map[string]string
+		var tsNs []int64
+		var values []float64
+		var spanIDs, traceIDs []string
+
+		if err := rows.Scan(&metricName, &attributes, &explicitBounds, &filtered, &tsNs, &values, &spanIDs, &traceIDs); err != nil {
+			logScanError(ctx, err)
+			continue
+		}
+
+		for i := range values {
+			if i >= len(tsNs) {
+				break
+			}
+			ts := tsNs[i] / 1e6
+			if ts < q.StartTimestampMs || ts > q.EndTimestampMs {
+				continue
+			}
+
+			e := prompb.Exemplar{Value: values[i], Timestamp: ts}
+			if i < len(traceIDs) && traceIDs[i] != "" {
+				e.Labels = append(e.Labels, prompb.Label{Name: "trace_id", Value: traceIDs[i]})
+			}
+			if i < len(spanIDs) && spanIDs[i] != "" {
+				e.Labels = append(e.Labels, prompb.Label{Name: "span_id", Value: spanIDs[i]})
+			}
+			if i < len(filtered) {
+				for k, v := range filtered[i] {
+					e.Labels = append(e.Labels, prompb.Label{Name: k, Value: v})
+				}
+			}
+			sortLabels(e.Labels)
+
+			ls := []prompb.Label{{Name: "__name__", Value: metricName}}
+			if t == metricTypeHistogram {
+				// Attach the exemplar to the bucket its value falls into.
+				le := math.Inf(1)
+				for _, b := range explicitBounds {
+					if values[i] <= b {
+						le = b
+						break
+					}
+				}
+				ls = []prompb.Label{
+					{Name: "__name__", Value: metricName + "_bucket"},
+					{Name: "le", Value: strconv.FormatFloat(le, 'g', -1, 64)},
+				}
+			}
+			for k, v := range attributes {
+				ls = append(ls, prompb.Label{Name: k, Value: v})
+			}
+			app.addExemplar(ls, e)
+		}
+	}
+	return rows.Err()
+}
+
+type exemplarQueryResult struct {
+	SeriesLabels labels.Labels  `json:"seriesLabels"`
+	Exemplars    []exemplarJSON `json:"exemplars"`
+}
+
+type exemplarJSON struct {
+	Labels    labels.Labels `json:"labels"`
+	Value     string        `json:"value"`
+	Timestamp float64       `json:"timestamp"`
+}
+
+func handleQueryExemplars(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	end := time.Now()
+	if v := r.FormValue("end"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			writeAPIError(w, &apiError{errorBadData, fmt.Errorf("invalid parameter \"end\": %w", err)})
+			return
+		}
+		end = t
+	}
+	start := end.Add(-metadataDefaultRange)
+	if v := r.FormValue("start"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			writeAPIError(w, &apiError{errorBadData, fmt.Errorf("invalid parameter \"start\": %w", err)})
+			return
+		}
+		start = t
+	}
+	if end.Before(start) {
+		writeAPIError(w, &apiError{errorBadData, fmt.Errorf("end timestamp must not be before start time")})
+		return
+	}
+
+	expr, err := parser.ParseExpr(r.FormValue("query"))
+	if err != nil {
+		writeAPIError(w, &apiError{errorBadData, err})
+		return
+	}
+
+	out := []exemplarQueryResult{}
+	selectors := parser.ExtractSelectors(expr)
+	if len(selectors) == 0 {
+		writeAPIResponse(w, apiResponse{Status: "success", Data: out})
+		return
+	}
+
+	seen := map[string]int{}
+	for _, q := range metadataQueries(selectors, start.UnixMilli(), end.UnixMilli()) {
+		set, err := newSeriesSet(q.Matchers)
+		if err != nil {
+			writeAPIError(w, &apiError{errorBadData, err})
+			return
+		}
+		if err := queryExemplars(ctx, q, set); err != nil {
+			writeAPIError(w, queryError(err))
+			return
+		}
+
+		// Selectors can overlap; merge their exemplars per series.
+		for _, ts := range set.series() {
+			lbls := toLabels(ts.Labels)
+			i, ok := seen[lbls.String()]
+			if !ok {
+				i = len(out)
+				seen[lbls.String()] = i
+				out = append(out, exemplarQueryResult{SeriesLabels: lbls})
+			}
+			for _, e := range ts.Exemplars {
+				out[i].Exemplars = append(out[i].Exemplars, exemplarJSON{
+					Labels:    toLabels(e.Labels),
+					Value:     strconv.FormatFloat(e.Value, 'f', -1, 64),
+					Timestamp: float64(e.Timestamp) / 1000,
+				})
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return labels.Compare(out[i].SeriesLabels, out[j].SeriesLabels) < 0 })
+
+	writeAPIResponse(w, apiResponse{Status: "success", Data: out})
+}
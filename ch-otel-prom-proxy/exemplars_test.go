@@ -0,0 +1,92 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+func TestQueryExemplars(t *testing.T) {
+	applyTestConfig(t, nil)
+	const sec = int64(1e9)
+	exemplarColumns := []string{"MetricName", "Labels", "bounds", "FilteredAttributes", "exemplar_ts_ns", "Value", "SpanId", "TraceId"}
+	f := newFakeClickHouse(func(query string, args []interface{}) (fakeResult, error) {
+		if strings.Contains(query, "GROUP BY MetricName") {
+			return catalogRows(map[string][][]interface{}{
+				"otel_metrics_sum":       {{"requests", "", uint8(1)}},
+				"otel_metrics_histogram": {{"latency", "", uint8(0)}},
+				"otel_metrics_summary":   {{"rpc", "", uint8(0)}},
+			})(query, args)
+		}
+		if strings.Contains(query, "otel_metrics_summary") {
+			t.Errorf("summaries carry no exemplars, but were queried: %s", query)
+		}
+		switch {
+		case strings.Contains(query, ".otel_metrics_histogram\n"):
+			return fakeResult{columns: exemplarColumns, rows: [][]interface{}{{
+				"latency", map[string]string{"host": "a"}, []float64{0.1, 1},
+				[]map[string]string{{"user": "u1"}, {}, {}, {}},
+				[]int64{10 * sec, 20 * sec, 30 * sec, 99 * sec},
+				[]float64{0.05, 0.5, 5, 0.5},
+				[]string{"s1", "s2", "", "s4"},
+				[]string{"t1", "t2", "t3", "t4"},
+			}}}, nil
+		case strings.Contains(query, ".otel_metrics_sum\n"):
+			return fakeResult{columns: exemplarColumns, rows: [][]interface{}{{
+				"requests", map[string]string{"host": "a"}, []float64{},
+				[]map[string]string{{}, {}},
+				[]int64{5 * sec, 15 * sec},
+				[]float64{3, 4},
+				[]string{"", ""},
+				[]string{"t5", "t6"},
+			}}}, nil
+		}
+		return fakeResult{columns: exemplarColumns}, nil
+	})
+	ctx := f.context(limitsConfig{})
+	q := &prompb.Query{
+		StartTimestampMs: 10000,
+		EndTimestampMs:   30000,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "host", Value: "a"}},
+	}
+	set, err := newSeriesSet(q.Matchers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queryExemplars(ctx, q, set); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string][]prompb.Exemplar{}
+	for _, ts := range set.series() {
+		got[toLabels(ts.Labels).String()] = ts.Exemplars
+	}
+	// Each histogram exemplar lands on the bucket its value falls into;
+	// those of other types on the series itself. Exemplars outside the
+	// range of the query are dropped.
+	want := map[string][]prompb.Exemplar{
+		`{__name__="latency_bucket", host="a", le="0.1"}`: {
+			{Value: 0.05, Timestamp: 10000, Labels: []prompb.Label{{Name: "span_id", Value: "s1"}, {Name: "trace_id", Value: "t1"}, {Name: "user", Value: "u1"}}},
+		},
+		`{__name__="latency_bucket", host="a", le="1"}`: {
+			{Value: 0.5, Timestamp: 20000, Labels: []prompb.Label{{Name: "span_id", Value: "s2"}, {Name: "trace_id", Value: "t2"}}},
+		},
+		`{__name__="latency_bucket", host="a", le="+Inf"}`: {
+			{Value: 5, Timestamp: 30000, Labels: []prompb.Label{{Name: "trace_id", Value: "t3"}}},
+		},
+		`{__name__="requests", host="a"}`: {
+			{Value: 4, Timestamp: 15000, Labels: []prompb.Label{{Name: "trace_id", Value: "t6"}}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got exemplars\n%v\nwant\n%v", got, want)
+	}
+
+	for _, query := range f.queryLog() {
+		if strings.Contains(query, "Exemplars") && !strings.Contains(query, timeRangeCondition) {
+			t.Errorf("exemplar query does not select the time range: %s", query)
+		}
+	}
+}
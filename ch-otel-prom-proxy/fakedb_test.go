@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+)
+
+// fakeClickHouse stands in for ClickHouse behind database/sql. Queries are
+// answered by answer; inserts are recorded per statement.
+type fakeClickHouse struct {
+	mu      sync.Mutex
+	answer  func(query string, args []interface{}) (fakeResult, error)
+	queries []string
+	inserts map[string][][]interface{}
+	pingErr error
+}
+
+// fakeResult is the answer to one query.
+type fakeResult struct {
+	columns []string
+	rows    [][]interface{}
+}
+
+func newFakeClickHouse(answer func(query string, args []interface{}) (fakeResult, error)) *fakeClickHouse {
+	return &fakeClickHouse{answer: answer, inserts: map[string][][]interface{}{}}
+}
+
+// context returns a context whose queries run against f as a tenant with
+// limits.
+func (f *fakeClickHouse) context(limits limitsConfig) context.Context {
+	return withTenant(context.Background(), newTenant("", sql.OpenDB(f), "otel_metrics", nil, limits))
+}
+
+func (f *fakeClickHouse) setPingErr(err error) {
+	f.mu.Lock()
+	f.pingErr = err
+	f.mu.Unlock()
+}
+
+func (f *fakeClickHouse) queryLog() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.queries...)
+}
+
+// applyTestConfig applies the default config, changed by edit if given, for
+// the rest of the test.
+func applyTestConfig(t *testing.T, edit func(c *config)) {
+	t.Helper()
+	c := defaultConfig()
+	if edit != nil {
+		edit(c)
+	}
+	c.apply()
+	t.Cleanup(func() { (&config{}).apply() })
+}
+
+func (f *fakeClickHouse) Connect(context.Context) (driver.Conn, error) { return fakeConn{f}, nil }
+func (f *fakeClickHouse) Driver() driver.Driver                        { return fakeDriver{f} }
+
+type fakeDriver struct{ f *fakeClickHouse }
+
+func (d fakeDriver) Open(string) (driver.Conn, error) { return fakeConn{d.f}, nil }
+
+type fakeConn struct{ f *fakeClickHouse }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.f, query}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)                 { return fakeTx{}, nil }
+
+// CheckNamedValue passes every argument through as is, as clickhouse-go
+// takes maps, slices and times.
+func (c fakeConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+func (c fakeConn) Ping(context.Context) error {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	return c.f.pingErr
+}
+
+func (c fakeConn) QueryContext(ctx context.Context, query string, named []driver.NamedValue) (driver.Rows, error) {
+	args := make([]interface{}, len(named))
+	for i, a := range named {
+		args[i] = a.Value
+	}
+	c.f.mu.Lock()
+	c.f.queries = append(c.f.queries, query)
+	answer := c.f.answer
+	c.f.mu.Unlock()
+	if answer == nil {
+		return nil, errors.New("fake ClickHouse: no answer")
+	}
+	res, err := answer(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{res: res}, nil
+}
+
+type fakeStmt struct {
+	f     *fakeClickHouse
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	row := make([]interface{}, len(args))
+	for i, a := range args {
+		row[i] = a
+	}
+	s.f.mu.Lock()
+	s.f.inserts[s.query] = append(s.f.inserts[s.query], row)
+	s.f.mu.Unlock()
+	return driver.RowsAffected(1), nil
+}
+
+func (s fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	return nil, errors.New("fake ClickHouse: statements only insert")
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeRows struct {
+	res fakeResult
+	i   int
+}
+
+func (r *fakeRows) Columns() []string { return r.res.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.i >= len(r.res.rows) {
+		return io.EOF
+	}
+	for i, v := range r.res.rows[r.i] {
+		dest[i] = v
+	}
+	r.i++
+	return nil
+}
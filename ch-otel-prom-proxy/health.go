@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readiness tracks whether every ClickHouse connection answered its last
+// ping, and whether the proxy is shutting down.
+type readiness struct {
+	mu       sync.Mutex
+	err      error
+	draining bool
+}
+
+var errDraining = errors.New("shutting down")
+
+// ready is checked once before the proxy starts listening.
+var ready = &readiness{}
+
+// check pings every ClickHouse connection the tenants use.
+func (r *readiness) check(ctx context.Context, timeout time.Duration) {
+	var errs []error
+	for _, c := range connections() {
+		pingCtx, cancel := context.WithTimeout(ctx, timeout)
+		if err := c.db.PingContext(pingCtx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.name, err))
+		}
+		cancel()
+	}
+	err := errors.Join(errs...)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case err != nil && r.err == nil:
+		log.Printf("not ready: %v", err)
+	case err == nil && r.err != nil:
+		log.Printf("ready: ClickHouse is reachable")
+	}
+	r.err = err
+}
+
+// watch pings ClickHouse every interval until ctx is done.
+func (r *readiness) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.check(ctx, interval)
+		}
+	}
+}
+
+// drain marks the proxy as not ready for good, once shutdown starts.
+func (r *readiness) drain() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.draining = true
+}
+
+func (r *readiness) status() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.draining {
+		return errDraining
+	}
+	return r.err
+}
+
+type connection struct {
+	name string
+	db   *sql.DB
+}
+
+// connections lists each ClickHouse connection once, named after the first
+// tenant using it.
+func connections() []connection {
+	conns := []connection{{"clickhouse", baseTenant.db}}
+	seen := map[*sql.DB]bool{baseTenant.db: true}
+	for id, t := range tenants {
+		if !seen[t.db] {
+			seen[t.db] = true
+			conns = append(conns, connection{"tenant " + id, t.db})
+		}
+	}
+	return conns
+}
+
+func handleHealthy(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "Healthy.")
+}
+
+// handleReady answers without credentials, so the ping errors, which name
+// ClickHouse addresses, only go to the log.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	switch err := ready.status(); {
+	case errors.Is(err, errDraining):
+		http.Error(w, "Not ready: shutting down.", http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		http.Error(w, "Not ready: ClickHouse is unreachable.", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "Ready.")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleReady(t *testing.T) {
+	saved := ready
+	t.Cleanup(func() { ready = saved })
+
+	for _, tc := range []struct {
+		name       string
+		err        error
+		draining   bool
+		wantStatus int
+		wantBody   string
+	}{
+		{"ready", nil, false, http.StatusOK, "Ready."},
+		{"ClickHouse unreachable", errors.New("clickhouse: dial tcp 10.1.2.3:9000: connection refused"), false, http.StatusServiceUnavailable, "Not ready: ClickHouse is unreachable."},
+		{"shutting down", nil, true, http.StatusServiceUnavailable, "Not ready: shutting down."},
+		{"shutting down and unreachable", errors.New("timeout"), true, http.StatusServiceUnavailable, "Not ready: shutting down."},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ready = &readiness{err: tc.err}
+			if tc.draining {
+				ready.drain()
+			}
+			w := httptest.NewRecorder()
+			handleReady(w, httptest.NewRequest("GET", "/-/ready", nil))
+			body := strings.TrimSpace(w.Body.String())
+			if w.Code != tc.wantStatus || body != tc.wantBody {
+				t.Errorf("got %d %q, want %d %q", w.Code, body, tc.wantStatus, tc.wantBody)
+			}
+		})
+	}
+}
+
+func TestHandleHealthy(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleHealthy(w, httptest.NewRequest("GET", "/-/healthy", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d, want 200", w.Code)
+	}
+}
+
+func TestReadinessCheck(t *testing.T) {
+	savedBase, savedTenants := baseTenant, tenants
+	t.Cleanup(func() { baseTenant, tenants = savedBase, savedTenants })
+
+	base := newFakeClickHouse(nil)
+	other := newFakeClickHouse(nil)
+	baseTenant = tenantFrom(base.context(limitsConfig{}))
+	tenants = map[string]*tenant{
+		"a": baseTenant,
+		"b": tenantFrom(other.context(limitsConfig{})),
+	}
+	if n := len(connections()); n != 2 {
+		t.Fatalf("got %d connections, want each one once", n)
+	}
+
+	r := &readiness{}
+	ctx := base.context(limitsConfig{})
+	r.check(ctx, time.Second)
+	if err := r.status(); err != nil {
+		t.Fatalf("all pings answered: got %v", err)
+	}
+
+	other.setPingErr(errors.New("connection refused"))
+	r.check(ctx, time.Second)
+	if err := r.status(); err == nil || !strings.Contains(err.Error(), "tenant b") {
+		t.Errorf("a failed ping: got %v, want the error of tenant b", err)
+	}
+
+	other.setPingErr(nil)
+	r.check(ctx, time.Second)
+	if err := r.status(); err != nil {
+		t.Errorf("after recovering: got %v", err)
+	}
+
+	r.drain()
+	r.check(ctx, time.Second)
+	if err := r.status(); err != errDraining {
+		t.Errorf("pings must not make a draining proxy ready again: got %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	// Native histograms support schemas -4..8. OTel scales above 8 are
+	// downscaled by merging adjacent buckets.
+	minNativeHistogramSchema = -4
+	maxNativeHistogramSchema = 8
+
+	// OTel exponential histograms carry no zero threshold in our schema;
+	// use the same default Prometheus applies when translating from OTLP.
+	defaultZeroThreshold = 1e-128
+)
+
+// expHistogramRow is one data point read from the exponential histogram
+// table.
+type expHistogramRow struct {
+	scale     int32
+	zeroCount uint64
+	posOffset int32
+	posCounts []uint64
+	negOffset int32
+	negCounts []uint64
+	sum       float64
+	count     uint64
+}
+
+// toNativeHistogram converts an OTel exponential histogram data point into a
+// Prometheus native histogram with integer counts.
+func (r expHistogramRow) toNativeHistogram(timestampMs int64) (prompb.Histogram, error) {
+	if r.scale < minNativeHistogramSchema {
+		return prompb.Histogram{}, fmt.Errorf("cannot convert exponential histogram with scale %d, minimum is %d", r.scale, minNativeHistogramSchema)
+	}
+
+	scaleDown := int32(0)
+	if r.scale > maxNativeHistogramSchema {
+		scaleDown = r.scale - maxNativeHistogramSchema
+	}
+
+	posSpans, posDeltas := bucketSpans(r.posCounts, r.posOffset, scaleDown)
+	negSpans, negDeltas := bucketSpans(r.negCounts, r.negOffset, scaleDown)
+
+	return prompb.Histogram{
+		Count:          &prompb.Histogram_CountInt{CountInt: r.count},
+		Sum:            r.sum,
+		Schema:         r.scale - scaleDown,
+		ZeroThreshold:  defaultZeroThreshold,
+		ZeroCount:      &prompb.Histogram_ZeroCountInt{ZeroCountInt: r.zeroCount},
+		PositiveSpans:  posSpans,
+		PositiveDeltas: posDeltas,
+		NegativeSpans:  negSpans,
+		NegativeDeltas: negDeltas,
+		Timestamp:      timestampMs,
+	}, nil
+}
+
+// bucketSpans encodes OTel exponential buckets as native histogram spans and
+// deltas. OTel bucket i covers (base^(offset+i), base^(offset+i+1)] while
+// Prometheus bucket j covers (base^(j-1), base^j], so indexes shift by one.
+// Downscaling by n merges every 2^n adjacent buckets into one.
+func bucketSpans(counts []uint64, offset int32, scaleDown int32) ([]prompb.BucketSpan, []int64) {
+	type bucket struct {
+		index int32
+		count uint64
+	}
+
+	var merged []bucket
+	for i, c := range counts {
+		idx := (offset+int32(i))>>scaleDown + 1
+		if n := len(merged); n > 0 && merged[n-1].index == idx {
+			merged[n-1].count += c
+			continue
+		}
+		merged = append(merged, bucket{index: idx, count: c})
+	}
+
+	var (
+		spans  []prompb.BucketSpan
+		deltas []int64
+		prev   int64
+		last   int32
+	)
+	appendBucket := func(c int64) {
+		spans[len(spans)-1].Length++
+		deltas = append(deltas, c-prev)
+		prev = c
+	}
+	for _, b := range merged {
+		if b.count == 0 {
+			continue
+		}
+		switch gap := b.index - last - 1; {
+		case len(spans) == 0:
+			spans = append(spans, prompb.BucketSpan{Offset: b.index})
+		case gap > 2:
+			// Same threshold client_golang uses before starting a new span
+			// rather than padding with empty buckets.
+			spans = append(spans, prompb.BucketSpan{Offset: gap})
+		default:
+			for j := int32(0); j < gap; j++ {
+				appendBucket(0)
+			}
+		}
+		appendBucket(int64(b.count))
+		last = b.index
+	}
+	return spans, deltas
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+func TestBucketSpans(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		counts     []uint64
+		offset     int32
+		scaleDown  int32
+		wantSpans  []prompb.BucketSpan
+		wantDeltas []int64
+	}{
+		{"empty", nil, 0, 0, nil, nil},
+		{"all zero", []uint64{0, 0}, 3, 0, nil, nil},
+		{"contiguous", []uint64{1, 3, 2}, 0, 0, []prompb.BucketSpan{{Offset: 1, Length: 3}}, []int64{1, 2, -1}},
+		{"negative offset", []uint64{4, 4}, -3, 0, []prompb.BucketSpan{{Offset: -2, Length: 2}}, []int64{4, 0}},
+		{"leading zeros skipped", []uint64{0, 0, 5}, 0, 0, []prompb.BucketSpan{{Offset: 3, Length: 1}}, []int64{5}},
+		{"short gap padded", []uint64{1, 0, 0, 1}, 0, 0, []prompb.BucketSpan{{Offset: 1, Length: 4}}, []int64{1, -1, 0, 1}},
+		{"long gap starts a span", []uint64{1, 0, 0, 0, 2}, 0, 0, []prompb.BucketSpan{{Offset: 1, Length: 1}, {Offset: 3, Length: 1}}, []int64{1, 1}},
+		{"downscaled by one", []uint64{1, 2, 3, 4}, 0, 1, []prompb.BucketSpan{{Offset: 1, Length: 2}}, []int64{3, 4}},
+		{"downscaled odd offset", []uint64{1, 2, 3}, -1, 1, []prompb.BucketSpan{{Offset: 0, Length: 2}}, []int64{1, 4}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			spans, deltas := bucketSpans(tc.counts, tc.offset, tc.scaleDown)
+			if !reflect.DeepEqual(spans, tc.wantSpans) || !reflect.DeepEqual(deltas, tc.wantDeltas) {
+				t.Errorf("got %v %v, want %v %v", spans, deltas, tc.wantSpans, tc.wantDeltas)
+			}
+		})
+	}
+}
+
+func TestToNativeHistogramRejectsLowScales(t *testing.T) {
+	if _, err := (expHistogramRow{scale: minNativeHistogramSchema - 1}).toNativeHistogram(0); err == nil {
+		t.Error("scales below the lowest schema must fail")
+	}
+}
+
+// TestNativeHistogramRoundTrip converts random OTel buckets to a native
+// histogram the way reads do and back the way remote write does, checking
+// that every bucket keeps its count and bounds.
+func TestNativeHistogramRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	randomBuckets := func() (int32, []uint64) {
+		counts := make([]uint64, rnd.Intn(20))
+		for i := range counts {
+			if rnd.Intn(3) > 0 {
+				counts[i] = uint64(rnd.Intn(100))
+			}
+		}
+		return int32(rnd.Intn(40) - 20), counts
+	}
+
+	for i := 0; i < 500; i++ {
+		r := expHistogramRow{scale: int32(rnd.Intn(13) - 4), zeroCount: uint64(rnd.Intn(5)), sum: rnd.Float64()}
+		r.posOffset, r.posCounts = randomBuckets()
+		r.negOffset, r.negCounts = randomBuckets()
+		r.count = r.zeroCount + total(r.posCounts) + total(r.negCounts)
+
+		h, err := r.toNativeHistogram(1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ih := h.ToIntHistogram()
+		if err := ih.Validate(); err != nil {
+			t.Fatalf("scale %d: invalid histogram %s: %v", r.scale, ih, err)
+		}
+
+		// Every OTel bucket (base^i, base^(i+1)] lands in the native bucket
+		// covering it; above the highest schema, merged with its neighbours.
+		// Buckets are keyed by the exponent of their upper bound, base^j.
+		schema := min(r.scale, maxNativeHistogramSchema)
+		want := map[int32]uint64{}
+		for i, c := range r.posCounts {
+			if c > 0 {
+				want[(r.posOffset+int32(i))>>(r.scale-schema)+1] += c
+			}
+		}
+		got := map[int32]uint64{}
+		for it := ih.PositiveBucketIterator(); it.Next(); {
+			if b := it.At(); b.Count > 0 {
+				got[int32(math.Round(math.Log2(b.Upper)*math.Exp2(float64(schema))))] += b.Count
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("scale %d offset %d counts %v: got buckets %v, want %v", r.scale, r.posOffset, r.posCounts, got, want)
+		}
+
+		if r.scale > maxNativeHistogramSchema {
+			continue
+		}
+		for _, side := range []struct {
+			spans  []prompb.BucketSpan
+			deltas []int64
+			offset int32
+			counts []uint64
+		}{
+			{h.PositiveSpans, h.PositiveDeltas, r.posOffset, r.posCounts},
+			{h.NegativeSpans, h.NegativeDeltas, r.negOffset, r.negCounts},
+		} {
+			offset, counts := otelBuckets(side.spans, deltasToFloats(side.deltas), true)
+			if !reflect.DeepEqual(nonZeroBuckets(offset, counts), nonZeroBuckets(side.offset, side.counts)) {
+				t.Fatalf("round trip of offset %d counts %v gave offset %d counts %v", side.offset, side.counts, offset, counts)
+			}
+		}
+	}
+}
+
+func total(counts []uint64) uint64 {
+	var n uint64
+	for _, c := range counts {
+		n += c
+	}
+	return n
+}
+
+// nonZeroBuckets maps the OTel index of every non-empty bucket to its count,
+// as leading, trailing and inner empty buckets may be dropped or padded.
+func nonZeroBuckets(offset int32, counts []uint64) map[int32]uint64 {
+	out := map[int32]uint64{}
+	for i, c := range counts {
+		if c > 0 {
+			out[offset+int32(i)] = c
+		}
+	}
+	return out
+}
+
+func TestOtelBucketsFromFloatCounts(t *testing.T) {
+	spans := []prompb.BucketSpan{{Offset: -1, Length: 2}, {Offset: 3, Length: 1}}
+	offset, counts := otelBuckets(spans, []float64{1.4, 2, 7.6}, false)
+	if offset != -2 || !reflect.DeepEqual(counts, []uint64{1, 2, 0, 0, 0, 8}) {
+		t.Errorf("got offset %d counts %v", offset, counts)
+	}
+}
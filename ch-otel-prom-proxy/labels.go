@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	prompb "github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// metadataWhere builds the WHERE clause for a series, label-name or
+// label-value lookup of q over the table holding metrics of type t.
+func metadataWhere(t metricType, q *prompb.Query) (string, []interface{}, error) {
+	where := []string{timeRangeCondition}
+	args := []interface{}{q.StartTimestampMs, q.EndTimestampMs + 1}
+
+	var synthetic []string
+	if l := t.syntheticLabel(); l != "" {
+		synthetic = append(synthetic, l)
+	}
+
+	mWhere, mArgs, err := matchersWhere(q.Matchers, t.nameExprs(), synthetic...)
+	if err != nil {
+		return "", nil, err
+	}
+	where = append(where, mWhere...)
+	args = append(args, mArgs...)
+	return strings.Join(where, " AND "), args, nil
+}
+
+// metadataQueries expands the match[] selectors of a metadata request into one
+// prompb.Query each. No selectors means every series.
+func metadataQueries(selectors [][]*labels.Matcher, startMs, endMs int64) []*prompb.Query {
+	if len(selectors) == 0 {
+		selectors = [][]*labels.Matcher{nil}
+	}
+	out := make([]*prompb.Query, 0, len(selectors))
+	for _, ms := range selectors {
+		out = append(out, &prompb.Query{
+			StartTimestampMs: startMs,
+			EndTimestampMs:   endMs,
+			Matchers:         toProtoMatchers(ms),
+		})
+	}
+	return out
+}
+
+// metadataLimitClause fetches one row past limit so that truncation can be
+// reported.
+func metadataLimitClause(limit int) string {
+	if limit <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("LIMIT %d", limit+1)
+}
+
+// stringSet collects distinct strings up to a limit.
+type stringSet struct {
+	limit     int
+	values    map[string]struct{}
+	truncated bool
+}
+
+func newStringSet(limit int) *stringSet {
+	return &stringSet{limit: limit, values: map[string]struct{}{}}
+}
+
+func (s *stringSet) add(v string) {
+	if _, ok := s.values[v]; ok {
+		return
+	}
+	if s.limit > 0 && len(s.values) >= s.limit {
+		s.truncated = true
+		return
+	}
+	s.values[v] = struct{}{}
+}
+
+func (s *stringSet) sorted() []string {
+	out := make([]string, 0, len(s.values))
+	for v := range s.values {
+		out = append(out, v)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func queryStrings(ctx context.Context, query string, args []interface{}, fn func(string)) error {
+	rows, err := queryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("ClickHouse query error: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			logScanError(ctx, err)
+			continue
+		}
+		fn(v)
+	}
+	return rows.Err()
+}
+
+// labelNames returns the label names of the series selected by qs.
+func labelNames(ctx context.Context, qs []*prompb.Query, limit int) ([]string, bool, error) {
+	set := newStringSet(limit)
+	for _, q := range qs {
+		types, err := resolveMetricTypes(ctx, q)
+		if err != nil {
+			return nil, false, err
+		}
+		qt, _, err := translateQuery(ctx, q)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, t := range types {
+			where, args, err := metadataWhere(t, qt)
+			if err != nil {
+				return nil, false, err
+			}
+			// Every series carries __name__; histogram buckets and summary
+			// quantiles also carry their synthetic label.
+			synthetic := "['__name__']"
+			if l := t.syntheticLabel(); l != "" {
+				synthetic = fmt.Sprintf("['__name__', '%s']", l)
+			}
+			query := fmt.Sprintf(`
+SELECT DISTINCT arrayJoin(arrayConcat(%s, mapKeys(%s))) AS name
+FROM %s
+WHERE %s
+ORDER BY name
+%s
+`, synthetic, labelsExpr(), tableRef(ctx, t.table()), where, metadataLimitClause(limit))
+
+			add := func(v string) { set.add(sanitizeLabelName(v)) }
+			if err := queryStrings(ctx, query, args, add); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	return set.sorted(), set.truncated, nil
+}
+
+// labelValues returns the values label name takes across the series selected
+// by qs.
+func labelValues(ctx context.Context, name string, qs []*prompb.Query, limit int) ([]string, bool, error) {
+	set := newStringSet(limit)
+	for _, q := range qs {
+		types, err := resolveMetricTypes(ctx, q)
+		if err != nil {
+			return nil, false, err
+		}
+
+		var nameMatchers []*labels.Matcher
+		if name == "__name__" {
+			lms, err := toLabelMatchers(q.Matchers)
+			if err != nil {
+				return nil, false, err
+			}
+			for _, lm := range lms {
+				if lm.Name == "__name__" {
+					nameMatchers = append(nameMatchers, lm)
+				}
+			}
+		}
+
+		if name == "__name__" {
+			targetInfo, err := wantsTargetInfo(q)
+			if err != nil {
+				return nil, false, err
+			}
+			if targetInfo {
+				set.add(targetInfoMetric)
+			}
+		}
+
+		qt, exposed, err := translateQuery(ctx, q)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, t := range types {
+			where, args, err := metadataWhere(t, qt)
+			if err != nil {
+				return nil, false, err
+			}
+
+			expr := labelExpr(name)
+			add := set.add
+			switch {
+			case name == "__name__":
+				expr = "arrayJoin([" + strings.Join(t.nameExprs(), ", ") + "])"
+			case name == "le" && t == metricTypeHistogram:
+				// Format bounds the way the read path renders le.
+				add = func(v string) {
+					if f, err := strconv.ParseFloat(v, 64); err == nil {
+						set.add(strconv.FormatFloat(f, 'g', -1, 64))
+					}
+				}
+				// The +Inf bucket has no explicit bound.
+				expr = "toString(arrayJoin(arrayConcat(ExplicitBounds, [inf])))"
+			case name == "quantile" && t == metricTypeSummary:
+				add = func(v string) {
+					if f, err := strconv.ParseFloat(v, 64); err == nil {
+						set.add(strconv.FormatFloat(f, 'g', -1, 64))
+					}
+				}
+				expr = "toString(arrayJoin(`ValueAtQuantiles.Quantile`))"
+			default:
+				where += " AND " + expr + " != ''"
+			}
+			if name == "__name__" {
+				add = func(v string) {
+					v = exposedMetricName(exposed, v)
+					if seriesMatches([]prompb.Label{{Name: "__name__", Value: v}}, nameMatchers) {
+						set.add(v)
+					}
+				}
+			}
+
+			query := fmt.Sprintf(`
+SELECT DISTINCT %s AS value
+FROM %s
+WHERE %s
+ORDER BY value
+%s
+`, expr, tableRef(ctx, t.table()), where, metadataLimitClause(limit))
+
+			if err := queryStrings(ctx, query, args, add); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	return set.sorted(), set.truncated, nil
+}
+
+// seriesLabels returns the label sets of the series selected by qs.
+func seriesLabels(ctx context.Context, qs []*prompb.Query, limit int) ([]labels.Labels, bool, error) {
+	var out []labels.Labels
+	seen := map[string]struct{}{}
+	truncated := false
+
+	for _, q := range qs {
+		lms, err := toLabelMatchers(q.Matchers)
+		if err != nil {
+			return nil, false, err
+		}
+		types, err := resolveMetricTypes(ctx, q)
+		if err != nil {
+			return nil, false, err
+		}
+		qt, exposed, err := translateQuery(ctx, q)
+		if err != nil {
+			return nil, false, err
+		}
+
+		for _, t := range types {
+			where, args, err := metadataWhere(t, qt)
+			if err != nil {
+				return nil, false, err
+			}
+			bounds := "[]"
+			switch t {
+			case metricTypeHistogram:
+				bounds = "groupUniqArrayArray(ExplicitBounds)"
+			case metricTypeSummary:
+				bounds = "groupUniqArrayArray(`ValueAtQuantiles.Quantile`)"
+			}
+			query := fmt.Sprintf(`
+SELECT MetricName, %s AS Labels, %s AS bounds
+FROM %s
+WHERE %s
+GROUP BY MetricName, Labels
+%s
+`, labelsExpr(), bounds, tableRef(ctx, t.table()), where, metadataLimitClause(limit))
+
+			rows, err := queryContext(ctx, query, args...)
+			if err != nil {
+				return nil, false, fmt.Errorf("ClickHouse query error: %w", err)
+			}
+			for rows.Next() {
+				var metricName string
+				var attributes map[string]string
+				var explicitBounds []float64
+				if err := rows.Scan(&metricName, &attributes, &explicitBounds); err != nil {
+					logScanError(ctx, err)
+					continue
+				}
+
+				for _, ls := range seriesLabelSets(t, metricName, attributes, explicitBounds) {
+					ls = translateLabels(exposed, ls)
+					if !seriesMatches(ls, lms) {
+						continue
+					}
+					lbls := toLabels(ls)
+					key := lbls.String()
+					if _, ok := seen[key]; ok {
+						continue
+					}
+					if limit > 0 && len(out) >= limit {
+						truncated = true
+						continue
+					}
+					seen[key] = struct{}{}
+					out = append(out, lbls)
+				}
+			}
+			err = rows.Err()
+			rows.Close()
+			if err != nil {
+				return nil, false, fmt.Errorf("ClickHouse query error: %w", err)
+			}
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool { return labels.Compare(out[i], out[j]) < 0 })
+	return out, truncated, nil
+}
+
+// seriesLabelSets lists the label sets the read path emits for one
+// MetricName/label set combination. bounds are the histogram bucket bounds
+// or summary quantiles seen for it.
+func seriesLabelSets(t metricType, metricName string, attributes map[string]string, bounds []float64) [][]prompb.Label {
+	base := func(name string) []prompb.Label {
+		ls := []prompb.Label{{Name: "__name__", Value: name}}
+		for k, v := range attributes {
+			ls = append(ls, prompb.Label{Name: k, Value: v})
+		}
+		return ls
+	}
+
+	sort.Float64s(bounds)
+	var out [][]prompb.Label
+	switch t {
+	case metricTypeHistogram:
+		for _, b := range append(bounds, math.Inf(1)) {
+			ls := append(base(metricName+"_bucket"), prompb.Label{Name: "le", Value: strconv.FormatFloat(b, 'g', -1, 64)})
+			out = append(out, ls)
+		}
+		return append(out, base(metricName+"_sum"), base(metricName+"_count"))
+	case metricTypeSummary:
+		for _, q := range bounds {
+			ls := append(base(metricName), prompb.Label{Name: "quantile", Value: strconv.FormatFloat(q, 'g', -1, 64)})
+			out = append(out, ls)
+		}
+		return append(out, base(metricName+"_sum"), base(metricName+"_count"))
+	}
+	return [][]prompb.Label{base(metricName)}
+}
+
+// metadataParams parses the match[], start, end and limit parameters shared
+// by the series and label endpoints.
+func metadataParams(r *http.Request) ([]*prompb.Query, int, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, 0, fmt.Errorf("error parsing form values: %w", err)
+	}
+
+	end := time.Now()
+	if v := r.FormValue("end"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid parameter \"end\": %w", err)
+		}
+		end = t
+	}
+	start := end.Add(-metadataDefaultRange)
+	if v := r.FormValue("start"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid parameter \"start\": %w", err)
+		}
+		start = t
+	}
+
+	limit := tenantFrom(r.Context()).limits.MetadataLimit
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, 0, fmt.Errorf("invalid parameter \"limit\": %q", v)
+		}
+		if n > 0 && (limit <= 0 || n < limit) {
+			limit = n
+		}
+	}
+
+	var selectors [][]*labels.Matcher
+	for _, s := range r.Form["match[]"] {
+		ms, err := parser.ParseMetricSelector(s)
+		if err != nil {
+			return nil, 0, err
+		}
+		selectors = append(selectors, ms)
+	}
+	return metadataQueries(selectors, start.UnixMilli(), end.UnixMilli()), limit, nil
+}
+
+func truncationWarnings(truncated bool) []string {
+	if !truncated {
+		return nil
+	}
+	return []string{"results truncated due to limit"}
+}
+
+func handleSeries(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	qs, limit, err := metadataParams(r)
+	if err != nil {
+		writeAPIError(w, &apiError{errorBadData, err})
+		return
+	}
+	if len(r.Form["match[]"]) == 0 {
+		writeAPIError(w, &apiError{errorBadData, fmt.Errorf("no match[] parameter provided")})
+		return
+	}
+
+	series, truncated, err := seriesLabels(ctx, qs, limit)
+	if err != nil {
+		writeAPIError(w, queryError(err))
+		return
+	}
+	if series == nil {
+		series = []labels.Labels{}
+	}
+	writeAPIResponse(w, apiResponse{Status: "success", Data: series, Warnings: truncationWarnings(truncated)})
+}
+
+func handleLabels(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	qs, limit, err := metadataParams(r)
+	if err != nil {
+		writeAPIError(w, &apiError{errorBadData, err})
+		return
+	}
+
+	names, truncated, err := labelNames(ctx, qs, limit)
+	if err != nil {
+		writeAPIError(w, queryError(err))
+		return
+	}
+	writeAPIResponse(w, apiResponse{Status: "success", Data: names, Warnings: truncationWarnings(truncated)})
+}
+
+func handleLabelValues(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	name := r.PathValue("name")
+	if !model.LabelName(name).IsValid() {
+		writeAPIError(w, &apiError{errorBadData, fmt.Errorf("invalid label name: %q", name)})
+		return
+	}
+	qs, limit, err := metadataParams(r)
+	if err != nil {
+		writeAPIError(w, &apiError{errorBadData, err})
+		return
+	}
+
+	values, truncated, err := labelValues(ctx, name, qs, limit)
+	if err != nil {
+		writeAPIError(w, queryError(err))
+		return
+	}
+	writeAPIResponse(w, apiResponse{Status: "success", Data: values, Warnings: truncationWarnings(truncated)})
+}
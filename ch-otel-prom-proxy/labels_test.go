@@ -0,0 +1,32 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+func TestMetadataWhereTimeRange(t *testing.T) {
+	applyTestConfig(t, nil)
+	q := &prompb.Query{
+		StartTimestampMs: 1000,
+		EndTimestampMs:   2000,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "host", Value: "a"}},
+	}
+	for _, typ := range allMetricTypes {
+		where, args, err := metadataWhere(typ, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The range is the one series queries read, so that the end
+		// millisecond belongs to it in both.
+		if !strings.HasPrefix(where, timeRangeCondition+" AND ") {
+			t.Errorf("%s: got %q, want the shared time range condition", typ, where)
+		}
+		if len(args) < 2 || !reflect.DeepEqual(args[:2], []interface{}{int64(1000), int64(2001)}) {
+			t.Errorf("%s: got time arguments %v, want [1000 2001]", typ, args)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// clickHouseLimiter is nil when ClickHouse queries are not limited.
+var clickHouseLimiter *queryLimiter
+
+// queryLimiter bounds the ClickHouse queries running at once across every
+// request and tenant. Queries over the limit wait in a bounded queue; once
+// it is full, or a query has waited queueTimeout, they are turned away with
+// an overloadError instead of piling up on ClickHouse.
+type queryLimiter struct {
+	slots        chan struct{}
+	maxQueued    int
+	queueTimeout time.Duration
+
+	mu     sync.Mutex
+	queued int
+}
+
+func newQueryLimiter(maxConcurrency, maxQueued int, queueTimeout time.Duration) *queryLimiter {
+	return &queryLimiter{
+		slots:        make(chan struct{}, maxConcurrency),
+		maxQueued:    maxQueued,
+		queueTimeout: queueTimeout,
+	}
+}
+
+// overloadError turns a request away while ClickHouse is busy. Clients are
+// told to come back after retryAfter.
+type overloadError struct {
+	status     int
+	reason     string
+	retryAfter time.Duration
+}
+
+func (e *overloadError) Error() string {
+	return fmt.Sprintf("ClickHouse is overloaded: %s", e.reason)
+}
+
+// writeHeaders sets Retry-After, in whole seconds.
+func (e *overloadError) writeHeaders(w http.ResponseWriter) {
+	secs := int(math.Ceil(e.retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(secs, 1)))
+}
+
+// acquire waits for a free query slot and returns the function releasing
+// it.
+func (l *queryLimiter) acquire(ctx context.Context) (func(), error) {
+	release := func() { <-l.slots }
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	l.mu.Lock()
+	if l.queued >= l.maxQueued {
+		l.mu.Unlock()
+		return nil, l.reject(ctx, http.StatusTooManyRequests, "queue_full", "too many queries queued")
+	}
+	l.queued++
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.queued--
+		l.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, l.reject(ctx, http.StatusServiceUnavailable, "queue_timeout", fmt.Sprintf("no query slot freed up within %s", l.queueTimeout))
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *queryLimiter) reject(ctx context.Context, status int, cause, reason string) error {
+	telemetry.queriesRejected.Add(ctx, 1, metric.WithAttributes(attribute.String("reason", cause)))
+	return &overloadError{status: status, reason: reason, retryAfter: l.queueTimeout}
+}
+
+// runOrdered calls fn for every index below n, with at most workers calls at
+// once, and hands each finished index to done in order. It stops at the
+// first error of fn or done, cancelling the calls still running.
+func runOrdered(ctx context.Context, n, workers int, fn func(ctx context.Context, i int) error, done func(i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make([]chan error, n)
+	for i := range errs {
+		errs[i] = make(chan error, 1)
+	}
+	sem := make(chan struct{}, max(workers, 1))
+	go func() {
+		for i := 0; i < n; i++ {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] <- ctx.Err()
+				continue
+			}
+			go func(i int) {
+				defer func() { <-sem }()
+				errs[i] <- fn(ctx, i)
+			}(i)
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		if err := <-errs[i]; err != nil {
+			return err
+		}
+		if err := done(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
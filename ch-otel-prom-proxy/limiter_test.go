@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/promql"
+)
+
+func TestQueryLimiter(t *testing.T) {
+	l := newQueryLimiter(1, 1, 50*time.Millisecond)
+	ctx := context.Background()
+
+	release, err := l.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second query waits in the queue, which the third then finds full.
+	queued := make(chan error, 1)
+	go func() {
+		_, err := l.acquire(ctx)
+		queued <- err
+	}()
+	for {
+		l.mu.Lock()
+		n := l.queued
+		l.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	var overload *overloadError
+	if _, err := l.acquire(ctx); !errors.As(err, &overload) || overload.status != http.StatusTooManyRequests {
+		t.Fatalf("full queue: got %v, want a 429", err)
+	}
+	if err := <-queued; !errors.As(err, &overload) || overload.status != http.StatusServiceUnavailable {
+		t.Fatalf("queue timeout: got %v, want a 503", err)
+	}
+
+	// A released slot goes to the query waiting for it.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release()
+	}()
+	release, err = l.acquire(ctx)
+	if err != nil {
+		t.Fatalf("waiting for a released slot: %v", err)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := l.acquire(cctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled while queued: got %v", err)
+	}
+	release()
+}
+
+func TestOverloadResponses(t *testing.T) {
+	for _, tc := range []struct {
+		err        *overloadError
+		wantStatus int
+		wantRetry  string
+	}{
+		{&overloadError{status: http.StatusTooManyRequests, reason: "full", retryAfter: 50 * time.Millisecond}, http.StatusTooManyRequests, "1"},
+		{&overloadError{status: http.StatusServiceUnavailable, reason: "slow", retryAfter: 2500 * time.Millisecond}, http.StatusServiceUnavailable, "3"},
+	} {
+		wrapped := fmt.Errorf("gauge query: %w", tc.err)
+
+		w := httptest.NewRecorder()
+		writeReadError(w, wrapped)
+		if w.Code != tc.wantStatus || w.Header().Get("Retry-After") != tc.wantRetry {
+			t.Errorf("remote read: got %d Retry-After %q, want %d %q", w.Code, w.Header().Get("Retry-After"), tc.wantStatus, tc.wantRetry)
+		}
+
+		// PromQL hands storage errors back wrapped.
+		w = httptest.NewRecorder()
+		writeAPIError(w, queryError(promql.ErrStorage{Err: wrapped}))
+		if w.Code != tc.wantStatus || w.Header().Get("Retry-After") != tc.wantRetry {
+			t.Errorf("query API: got %d Retry-After %q, want %d %q", w.Code, w.Header().Get("Retry-After"), tc.wantStatus, tc.wantRetry)
+		}
+	}
+}
+
+func TestRunOrdered(t *testing.T) {
+	const n, workers = 20, 3
+	var running, peak atomic.Int32
+	var order []int
+	err := runOrdered(context.Background(), n, workers, func(ctx context.Context, i int) error {
+		r := running.Add(1)
+		for p := peak.Load(); r > p && !peak.CompareAndSwap(p, r); p = peak.Load() {
+		}
+		defer running.Add(-1)
+		// Later calls finish first.
+		time.Sleep(time.Duration(n-i) * 100 * time.Microsecond)
+		return nil
+	}, func(i int) error {
+		order = append(order, i)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]int, n)
+	for i := range want {
+		want[i] = i
+	}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("done called in order %v", order)
+	}
+	if p := peak.Load(); p > workers {
+		t.Errorf("%d calls ran at once, want at most %d", p, workers)
+	}
+}
+
+func TestRunOrderedStopsAtTheFirstError(t *testing.T) {
+	boom := errors.New("boom")
+	var done []int
+	var cancelled atomic.Int32
+	err := runOrdered(context.Background(), 10, 4, func(ctx context.Context, i int) error {
+		if i == 2 {
+			return boom
+		}
+		if i > 2 {
+			select {
+			case <-ctx.Done():
+				cancelled.Add(1)
+				return ctx.Err()
+			case <-time.After(5 * time.Second):
+			}
+		}
+		return nil
+	}, func(i int) error {
+		done = append(done, i)
+		return nil
+	})
+	if err != boom {
+		t.Fatalf("got %v, want the first error", err)
+	}
+	if !reflect.DeepEqual(done, []int{0, 1}) {
+		t.Errorf("done called for %v, want only the indexes before the error", done)
+	}
+	// The calls still running are cancelled rather than left to finish.
+	for deadline := time.Now().Add(time.Second); cancelled.Load() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the calls after the error were not cancelled")
+		}
+	}
+
+	err = runOrdered(context.Background(), 5, 2, func(ctx context.Context, i int) error {
+		return nil
+	}, func(i int) error {
+		if i == 1 {
+			return boom
+		}
+		return nil
+	})
+	if err != boom {
+		t.Errorf("got %v, want the error of done", err)
+	}
+}
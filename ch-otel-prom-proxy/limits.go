@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/prometheus/model/labels"
+	prompb "github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/util/annotations"
+)
+
+// limitError reports a query that went over one of the tenant's limits.
+type limitError struct {
+	what  string
+	limit int
+}
+
+func (e *limitError) Error() string {
+	return fmt.Sprintf("query exceeded the limit of %d %s; narrow it down or shorten its range", e.limit, e.what)
+}
+
+// exceeded returns err, unless the tenant of ctx allows partial responses,
+// in which case the query goes on with what it has and err becomes a
+// warning.
+func exceeded(ctx context.Context, err *limitError) error {
+	if !tenantFrom(ctx).limits.PartialResponse {
+		return err
+	}
+	addQueryWarning(ctx, err)
+	return nil
+}
+
+type truncatedKey struct{}
+
+// withTruncation returns a context that records whether the row limit cut
+// short a query run with it, which partial response mode lets go on.
+func withTruncation(ctx context.Context) (context.Context, *atomic.Bool) {
+	cut := &atomic.Bool{}
+	return context.WithValue(ctx, truncatedKey{}, cut), cut
+}
+
+func markTruncated(ctx context.Context) {
+	if cut, ok := ctx.Value(truncatedKey{}).(*atomic.Bool); ok {
+		cut.Store(true)
+	}
+}
+
+// queryWarnings collects what went wrong during a request without failing
+// it.
+type queryWarnings struct {
+	mu    sync.Mutex
+	annos annotations.Annotations
+}
+
+type queryWarningsKey struct{}
+
+func withQueryWarnings(ctx context.Context) (context.Context, *queryWarnings) {
+	w := &queryWarnings{}
+	return context.WithValue(ctx, queryWarningsKey{}, w), w
+}
+
+func addQueryWarning(ctx context.Context, err error) {
+	log.Printf("partial response: %v", err)
+	if w, ok := ctx.Value(queryWarningsKey{}).(*queryWarnings); ok {
+		w.mu.Lock()
+		w.annos.Add(err)
+		w.mu.Unlock()
+	}
+}
+
+func (w *queryWarnings) annotations() annotations.Annotations {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return annotations.New().Merge(w.annos)
+}
+
+// rowBudget counts the rows the ClickHouse queries of one query read against
+// its row limit, so that splitting the query into shards does not multiply
+// the limit.
+type rowBudget struct {
+	limit int
+	used  atomic.Int64
+}
+
+type rowBudgetKey struct{}
+
+// withRowBudget returns a context whose queries share one row budget, if
+// there is a row limit. A budget already in ctx is kept.
+func withRowBudget(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(rowBudgetKey{}).(*rowBudget); ok {
+		return ctx
+	}
+	n := rowLimit(ctx)
+	if n <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, rowBudgetKey{}, &rowBudget{limit: n})
+}
+
+func (b *rowBudget) remaining() int {
+	return max(b.limit-int(b.used.Load()), 0)
+}
+
+// queryLimited runs a query built with limitClause, which reads one row past
+// the row budget so that reaching it can be told apart from running into it.
+// Queries of a shard wait for its turn.
+func queryLimited(ctx context.Context, query string, args ...interface{}) (*queryRows, error) {
+	turn, _ := ctx.Value(shardTurnKey{}).(*shardTurn)
+	rows, err := turn.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	rows.budget, _ = ctx.Value(rowBudgetKey{}).(*rowBudget)
+	if n := rowLimit(ctx); rows.budget == nil && n > 0 {
+		rows.budget = &rowBudget{limit: n}
+	}
+	return rows, nil
+}
+
+// limitingAppender holds the series of one query to the tenant's series,
+// sample and byte limits. Once over one, it cancels the query, or in partial
+// response mode drops whatever does not fit.
+type limitingAppender struct {
+	app      seriesAppender
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+	matchers []*labels.Matcher
+	limits   limitsConfig
+
+	series  map[uint64]struct{}
+	samples int
+	bytes   int
+	warned  map[string]bool
+	full    bool
+	err     error
+}
+
+// sampleBytes is what a float sample is counted as against the byte limit.
+const sampleBytes = 16
+
+// newLimitingAppender wraps app when the tenant of ctx has per-query limits,
+// returning the context the query has to run with.
+func newLimitingAppender(ctx context.Context, q *prompb.Query, app seriesAppender) (context.Context, *limitingAppender, error) {
+	l := tenantFrom(ctx).limits
+	if l.MaxSeriesPerQuery <= 0 && l.MaxSamplesPerQuery <= 0 && l.MaxBytesPerQuery <= 0 {
+		return ctx, nil, nil
+	}
+	lms, err := toLabelMatchers(q.Matchers)
+	if err != nil {
+		return ctx, nil, err
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	return ctx, &limitingAppender{
+		app:      app,
+		ctx:      ctx,
+		cancel:   cancel,
+		matchers: lms,
+		limits:   l,
+		series:   map[uint64]struct{}{},
+		warned:   map[string]bool{},
+	}, nil
+}
+
+// admit counts a point of ls taking size bytes, and reports whether it fits.
+func (a *limitingAppender) admit(ls []prompb.Label, size int) bool {
+	if a.full {
+		return false
+	}
+	sortLabels(ls)
+	// The appender behind drops series the matchers do not select; they
+	// do not count.
+	if !seriesMatches(ls, a.matchers) {
+		return true
+	}
+
+	fp := fingerprint(ls)
+	_, known := a.series[fp]
+	if !known {
+		for _, l := range ls {
+			size += len(l.Name) + len(l.Value)
+		}
+	}
+	switch {
+	case !known && a.limits.MaxSeriesPerQuery > 0 && len(a.series) >= a.limits.MaxSeriesPerQuery:
+		// Series already in keep their points.
+		return a.exceed(&limitError{"series", a.limits.MaxSeriesPerQuery}, false)
+	case a.limits.MaxSamplesPerQuery > 0 && a.samples >= a.limits.MaxSamplesPerQuery:
+		return a.exceed(&limitError{"samples", a.limits.MaxSamplesPerQuery}, true)
+	case a.limits.MaxBytesPerQuery > 0 && a.bytes+size > a.limits.MaxBytesPerQuery:
+		return a.exceed(&limitError{"bytes", a.limits.MaxBytesPerQuery}, true)
+	}
+	a.series[fp] = struct{}{}
+	a.samples++
+	a.bytes += size
+	return true
+}
+
+// exceed handles going over a limit. In partial response mode, the query
+// goes on if stop is false, dropping just the point at hand.
+func (a *limitingAppender) exceed(err *limitError, stop bool) bool {
+	if !a.limits.PartialResponse {
+		a.full, a.err = true, err
+		a.cancel(err)
+		return false
+	}
+	if !a.warned[err.what] {
+		a.warned[err.what] = true
+		addQueryWarning(a.ctx, err)
+	}
+	a.full = stop
+	return false
+}
+
+func (a *limitingAppender) addSample(ls []prompb.Label, sample prompb.Sample) {
+	if a.admit(ls, sampleBytes) {
+		a.app.addSample(ls, sample)
+	}
+}
+
+func (a *limitingAppender) addHistogram(ls []prompb.Label, h prompb.Histogram) {
+	if a.admit(ls, h.Size()) {
+		a.app.addHistogram(ls, h)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+// recordingAppender records the points that get through as host@timestamp.
+type recordingAppender struct {
+	got []string
+}
+
+func (r *recordingAppender) addSample(ls []prompb.Label, s prompb.Sample) {
+	r.got = append(r.got, fmt.Sprintf("%s@%d", labelValue(ls, "host"), s.Timestamp))
+}
+
+func (r *recordingAppender) addHistogram(ls []prompb.Label, h prompb.Histogram) {
+	r.got = append(r.got, fmt.Sprintf("%s@%d", labelValue(ls, "host"), h.Timestamp))
+}
+
+func labelValue(ls []prompb.Label, name string) string {
+	for _, l := range ls {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+func TestLimitingAppender(t *testing.T) {
+	type point struct {
+		host string
+		ts   int64
+	}
+	// A first point of m{host="x"} takes 16 + len("__name__m") +
+	// len("hostx") = 30 bytes, every later one 16.
+	for _, tc := range []struct {
+		name         string
+		limits       limitsConfig
+		host         string // selects only this host, if set
+		points       []point
+		want         []string
+		wantErr      string
+		wantWarnings int
+	}{
+		{
+			name:    "series",
+			limits:  limitsConfig{MaxSeriesPerQuery: 2},
+			points:  []point{{"a", 1}, {"b", 1}, {"c", 1}, {"a", 2}},
+			want:    []string{"a@1", "b@1"},
+			wantErr: "series",
+		},
+		{
+			name:         "series, partial",
+			limits:       limitsConfig{MaxSeriesPerQuery: 2, PartialResponse: true},
+			points:       []point{{"a", 1}, {"b", 1}, {"c", 1}, {"a", 2}, {"d", 2}, {"b", 2}},
+			want:         []string{"a@1", "b@1", "a@2", "b@2"},
+			wantWarnings: 1,
+		},
+		{
+			name:    "samples",
+			limits:  limitsConfig{MaxSamplesPerQuery: 3},
+			points:  []point{{"a", 1}, {"b", 1}, {"a", 2}, {"b", 2}},
+			want:    []string{"a@1", "b@1", "a@2"},
+			wantErr: "samples",
+		},
+		{
+			name:         "samples, partial",
+			limits:       limitsConfig{MaxSamplesPerQuery: 3, PartialResponse: true},
+			points:       []point{{"a", 1}, {"b", 1}, {"a", 2}, {"b", 2}, {"a", 3}},
+			want:         []string{"a@1", "b@1", "a@2"},
+			wantWarnings: 1,
+		},
+		{
+			name:    "bytes",
+			limits:  limitsConfig{MaxBytesPerQuery: 61},
+			points:  []point{{"a", 1}, {"a", 2}, {"a", 3}, {"b", 1}},
+			want:    []string{"a@1", "a@2"},
+			wantErr: "bytes",
+		},
+		{
+			name:         "bytes, partial",
+			limits:       limitsConfig{MaxBytesPerQuery: 61, PartialResponse: true},
+			points:       []point{{"a", 1}, {"a", 2}, {"a", 3}, {"a", 4}},
+			want:         []string{"a@1", "a@2"},
+			wantWarnings: 1,
+		},
+		{
+			name:   "series the matchers drop do not count",
+			limits: limitsConfig{MaxSeriesPerQuery: 1, MaxSamplesPerQuery: 2},
+			host:   "a",
+			points: []point{{"b", 1}, {"a", 1}, {"c", 1}, {"a", 2}, {"b", 2}},
+			want:   []string{"b@1", "a@1", "c@1", "a@2", "b@2"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := withTenant(context.Background(), newTenant("", nil, "otel_metrics", nil, tc.limits))
+			ctx, warnings := withQueryWarnings(ctx)
+			q := &prompb.Query{Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "m"}}}
+			if tc.host != "" {
+				q.Matchers = append(q.Matchers, &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "host", Value: tc.host})
+			}
+			rec := &recordingAppender{}
+			ctx, app, err := newLimitingAppender(ctx, q, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range tc.points {
+				app.addSample([]prompb.Label{{Name: "host", Value: p.host}, {Name: "__name__", Value: "m"}}, prompb.Sample{Timestamp: p.ts})
+			}
+
+			if !reflect.DeepEqual(rec.got, tc.want) {
+				t.Errorf("let through %v, want %v", rec.got, tc.want)
+			}
+			if tc.wantErr == "" {
+				if app.err != nil || ctx.Err() != nil {
+					t.Errorf("got error %v, context error %v, want none", app.err, ctx.Err())
+				}
+			} else {
+				lerr, ok := app.err.(*limitError)
+				if !ok || lerr.what != tc.wantErr {
+					t.Errorf("got error %v, want the %s limit", app.err, tc.wantErr)
+				}
+				if context.Cause(ctx) != app.err {
+					t.Errorf("query cancelled with %v, want %v", context.Cause(ctx), app.err)
+				}
+			}
+			if n := len(warnings.annotations()); n != tc.wantWarnings {
+				t.Errorf("got %d warnings, want %d", n, tc.wantWarnings)
+			}
+		})
+	}
+}
+
+func TestLimitingAppenderHistograms(t *testing.T) {
+	h := prompb.Histogram{Timestamp: 1, Sum: 1, Count: &prompb.Histogram_CountInt{CountInt: 1}}
+	size := h.Size() + len("__name__m") + len("hosta")
+	ctx := withTenant(context.Background(), newTenant("", nil, "otel_metrics", nil, limitsConfig{MaxBytesPerQuery: size + h.Size() - 1}))
+	rec := &recordingAppender{}
+	_, app, err := newLimitingAppender(ctx, &prompb.Query{}, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := []prompb.Label{{Name: "__name__", Value: "m"}, {Name: "host", Value: "a"}}
+	app.addHistogram(ls, h)
+	h.Timestamp = 2
+	app.addHistogram(ls, h)
+	if want := []string{"a@1"}; !reflect.DeepEqual(rec.got, want) {
+		t.Errorf("let through %v, want %v", rec.got, want)
+	}
+}
+
+func TestNoLimitingAppenderWithoutLimits(t *testing.T) {
+	ctx := withTenant(context.Background(), newTenant("", nil, "otel_metrics", nil, limitsConfig{MaxRows: 10}))
+	if _, app, err := newLimitingAppender(ctx, &prompb.Query{}, &recordingAppender{}); app != nil || err != nil {
+		t.Errorf("got %v, %v, want no appender", app, err)
+	}
+}
@@ -3,14 +3,18 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
@@ -19,62 +23,170 @@ import (
 	prompb "github.com/prometheus/prometheus/prompb"
 )
 
+// Settings of the running proxy, filled in from the config by config.apply.
 var (
-	chAddr       = envOr("CLICKHOUSE_ADDR", "clickhouse-server:9000")
-	chDatabase   = envOr("CLICKHOUSE_DB", "otel_metrics")
-	chUser       = envOr("CLICKHOUSE_USER", "otel_user")
-	chPass       = envOr("CLICKHOUSE_PASS", "otel_pass")
-	chTable      = envOr("CLICKHOUSE_TABLE", "otel_metrics_sum")
-	listenAddr   = envOr("PROXY_LISTEN", ":9364")
-	queryTimeout = envDurationOr("QUERY_TIMEOUT", 30*time.Second)
-	maxRows      = envIntOr("MAX_ROWS", 20000)
+	chDatabase   string
+	chTable      string
+	listenAddr   string
+	queryTimeout time.Duration
+
+	queryLookbackDelta time.Duration
+
+	chGaugeTable                string
+	chHistogramTable            string
+	chExponentialHistogramTable string
+	chSummaryTable              string
+	metricCatalogTTL            time.Duration
+	metricCatalogRange          time.Duration
+
+	metadataDefaultRange time.Duration
+
+	pushdownEnabled     bool
+	readConcurrency     int
+	shardInterval       time.Duration
+	remoteReadExemplars bool
+
+	promoteResourceAttrs []string
+	targetInfoEnabled    bool
+
+	translateNames bool
 )
 
-func envOr(k, d string) string {
-	if v := os.Getenv(k); v != "" {
-		return v
+var db *sql.DB
+
+func openClickHouse(c clickHouseConfig) (*sql.DB, error) {
+	tlsConfig, err := c.TLS.tlsConfig()
+	if err != nil {
+		return nil, err
 	}
-	return d
+	return clickhouse.OpenDB(&clickhouse.Options{
+		Addr: []string{c.Address},
+		Auth: clickhouse.Auth{
+			Database: c.Database,
+			Username: c.Username,
+			Password: c.Password,
+		},
+		TLS: tlsConfig,
+	}), nil
 }
-func envDurationOr(k string, d time.Duration) time.Duration {
-	if v := os.Getenv(k); v != "" {
-		if t, err := time.ParseDuration(v); err == nil {
-			return t
+
+func main() {
+	cfg := defaultConfig()
+	configFile := flag.String("config.file", "", "YAML config file.")
+	checkConfig := flag.Bool("check-config", false, "Validate the config, print it and exit.")
+	cfg.registerFlags(flag.CommandLine)
+	flag.Parse()
+
+	if err := cfg.load(*configFile, flag.CommandLine); err != nil {
+		if *checkConfig {
+			fmt.Fprintf(os.Stderr, "invalid config: %v\n", err)
+			os.Exit(1)
 		}
+		log.Fatalf("invalid config: %v", err)
 	}
-	return d
-}
-func envIntOr(k string, d int) int {
-	if v := os.Getenv(k); v != "" {
-		if n, err := strconv.Atoi(v); err == nil {
-			return n
-		}
+	if *checkConfig {
+		fmt.Print(cfg)
+		return
 	}
-	return d
-}
+	cfg.apply()
 
-var db *sql.DB
+	metricsHandler, shutdownTelemetry, err := setupTelemetry(cfg.Telemetry)
+	if err != nil {
+		log.Fatalf("telemetry: %v", err)
+	}
 
-func main() {
-	flag.Parse()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-	opts := &clickhouse.Options{
-		Addr: []string{chAddr},
-		Auth: clickhouse.Auth{
-			Database: chDatabase,
-			Username: chUser,
-			Password: chPass,
-		},
+	db, err = openClickHouse(cfg.ClickHouse)
+	if err != nil {
+		log.Fatalf("clickhouse: %v", err)
+	}
+	if err := setupTenants(cfg, db); err != nil {
+		log.Fatalf("tenants: %v", err)
+	}
+	// An unreachable ClickHouse leaves the proxy running but not ready.
+	pingInterval := time.Duration(cfg.ClickHouse.PingInterval)
+	ready.check(ctx, pingInterval)
+	go ready.watch(ctx, pingInterval)
+
+	handle("/read", handleRemoteRead)
+	handle("/write", handleRemoteWrite)
+
+	handle("/api/v1/query", handleQuery)
+	handle("/api/v1/query_range", handleQueryRange)
+	handle("/api/v1/series", handleSeries)
+	handle("/api/v1/labels", handleLabels)
+	handle("/api/v1/label/{name}/values", handleLabelValues)
+	handle("/api/v1/query_exemplars", handleQueryExemplars)
+
+	// The proxy's own endpoints belong to no tenant.
+	root := http.NewServeMux()
+	root.Handle(cfg.Telemetry.MetricsPath, metricsHandler)
+	root.Handle("/", withTenants(http.DefaultServeMux))
+
+	// Health probes tell nothing about the data, and are answered without
+	// credentials so orchestrators need none.
+	probes := http.NewServeMux()
+	probes.HandleFunc("/-/healthy", handleHealthy)
+	probes.HandleFunc("/-/ready", handleReady)
+	probes.Handle("/", newAuthenticator(cfg).wrap(root))
+
+	tlsConfig, err := cfg.Web.tlsConfig()
+	if err != nil {
+		log.Fatalf("web TLS: %v", err)
 	}
-	var err error
-	db = clickhouse.OpenDB(opts)
-	if err = db.Ping(); err != nil {
-		log.Fatalf("clickhouse ping: %v", err)
+	// Requests and their ClickHouse queries run under queryCtx, which is
+	// only cancelled once the shutdown deadline has passed.
+	queryCtx, cancelQueries := context.WithCancel(context.Background())
+	defer cancelQueries()
+	srv := &http.Server{
+		Addr:        listenAddr,
+		Handler:     probes,
+		TLSConfig:   tlsConfig,
+		BaseContext: func(net.Listener) context.Context { return queryCtx },
 	}
 
-	http.HandleFunc("/read", handleRemoteRead)
 	log.Printf("listening on %s, ClickHouse %s.%s", listenAddr, chDatabase, chTable)
-	log.Fatal(http.ListenAndServe(listenAddr, nil))
+	serveErr := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			serveErr <- srv.ListenAndServeTLS("", "")
+			return
+		}
+		serveErr <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	// A second signal kills the proxy right away.
+	stop()
+
+	ready.drain()
+	if delay := time.Duration(cfg.Web.DrainDelay); delay > 0 {
+		log.Printf("not ready, serving for another %s before shutting down", delay)
+		time.Sleep(delay)
+	}
+	timeout := time.Duration(cfg.Web.ShutdownTimeout)
+	log.Printf("shutting down, waiting up to %s for in-flight requests", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("shutdown: %v; cancelling in-flight queries", err)
+		cancelQueries()
+		srv.Close()
+	}
+
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFlush()
+	if err := shutdownTelemetry(flushCtx); err != nil {
+		log.Printf("telemetry shutdown: %v", err)
+	}
+	for _, c := range connections() {
+		c.db.Close()
+	}
 }
 
 func handleRemoteRead(w http.ResponseWriter, r *http.Request) {
@@ -98,19 +210,46 @@ func handleRemoteRead(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp := &prompb.ReadResponse{}
-	for _, q := range rr.Queries {
-		ts, err := processQueryExponentialHistogram(ctx, q)
-		if err != nil {
-			log.Printf("processQuery error: %v", err)
-			http.Error(w, "internal error", http.StatusInternalServerError)
+	respType, err := negotiateResponseType(rr.AcceptedResponseTypes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if respType == prompb.ReadRequest_STREAMED_XOR_CHUNKS {
+		streamChunkedResponse(withRowLimit(ctx, tenantFrom(ctx).limits.MaxStreamedRows), w, &rr)
+		return
+	}
+
+	ctx, warnings := withQueryWarnings(ctx)
+	sets := make([]*seriesSet, len(rr.Queries))
+	for i, q := range rr.Queries {
+		if sets[i], err = newSeriesSet(q.Matchers); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+	}
 
-		qr := &prompb.QueryResult{
-			Timeseries: ts,
+	resp := &prompb.ReadResponse{Results: make([]*prompb.QueryResult, len(rr.Queries))}
+	err = runOrdered(ctx, len(rr.Queries), readConcurrency, func(ctx context.Context, i int) error {
+		// Exemplars count against the row limit of the samples.
+		ctx = withRowBudget(ctx)
+		if err := dispatchQuery(ctx, rr.Queries[i], sets[i]); err != nil {
+			return err
+		}
+		if !remoteReadExemplars {
+			return nil
 		}
-		resp.Results = append(resp.Results, qr)
+		if err := queryExemplars(ctx, rr.Queries[i], sets[i]); err != nil {
+			return fmt.Errorf("exemplars: %w", err)
+		}
+		return nil
+	}, func(i int) error {
+		resp.Results[i] = &prompb.QueryResult{Timeseries: sets[i].series()}
+		return nil
+	})
+	if err != nil {
+		writeReadError(w, err)
+		return
 	}
 
 	out, err := proto.Marshal(resp)
@@ -119,32 +258,103 @@ func handleRemoteRead(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	enc := snappy.Encode(nil, out)
+	// Remote read has no place for warnings in the response itself.
+	for _, warning := range warnings.annotations().AsErrors() {
+		w.Header().Add("Warning", fmt.Sprintf("299 - %q", warning.Error()))
+	}
 	w.Header().Set("Content-Type", "application/x-protobuf")
 	w.Header().Set("Content-Encoding", "snappy")
 	_, _ = w.Write(enc)
 }
 
-func ProcessQuery(ctx context.Context, q *prompb.Query) ([]*prompb.TimeSeries, error) {
+// writeReadError answers a remote-read request whose queries failed. Queries
+// the limiter turned away are answered with its status and Retry-After, and
+// queries over a limit with 422.
+func writeReadError(w http.ResponseWriter, err error) {
+	var (
+		overload *overloadError
+		limitErr *limitError
+	)
+	switch {
+	case errors.As(err, &overload):
+		overload.writeHeaders(w)
+		http.Error(w, overload.Error(), overload.status)
+		return
+	case errors.As(err, &limitErr):
+		http.Error(w, limitErr.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	log.Printf("processQuery error: %v", err)
+	http.Error(w, "internal error", http.StatusInternalServerError)
+}
+
+// negotiateResponseType picks the first accepted response type the proxy
+// supports. Requests that accept nothing in particular get SAMPLES.
+func negotiateResponseType(accepted []prompb.ReadRequest_ResponseType) (prompb.ReadRequest_ResponseType, error) {
+	if len(accepted) == 0 {
+		return prompb.ReadRequest_SAMPLES, nil
+	}
+	for _, t := range accepted {
+		switch t {
+		case prompb.ReadRequest_SAMPLES, prompb.ReadRequest_STREAMED_XOR_CHUNKS:
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("none of the accepted response types %v is supported", accepted)
+}
+
+type rowLimitKey struct{}
+
+// withRowLimit overrides the tenant's MaxRows for the queries run with ctx. A limit of
+// zero or less means no limit.
+func withRowLimit(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, rowLimitKey{}, n)
+}
+
+// rowLimit returns the maximum rows a ClickHouse query run with ctx may
+// read, or zero or less for no limit.
+func rowLimit(ctx context.Context) int {
+	if n, ok := ctx.Value(rowLimitKey{}).(int); ok {
+		return n
+	}
+	return tenantFrom(ctx).limits.MaxRows
+}
+
+// limitClause reads one row past what is left of the row budget, for
+// queryLimited to tell when the limit cut the result short.
+func limitClause(ctx context.Context) string {
+	n := rowLimit(ctx)
+	if n <= 0 {
+		return ""
+	}
+	if b, ok := ctx.Value(rowBudgetKey{}).(*rowBudget); ok {
+		n = b.remaining()
+	}
+	return fmt.Sprintf("LIMIT %d", n+1)
+}
+
+// timeRangeCondition selects the points of [startMs, endMs+1), given as its
+// arguments. Samples are exposed at millisecond precision, so the whole end
+// millisecond belongs to the range, and the ranges [a, b] and [b+1, c]
+// neither share nor drop a point.
+const timeRangeCondition = "TimeUnix >= fromUnixTimestamp64Milli(toInt64(?)) AND TimeUnix < fromUnixTimestamp64Milli(toInt64(?))"
+
+func ProcessQuery(ctx context.Context, q *prompb.Query, app seriesAppender) error {
 	var metricNameEq string
-	labelEq := map[string]string{}
+	var matchers []*prompb.LabelMatcher
 	for _, m := range q.Matchers {
-		if m.Type == prompb.LabelMatcher_EQ {
-			if m.Name == "__name__" {
-				metricNameEq = m.Value
-			} else {
-				labelEq[m.Name] = m.Value
-			}
+		if m.Type == prompb.LabelMatcher_EQ && m.Name == "__name__" && metricNameEq == "" {
+			metricNameEq = m.Value
+			continue
 		}
+		matchers = append(matchers, m)
 	}
 
-	// Convert start/end to seconds
 	startMs := q.StartTimestampMs
 	endMs := q.EndTimestampMs
 	if endMs == 0 {
 		endMs = time.Now().UnixNano() / 1e6
 	}
-	startSec := float64(startMs) / 1000.0
-	endSec := float64(endMs) / 1000.0
 
 	// Determine wantType and baseMetric
 	wantType := ""
@@ -166,49 +376,52 @@ func ProcessQuery(ctx context.Context, q *prompb.Query) ([]*prompb.TimeSeries, e
 	}
 
 	// Build WHERE clause and arguments
-	where := []string{"TimeUnix >= toDateTime64(?,9) AND TimeUnix <= toDateTime64(?,9)"}
-	args := []interface{}{startSec, endSec}
+	where := []string{timeRangeCondition}
+	args := []interface{}{startMs, endMs + 1}
 
 	if baseMetric != "" {
 		where = append(where, "MetricName = ?")
 		args = append(args, baseMetric)
 	}
 
-	leFilter := ""
-	if v, ok := labelEq["le"]; ok {
-		leFilter = v
-		delete(labelEq, "le")
+	nameExprs := make([]string, 0, len(histogramSuffixes))
+	for _, suffix := range histogramSuffixes {
+		nameExprs = append(nameExprs, fmt.Sprintf("concat(MetricName, '%s')", suffix))
 	}
-	for k, v := range labelEq {
-		ek := strings.ReplaceAll(k, "'", "\\'")
-		where = append(where, fmt.Sprintf("Attributes['%s'] = ?", ek))
-		args = append(args, v)
+	mWhere, mArgs, err := matchersWhere(matchers, nameExprs, "le")
+	if err != nil {
+		return err
 	}
+	where = append(where, mWhere...)
+	args = append(args, mArgs...)
 
 	whereClause := strings.Join(where, " AND ")
 
 	query := fmt.Sprintf(`
 SELECT
   MetricName,
-  Attributes,
+  %s AS Labels,
   toUnixTimestamp64Nano(TimeUnix) AS ts_ns,
   Sum,
   Count,
   BucketCounts,
-  ExplicitBounds
-FROM %s.%s
+  ExplicitBounds,
+  Flags,
+  AggregationTemporality,
+  toUnixTimestamp64Nano(StartTimeUnix) AS start_ns
+FROM %s
 WHERE %s
-LIMIT %d
-`, chDatabase, chTable, whereClause, maxRows)
+ORDER BY TimeUnix
+%s
+`, labelsExpr(), tableRef(ctx, chHistogramTable), whereClause, limitClause(ctx))
 
-	rows, err := db.QueryContext(ctx, query, args...)
+	rows, err := queryLimited(ctx, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("clickhouse query: %w", err)
+		return fmt.Errorf("clickhouse query: %w", err)
 	}
 	defer rows.Close()
 
-	var out []*prompb.TimeSeries
-
+	deltas, resets := seriesStateFor(ctx, q)
 	for rows.Next() {
 		var metricName string
 		var attributes map[string]string
@@ -217,9 +430,12 @@ LIMIT %d
 		var count uint64
 		var bucketCounts []uint64
 		var explicitBounds []float64
+		var flags uint32
+		var temporality int32
+		var startNS int64
 
-		if err := rows.Scan(&metricName, &attributes, &tsNS, &sum, &count, &bucketCounts, &explicitBounds); err != nil {
-			log.Printf("scan error: %v", err)
+		if err := rows.Scan(&metricName, &attributes, &tsNS, &sum, &count, &bucketCounts, &explicitBounds, &flags, &temporality, &startNS); err != nil {
+			logScanError(ctx, err)
 			continue
 		}
 
@@ -228,122 +444,118 @@ LIMIT %d
 			baseLabels = append(baseLabels, prompb.Label{Name: k, Value: v})
 		}
 
-		// Buckets (including +Inf)
-		cum := uint64(0)
-		for i := 0; i < len(bucketCounts); i++ {
-			cum += bucketCounts[i]
-
-			leStr := "+Inf"
-			if i < len(explicitBounds) {
-				leStr = strconv.FormatFloat(explicitBounds[i], 'g', -1, 64)
-			}
-
+		// emit adds one point of every wanted sub-series, with buckets
+		// holding the cumulative le counts.
+		emit := func(tsMs int64, sum, count float64, buckets []float64) {
 			if wantType == "" || wantType == "bucket" {
-				if leFilter != "" && leFilter != leStr {
-					continue
+				for i, v := range buckets {
+					leStr := "+Inf"
+					if i < len(explicitBounds) {
+						leStr = strconv.FormatFloat(explicitBounds[i], 'g', -1, 64)
+					}
+					labels := append([]prompb.Label{
+						{Name: "__name__", Value: metricName + "_bucket"},
+						{Name: "le", Value: leStr},
+					}, baseLabels...)
+					app.addSample(labels, prompb.Sample{Timestamp: tsMs, Value: v})
 				}
-				labels := append([]prompb.Label{
-					{Name: "__name__", Value: metricName + "_bucket"},
-					{Name: "le", Value: leStr},
-				}, baseLabels...)
+			}
 
-				out = append(out, &prompb.TimeSeries{
-					Labels:  labels,
-					Samples: []prompb.Sample{{Timestamp: tsNS / 1e6, Value: float64(cum)}},
-				})
+			if wantType == "" || wantType == "sum" {
+				labels := append([]prompb.Label{{Name: "__name__", Value: metricName + "_sum"}}, baseLabels...)
+				app.addSample(labels, prompb.Sample{Timestamp: tsMs, Value: sum})
+			}
+
+			if wantType == "" || wantType == "count" {
+				labels := append([]prompb.Label{{Name: "__name__", Value: metricName + "_count"}}, baseLabels...)
+				app.addSample(labels, prompb.Sample{Timestamp: tsMs, Value: count})
 			}
 		}
 
-		// Sum
-		if wantType == "" || wantType == "sum" {
-			labels := append([]prompb.Label{{Name: "__name__", Value: metricName + "_sum"}}, baseLabels...)
-			out = append(out, &prompb.TimeSeries{
-				Labels:  labels,
-				Samples: []prompb.Sample{{Timestamp: tsNS / 1e6, Value: sum}},
-			})
+		buckets := make([]float64, len(bucketCounts))
+		switch {
+		case noRecordedValue(flags):
+			for i := range buckets {
+				buckets[i] = staleNaN
+			}
+			emit(tsNS/1e6, staleNaN, staleNaN, buckets)
+			continue
+		case temporality == aggregationTemporalityDelta:
+			sum, count, bucketCounts = deltas.histogram(metricName, attributes, startNS, tsNS, sum, count, bucketCounts, explicitBounds)
+		default:
+			if zeroMs, ok := resets.zeroAt(metricName, attributes, startNS, tsNS); ok {
+				emit(zeroMs, 0, 0, buckets)
+			}
 		}
 
-		// Count
-		if wantType == "" || wantType == "count" {
-			labels := append([]prompb.Label{{Name: "__name__", Value: metricName + "_count"}}, baseLabels...)
-			out = append(out, &prompb.TimeSeries{
-				Labels:  labels,
-				Samples: []prompb.Sample{{Timestamp: tsNS / 1e6, Value: float64(count)}},
-			})
+		// Buckets (including +Inf)
+		cum := uint64(0)
+		for i := range bucketCounts {
+			cum += bucketCounts[i]
+			buckets[i] = float64(cum)
 		}
+		emit(tsNS/1e6, sum, float64(count), buckets)
 	}
 
-	return out, nil
+	return rows.Err()
 }
 
-func ProcessQuerySum(ctx context.Context, q *prompb.Query) ([]*prompb.TimeSeries, error) {
-	log.Printf("Prometheus query looks like: %v", q)
-
-	metricNameEq := ""
-	labelEq := map[string]string{}
-
-	for _, m := range q.Matchers {
-		if m.Type == prompb.LabelMatcher_EQ {
-			if m.Name == "__name__" {
-				metricNameEq = m.Value
-			} else {
-				labelEq[m.Name] = m.Value
-			}
-		}
-	}
-
+func ProcessQuerySum(ctx context.Context, q *prompb.Query, app seriesAppender) error {
 	startMs := q.StartTimestampMs
 	endMs := q.EndTimestampMs
 	if endMs == 0 {
 		endMs = time.Now().UnixNano() / 1e6
 	}
-	startSec := float64(startMs) / 1000.0
-	endSec := float64(endMs) / 1000.0
-
-	where := []string{"TimeUnix >= toDateTime64(?,9) AND TimeUnix <= toDateTime64(?,9)"}
-	args := []interface{}{startSec, endSec}
+	where := []string{timeRangeCondition}
+	args := []interface{}{startMs, endMs + 1}
 
-	if metricNameEq != "" {
-		where = append(where, "MetricName = ?")
-		args = append(args, metricNameEq)
-	}
-
-	for k, v := range labelEq {
-		ek := strings.ReplaceAll(k, "'", "\\'")
-		where = append(where, fmt.Sprintf("Attributes['%s'] = ?", ek))
-		args = append(args, v)
+	mWhere, mArgs, err := matchersWhere(q.Matchers, []string{"MetricName"})
+	if err != nil {
+		return err
 	}
+	where = append(where, mWhere...)
+	args = append(args, mArgs...)
 
 	whereClause := strings.Join(where, " AND ")
 
 	query := fmt.Sprintf(`
 SELECT
   MetricName,
-  Attributes,
+  %s AS Labels,
   toUnixTimestamp64Nano(TimeUnix) AS ts_ns,
-  Value AS SumValue
-FROM %s.%s
+  Value AS SumValue,
+  Flags,
+  AggregationTemporality,
+  toUnixTimestamp64Nano(StartTimeUnix) AS start_ns,
+  IsMonotonic
+FROM %s
 WHERE %s
 ORDER BY TimeUnix
-LIMIT %d
-`, chDatabase, chTable, whereClause, maxRows)
+%s
+`, labelsExpr(), tableRef(ctx, chTable), whereClause, limitClause(ctx))
+	if mode := pushdownMode(q, metricTypeSum); mode != downsampleNone {
+		query = downsampledQuery(ctx, q, mode, metricTypeSum, whereClause, limitClause(ctx))
+	}
 
-	rows, err := db.QueryContext(ctx, query, args...)
+	rows, err := queryLimited(ctx, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("ClickHouse query error: %w", err)
+		return fmt.Errorf("ClickHouse query error: %w", err)
 	}
 	defer rows.Close()
 
-	var out []*prompb.TimeSeries
-
+	deltas, resets := seriesStateFor(ctx, q)
 	for rows.Next() {
 		var metricName string
 		var attributes map[string]string
 		var tsNS int64
 		var sumValue float64
+		var flags uint32
+		var temporality int32
+		var startNS int64
+		var monotonic bool
 
-		if err := rows.Scan(&metricName, &attributes, &tsNS, &sumValue); err != nil {
-			log.Printf("row scan error: %v", err)
+		if err := rows.Scan(&metricName, &attributes, &tsNS, &sumValue, &flags, &temporality, &startNS, &monotonic); err != nil {
+			logScanError(ctx, err)
 			continue
 		}
 
@@ -352,34 +564,24 @@ LIMIT %d
 			labels = append(labels, prompb.Label{Name: k, Value: v})
 		}
 
-		ts := &prompb.TimeSeries{
-			Labels:  labels,
-			Samples: []prompb.Sample{{Timestamp: tsNS / 1e6, Value: sumValue}},
+		switch {
+		case noRecordedValue(flags):
+			sumValue = staleNaN
+		case temporality == aggregationTemporalityDelta:
+			sumValue = deltas.sum(metricName, attributes, startNS, tsNS, sumValue)
+		case monotonic:
+			if zeroMs, ok := resets.zeroAt(metricName, attributes, startNS, tsNS); ok {
+				app.addSample(labels, prompb.Sample{Timestamp: zeroMs, Value: 0})
+			}
 		}
 
-		out = append(out, ts)
+		app.addSample(labels, prompb.Sample{Timestamp: tsNS / 1e6, Value: sumValue})
 	}
 
-	return out, nil
+	return rows.Err()
 }
 
-func ProcessQueryGauge(ctx context.Context, q *prompb.Query) ([]*prompb.TimeSeries, error) {
-
-	log.Printf("Prometheus query looks like: %v", q)
-
-	metricNameEq := ""
-	labelEq := map[string]string{}
-
-	for _, m := range q.Matchers {
-		if m.Type == prompb.LabelMatcher_EQ {
-			if m.Name == "__name__" {
-				metricNameEq = m.Value
-			} else {
-				labelEq[m.Name] = m.Value
-			}
-		}
-	}
-
+func ProcessQueryGauge(ctx context.Context, q *prompb.Query, app seriesAppender) error {
 	startMs := q.StartTimestampMs
 	endMs := q.EndTimestampMs
 
@@ -387,119 +589,91 @@ func ProcessQueryGauge(ctx context.Context, q *prompb.Query) ([]*prompb.TimeSeri
 		endMs = time.Now().UnixNano() / 1e6
 	}
 
-	startSec := float64(startMs) / 1000.0
-	endSec := float64(endMs) / 1000.0
-
-	where := []string{"TimeUnix >= toDateTime64(?,9) AND TimeUnix <= toDateTime(?,9)"}
-	args := []interface{}{startSec, endSec}
-
-	if metricNameEq != "" {
-		where = append(where, "MetricName = ?")
-		args = append(args, metricNameEq)
-	}
+	where := []string{timeRangeCondition}
+	args := []interface{}{startMs, endMs + 1}
 
-	for k, v := range labelEq {
-		ek := strings.ReplaceAll(k, "'", "\\")
-		where = append(where, fmt.Sprintf("Attributes['%s'] = ?", ek))
-		args = append(args, v)
+	mWhere, mArgs, err := matchersWhere(q.Matchers, []string{"MetricName"})
+	if err != nil {
+		return err
 	}
+	where = append(where, mWhere...)
+	args = append(args, mArgs...)
 
 	whereClause := strings.Join(where, " AND ")
 
 	query := fmt.Sprintf(`
 	SELECT 
 		MetricName, 
-		Attributes, 
+		%s AS Labels,
 		toUnixTimestamp64Nano(TimeUnix) as ts_ns, 
-		Value as SumValue
-	FROM %s.otel_metrics_gauge
+		Value as SumValue,
+		Flags
+	FROM %s
 	WHERE %s
 	ORDER BY TimeUnix
-	LIMIT %d
-	`, chDatabase, whereClause, maxRows)
+	%s
+	`, labelsExpr(), tableRef(ctx, chGaugeTable), whereClause, limitClause(ctx))
+	if mode := pushdownMode(q, metricTypeGauge); mode != downsampleNone {
+		query = downsampledQuery(ctx, q, mode, metricTypeGauge, whereClause, limitClause(ctx))
+	}
 
-	rows, err := db.QueryContext(ctx, query, args...)
+	rows, err := queryLimited(ctx, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("ClickHouse query error: %w", err)
+		return fmt.Errorf("ClickHouse query error: %w", err)
 	}
 
 	defer rows.Close()
 
-	var out []*prompb.TimeSeries
-
 	for rows.Next() {
 
 		var metricName string
 		var attributes map[string]string
 		var tsNs int64
 		var sumValue float64
+		var flags uint32
 
-		if err := rows.Scan(&metricName, &attributes, &tsNs, &sumValue); err != nil {
-			log.Printf("row scan error: %v", err)
+		if err := rows.Scan(&metricName, &attributes, &tsNs, &sumValue, &flags); err != nil {
+			logScanError(ctx, err)
 			continue
 		}
+		if noRecordedValue(flags) {
+			sumValue = staleNaN
+		}
 
 		labels := []prompb.Label{{Name: "__name__", Value: metricName}}
 		for k, v := range attributes {
 			labels = append(labels, prompb.Label{Name: k, Value: v})
 		}
 
-		ts := &prompb.TimeSeries{
-			Labels:  labels,
-			Samples: []prompb.Sample{{Timestamp: tsNs / 1e6, Value: sumValue}},
-		}
-
-		out = append(out, ts)
+		app.addSample(labels, prompb.Sample{Timestamp: tsNs / 1e6, Value: sumValue})
 	}
 
-	return out, nil
+	return rows.Err()
 }
 
-func processQueryExponentialHistogram(ctx context.Context, q *prompb.Query) ([]*prompb.TimeSeries, error) {
-	log.Printf("Prometheus query looks like: %v", q)
-
-	metricNameEq := ""
-	labelEq := map[string]string{}
-
-	for _, m := range q.Matchers {
-		if m.Type == prompb.LabelMatcher_EQ {
-			if m.Name == "__name__" {
-				metricNameEq = m.Value
-			} else {
-				labelEq[m.Name] = m.Value
-			}
-		}
-	}
-
+func processQueryExponentialHistogram(ctx context.Context, q *prompb.Query, app seriesAppender) error {
 	startMs := q.StartTimestampMs
 	endMs := q.EndTimestampMs
 	if endMs == 0 {
 		endMs = time.Now().UnixNano() / 1e6
 	}
 
-	startSec := float64(startMs) / 1000.0
-	endSec := float64(endMs) / 1000.0
+	where := []string{timeRangeCondition}
+	args := []interface{}{startMs, endMs + 1}
 
-	where := []string{"TimeUnix >= toDateTime64(?,9) AND TimeUnix <= toDateTime64(?,9)"}
-	args := []interface{}{startSec, endSec}
-
-	if metricNameEq != "" {
-		where = append(where, "MetricName = ?")
-		args = append(args, metricNameEq)
-	}
-
-	for k, v := range labelEq {
-		ek := strings.ReplaceAll(k, "'", "\\")
-		where = append(where, fmt.Sprintf("Attributes['%s'] = ?", ek))
-		args = append(args, v)
+	mWhere, mArgs, err := matchersWhere(q.Matchers, []string{"MetricName"})
+	if err != nil {
+		return err
 	}
+	where = append(where, mWhere...)
+	args = append(args, mArgs...)
 
 	whereClause := strings.Join(where, " AND ")
 
 	query := fmt.Sprintf(`
 	SELECT
 		MetricName,
-		Attributes,
+		%s AS Labels,
 		toUnixTimestamp64Nano(TimeUnix) as ts_ns,
 		Scale,
 		ZeroCount,
@@ -510,54 +684,53 @@ func processQueryExponentialHistogram(ctx context.Context, q *prompb.Query) ([]*
 		Sum,
 		Min,
 		Max,
-		Count
-	FROM %s.otel_metrics_exponential_histogram
+		Count,
+		Flags,
+		AggregationTemporality,
+		toUnixTimestamp64Nano(StartTimeUnix) AS start_ns
+	FROM %s
 	WHERE %s
 	ORDER BY TimeUnix
-	LIMIT %d
-	`, chDatabase, whereClause, maxRows)
-
-	log.Printf("query: %v", query)
+	%s
+	`, labelsExpr(), tableRef(ctx, chExponentialHistogramTable), whereClause, limitClause(ctx))
 
-	rows, err := db.QueryContext(ctx, query, args...)
+	rows, err := queryLimited(ctx, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("ClickHouse query error: %w", err)
+		return fmt.Errorf("ClickHouse query error: %w", err)
 	}
 	defer rows.Close()
 
-	var out []*prompb.TimeSeries
-
+	deltas, resets := seriesStateFor(ctx, q)
 	for rows.Next() {
 		var metricName string
 		var attributes map[string]string
 		var tsNs int64
-		var scale int32
-		var zeroCount uint64
-		var posOffset int32
-		var posCounts []uint64
-		var negOffset int32
-		var negCounts []uint64
-		var sum float64
+		var row expHistogramRow
 		var min float64
 		var max float64
-		var count uint64
+		var flags uint32
+		var temporality int32
+		var startNs int64
 
 		if err := rows.Scan(
 			&metricName,
 			&attributes,
 			&tsNs,
-			&scale,
-			&zeroCount,
-			&posOffset,
-			&posCounts,
-			&negOffset,
-			&negCounts,
-			&sum,
+			&row.scale,
+			&row.zeroCount,
+			&row.posOffset,
+			&row.posCounts,
+			&row.negOffset,
+			&row.negCounts,
+			&row.sum,
 			&min,
 			&max,
-			&count,
+			&row.count,
+			&flags,
+			&temporality,
+			&startNs,
 		); err != nil {
-			log.Printf("row scan error: %v", err)
+			logScanError(ctx, err)
 			continue
 		}
 
@@ -566,17 +739,148 @@ func processQueryExponentialHistogram(ctx context.Context, q *prompb.Query) ([]*
 			labels = append(labels, prompb.Label{Name: k, Value: v})
 		}
 
-		totalValue := float64(zeroCount)*0.0 + sum 
+		switch {
+		case noRecordedValue(flags):
+			// A native histogram stale marker is one with a StaleNaN sum.
+			row = expHistogramRow{scale: row.scale, sum: staleNaN}
+		case temporality == aggregationTemporalityDelta:
+			row = deltas.expHistogram(metricName, attributes, startNs, tsNs, row)
+		default:
+			if zeroMs, ok := resets.zeroAt(metricName, attributes, startNs, tsNs); ok {
+				if h, err := (expHistogramRow{scale: row.scale}).toNativeHistogram(zeroMs); err == nil {
+					app.addHistogram(labels, h)
+				}
+			}
+		}
+
+		h, err := row.toNativeHistogram(tsNs / 1e6)
+		if err != nil {
+			log.Printf("%s: %v", metricName, err)
+			continue
+		}
+
+		app.addHistogram(labels, h)
+	}
+
+	return rows.Err()
+}
+
+func processQuerySummary(ctx context.Context, q *prompb.Query, app seriesAppender) error {
+	startMs := q.StartTimestampMs
+	endMs := q.EndTimestampMs
+	if endMs == 0 {
+		endMs = time.Now().UnixNano() / 1e6
+	}
+
+	// Only emit the sub-series (quantiles, _sum, _count) the __name__
+	// matchers ask for.
+	var nameMatchers []*prompb.LabelMatcher
+	for _, m := range q.Matchers {
+		if m.Name == "__name__" {
+			nameMatchers = append(nameMatchers, m)
+		}
+	}
+	lms, err := toLabelMatchers(nameMatchers)
+	if err != nil {
+		return err
+	}
+	wanted := func(name string) bool {
+		return seriesMatches([]prompb.Label{{Name: "__name__", Value: name}}, lms)
+	}
+
+	where := []string{timeRangeCondition}
+	args := []interface{}{startMs, endMs + 1}
+
+	mWhere, mArgs, err := matchersWhere(q.Matchers, metricTypeSummary.nameExprs(), "quantile")
+	if err != nil {
+		return err
+	}
+	where = append(where, mWhere...)
+	args = append(args, mArgs...)
+
+	whereClause := strings.Join(where, " AND ")
+
+	query := fmt.Sprintf(`
+SELECT
+  MetricName,
+  %s AS Labels,
+  toUnixTimestamp64Nano(TimeUnix) AS ts_ns,
+  Sum,
+  Count,
+  ValueAtQuantiles.Quantile,
+  ValueAtQuantiles.Value,
+  Flags,
+  toUnixTimestamp64Nano(StartTimeUnix) AS start_ns
+FROM %s
+WHERE %s
+ORDER BY TimeUnix
+%s
+`, labelsExpr(), tableRef(ctx, chSummaryTable), whereClause, limitClause(ctx))
+
+	rows, err := queryLimited(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("ClickHouse query error: %w", err)
+	}
+	defer rows.Close()
 
-		ts := &prompb.TimeSeries{
-			Labels:  labels,
-			Samples: []prompb.Sample{{Timestamp: tsNs / 1e6, Value: totalValue}},
+	_, resets := seriesStateFor(ctx, q)
+	for rows.Next() {
+		var metricName string
+		var attributes map[string]string
+		var tsNS int64
+		var sum float64
+		var count uint64
+		var quantiles []float64
+		var values []float64
+		var flags uint32
+		var startNS int64
+
+		if err := rows.Scan(&metricName, &attributes, &tsNS, &sum, &count, &quantiles, &values, &flags, &startNS); err != nil {
+			logScanError(ctx, err)
+			continue
 		}
 
-		log.Printf("output rows: %v", ts)
+		baseLabels := []prompb.Label{}
+		for k, v := range attributes {
+			baseLabels = append(baseLabels, prompb.Label{Name: k, Value: v})
+		}
 
-		out = append(out, ts)
+		countValue := float64(count)
+		if noRecordedValue(flags) {
+			sum, countValue = staleNaN, staleNaN
+			for i := range values {
+				values[i] = staleNaN
+			}
+		} else if zeroMs, ok := resets.zeroAt(metricName, attributes, startNS, tsNS); ok {
+			// Only _sum and _count are cumulative; quantiles are not.
+			for _, suffix := range []string{"_sum", "_count"} {
+				if wanted(metricName + suffix) {
+					labels := append([]prompb.Label{{Name: "__name__", Value: metricName + suffix}}, baseLabels...)
+					app.addSample(labels, prompb.Sample{Timestamp: zeroMs, Value: 0})
+				}
+			}
+		}
+
+		if wanted(metricName) {
+			for i := 0; i < len(quantiles) && i < len(values); i++ {
+				labels := append([]prompb.Label{
+					{Name: "__name__", Value: metricName},
+					{Name: "quantile", Value: strconv.FormatFloat(quantiles[i], 'g', -1, 64)},
+				}, baseLabels...)
+				app.addSample(labels, prompb.Sample{Timestamp: tsNS / 1e6, Value: values[i]})
+			}
+		}
+
+		if wanted(metricName + "_sum") {
+			labels := append([]prompb.Label{{Name: "__name__", Value: metricName + "_sum"}}, baseLabels...)
+			app.addSample(labels, prompb.Sample{Timestamp: tsNS / 1e6, Value: sum})
+		}
+
+		if wanted(metricName + "_count") {
+			labels := append([]prompb.Label{{Name: "__name__", Value: metricName + "_count"}}, baseLabels...)
+			app.addSample(labels, prompb.Sample{Timestamp: tsNS / 1e6, Value: countValue})
+		}
 	}
 
-	return out, nil
+	return rows.Err()
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/value"
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+func TestProcessQuerySummary(t *testing.T) {
+	applyTestConfig(t, nil)
+	f := newFakeClickHouse(func(query string, args []interface{}) (fakeResult, error) {
+		return fakeResult{
+			columns: []string{"MetricName", "Labels", "ts_ns", "Sum", "Count", "Quantile", "Value", "Flags", "start_ns"},
+			rows: [][]interface{}{
+				{"rpc", map[string]string{"host": "a"}, int64(10e9), 12.5, uint64(4), []float64{0.5, 0.99}, []float64{2, 9}, uint32(0), int64(0)},
+				{"rpc", map[string]string{"host": "a"}, int64(20e9), 0.0, uint64(0), []float64{0.5, 0.99}, []float64{0, 0}, flagNoRecordedValue, int64(0)},
+			},
+		}, nil
+	})
+	ctx := f.context(limitsConfig{})
+	name := func(typ prompb.LabelMatcher_Type, v string) *prompb.LabelMatcher {
+		return &prompb.LabelMatcher{Type: typ, Name: "__name__", Value: v}
+	}
+	const (
+		q50   = `{__name__="rpc", host="a", quantile="0.5"}`
+		q99   = `{__name__="rpc", host="a", quantile="0.99"}`
+		sum   = `{__name__="rpc_sum", host="a"}`
+		count = `{__name__="rpc_count", host="a"}`
+	)
+
+	for _, tc := range []struct {
+		name     string
+		matchers []*prompb.LabelMatcher
+		want     []string
+	}{
+		{"every sub-series", []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "host", Value: "a"}}, []string{q50, q99, count, sum}},
+		{"quantiles", []*prompb.LabelMatcher{name(prompb.LabelMatcher_EQ, "rpc")}, []string{q50, q99}},
+		{"one quantile", []*prompb.LabelMatcher{name(prompb.LabelMatcher_EQ, "rpc"), {Type: prompb.LabelMatcher_EQ, Name: "quantile", Value: "0.99"}}, []string{q99}},
+		{"_sum", []*prompb.LabelMatcher{name(prompb.LabelMatcher_EQ, "rpc_sum")}, []string{sum}},
+		{"_sum and _count", []*prompb.LabelMatcher{name(prompb.LabelMatcher_RE, "rpc_(sum|count)")}, []string{count, sum}},
+		{"everything but the quantiles", []*prompb.LabelMatcher{name(prompb.LabelMatcher_NEQ, "rpc")}, []string{count, sum}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := &prompb.Query{StartTimestampMs: 0, EndTimestampMs: 30000, Matchers: tc.matchers}
+			set, err := newSeriesSet(q.Matchers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := processQuerySummary(ctx, q, set); err != nil {
+				t.Fatal(err)
+			}
+			got := map[string][]prompb.Sample{}
+			var names []string
+			for _, ts := range set.series() {
+				ls := toLabels(ts.Labels).String()
+				got[ls] = ts.Samples
+				names = append(names, ls)
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, tc.want) {
+				t.Fatalf("got series %v, want %v", names, tc.want)
+			}
+
+			// The second row is a stale marker for every sub-series.
+			first := map[string]float64{q50: 2, q99: 9, sum: 12.5, count: 4}
+			for ls, samples := range got {
+				if len(samples) != 2 || samples[0].Timestamp != 10000 || samples[0].Value != first[ls] ||
+					samples[1].Timestamp != 20000 || !value.IsStaleNaN(samples[1].Value) {
+					t.Errorf("%s: got samples %v, want %v then a stale marker", ls, samples, first[ls])
+				}
+			}
+
+			// quantile is made up by the proxy, so it is not looked up in
+			// the attributes.
+			query := f.queryLog()[len(f.queryLog())-1]
+			if strings.Contains(query, "'quantile'") {
+				t.Errorf("the quantile label was looked up in ClickHouse: %s", query)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+func escapeString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return strings.ReplaceAll(s, "'", `\'`)
+}
+
+// matcherSQL translates a single matcher into a predicate over expr.
+func matcherSQL(m *prompb.LabelMatcher, expr string) (string, []interface{}, error) {
+	switch m.Type {
+	case prompb.LabelMatcher_EQ:
+		// label="" matches series where the label is absent or empty,
+		// both of which read back as ''.
+		return expr + " = ?", []interface{}{m.Value}, nil
+	case prompb.LabelMatcher_NEQ:
+		return expr + " != ?", []interface{}{m.Value}, nil
+	case prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE:
+		// Validate with the same RE2 dialect Prometheus uses before
+		// handing the pattern to ClickHouse.
+		if _, err := labels.NewMatcher(labels.MatchRegexp, m.Name, m.Value); err != nil {
+			return "", nil, fmt.Errorf("invalid regex matcher %s=~%q: %w", m.Name, m.Value, err)
+		}
+		pred := ""
+		var args []interface{}
+		switch m.Value {
+		case ".*":
+			pred = "1"
+		case ".+":
+			pred = expr + " != ''"
+		default:
+			// Prometheus regexes are fully anchored.
+			pred = fmt.Sprintf("match(%s, ?)", expr)
+			args = []interface{}{"^(?:" + m.Value + ")$"}
+		}
+		if m.Type == prompb.LabelMatcher_NRE {
+			pred = "NOT (" + pred + ")"
+		}
+		return pred, args, nil
+	}
+	return "", nil, fmt.Errorf("unsupported matcher type %v", m.Type)
+}
+
+// matchersWhere translates matchers into ClickHouse predicates. nameExprs are
+// the expressions __name__ can take for a row; a __name__ matcher holds if it
+// holds for any of them. Matchers on synthetic labels, which are produced by
+// the proxy rather than stored with the row, are left to the series appender.
+func matchersWhere(ms []*prompb.LabelMatcher, nameExprs []string, synthetic ...string) ([]string, []interface{}, error) {
+	var where []string
+	var args []interface{}
+
+outer:
+	for _, m := range ms {
+		for _, s := range synthetic {
+			if m.Name == s {
+				continue outer
+			}
+		}
+
+		if m.Name != "__name__" {
+			pred, a, err := matcherSQL(m, labelExpr(m.Name))
+			if err != nil {
+				return nil, nil, err
+			}
+			where = append(where, pred)
+			args = append(args, a...)
+			continue
+		}
+
+		preds := make([]string, 0, len(nameExprs))
+		for _, expr := range nameExprs {
+			pred, a, err := matcherSQL(m, expr)
+			if err != nil {
+				return nil, nil, err
+			}
+			preds = append(preds, pred)
+			args = append(args, a...)
+		}
+		if len(preds) == 1 {
+			where = append(where, preds[0])
+		} else {
+			where = append(where, "("+strings.Join(preds, " OR ")+")")
+		}
+	}
+	return where, args, nil
+}
+
+func toLabelMatchers(ms []*prompb.LabelMatcher) ([]*labels.Matcher, error) {
+	out := make([]*labels.Matcher, 0, len(ms))
+	for _, m := range ms {
+		var t labels.MatchType
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			t = labels.MatchEqual
+		case prompb.LabelMatcher_NEQ:
+			t = labels.MatchNotEqual
+		case prompb.LabelMatcher_RE:
+			t = labels.MatchRegexp
+		case prompb.LabelMatcher_NRE:
+			t = labels.MatchNotRegexp
+		default:
+			return nil, fmt.Errorf("unsupported matcher type %v", m.Type)
+		}
+		lm, err := labels.NewMatcher(t, m.Name, m.Value)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, lm)
+	}
+	return out, nil
+}
+
+// seriesMatches reports whether the final label set of a series satisfies
+// lms. It catches matchers on synthetic labels (such as le) and on the
+// suffixed names of histogram sub-series, which SQL cannot check exactly.
+func seriesMatches(ls []prompb.Label, lms []*labels.Matcher) bool {
+	for _, lm := range lms {
+		v := ""
+		for _, l := range ls {
+			if l.Name == lm.Name {
+				v = l.Value
+				break
+			}
+		}
+		if !lm.Matches(v) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+func TestMatcherSQL(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		matcher  *prompb.LabelMatcher
+		wantPred string
+		wantArgs []interface{}
+		wantErr  bool
+	}{
+		{"equal", &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "api"}, "x = ?", []interface{}{"api"}, false},
+		{"equal empty", &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "job", Value: ""}, "x = ?", []interface{}{""}, false},
+		{"not equal", &prompb.LabelMatcher{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: "api"}, "x != ?", []interface{}{"api"}, false},
+		{"regex anchored", &prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "job", Value: "api|web"}, "match(x, ?)", []interface{}{"^(?:api|web)$"}, false},
+		{"not regex", &prompb.LabelMatcher{Type: prompb.LabelMatcher_NRE, Name: "job", Value: "a.*"}, "NOT (match(x, ?))", []interface{}{"^(?:a.*)$"}, false},
+		{"regex anything", &prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "job", Value: ".*"}, "1", nil, false},
+		{"regex nothing", &prompb.LabelMatcher{Type: prompb.LabelMatcher_NRE, Name: "job", Value: ".*"}, "NOT (1)", nil, false},
+		{"regex non-empty", &prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "job", Value: ".+"}, "x != ''", nil, false},
+		{"not regex non-empty", &prompb.LabelMatcher{Type: prompb.LabelMatcher_NRE, Name: "job", Value: ".+"}, "NOT (x != '')", nil, false},
+		{"quote stays an argument", &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "a' OR 1 --"}, "x = ?", []interface{}{"a' OR 1 --"}, false},
+		{"invalid regex", &prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "job", Value: "(a"}, "", nil, true},
+		{"unknown type", &prompb.LabelMatcher{Type: 42, Name: "job", Value: "a"}, "", nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pred, args, err := matcherSQL(tc.matcher, "x")
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("got %q, want an error", pred)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pred != tc.wantPred || !reflect.DeepEqual(args, tc.wantArgs) {
+				t.Errorf("got %q %v, want %q %v", pred, args, tc.wantPred, tc.wantArgs)
+			}
+		})
+	}
+}
+
+func TestMatchersWhere(t *testing.T) {
+	eq := func(name, value string) *prompb.LabelMatcher {
+		return &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: name, Value: value}
+	}
+	for _, tc := range []struct {
+		name      string
+		matchers  []*prompb.LabelMatcher
+		nameExprs []string
+		synthetic []string
+		wantWhere []string
+		wantArgs  []interface{}
+	}{
+		{
+			name:      "name and label",
+			matchers:  []*prompb.LabelMatcher{eq("__name__", "m"), eq("host", "a")},
+			nameExprs: []string{"MetricName"},
+			wantWhere: []string{"MetricName = ?", "Attributes['host'] = ?"},
+			wantArgs:  []interface{}{"m", "a"},
+		},
+		{
+			name:      "name of a sub-series",
+			matchers:  []*prompb.LabelMatcher{eq("__name__", "h_bucket")},
+			nameExprs: []string{"concat(MetricName, '_bucket')", "concat(MetricName, '_sum')"},
+			wantWhere: []string{"(concat(MetricName, '_bucket') = ? OR concat(MetricName, '_sum') = ?)"},
+			wantArgs:  []interface{}{"h_bucket", "h_bucket"},
+		},
+		{
+			name:      "synthetic label left to the appender",
+			matchers:  []*prompb.LabelMatcher{eq("__name__", "h_bucket"), eq("le", "0.5")},
+			nameExprs: []string{"MetricName"},
+			synthetic: []string{"le"},
+			wantWhere: []string{"MetricName = ?"},
+			wantArgs:  []interface{}{"h_bucket"},
+		},
+		{
+			name:      "quotes in label names are escaped",
+			matchers:  []*prompb.LabelMatcher{eq("a'b", "v")},
+			wantWhere: []string{`Attributes['a\'b'] = ?`},
+			wantArgs:  []interface{}{"v"},
+		},
+		{
+			name: "no matchers",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			where, args, err := matchersWhere(tc.matchers, tc.nameExprs, tc.synthetic...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(where, tc.wantWhere) || !reflect.DeepEqual(args, tc.wantArgs) {
+				t.Errorf("got %q %v, want %q %v", where, args, tc.wantWhere, tc.wantArgs)
+			}
+		})
+	}
+
+	if _, _, err := matchersWhere([]*prompb.LabelMatcher{{Type: prompb.LabelMatcher_RE, Name: "host", Value: "("}}, nil); err == nil {
+		t.Error("an invalid regex must fail")
+	}
+}
+
+func TestSeriesMatches(t *testing.T) {
+	ls := []prompb.Label{{Name: "__name__", Value: "h_bucket"}, {Name: "le", Value: "0.5"}}
+	for _, tc := range []struct {
+		matchers []*prompb.LabelMatcher
+		want     bool
+	}{
+		{[]*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "le", Value: "0.5"}}, true},
+		{[]*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "le", Value: "1"}}, false},
+		{[]*prompb.LabelMatcher{{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "h_(sum|count)"}}, false},
+		// A missing label reads as empty.
+		{[]*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "host", Value: ""}}, true},
+		{[]*prompb.LabelMatcher{{Type: prompb.LabelMatcher_NEQ, Name: "host", Value: ""}}, false},
+	} {
+		lms, err := toLabelMatchers(tc.matchers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := seriesMatches(ls, lms); got != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.matchers, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+// Name translation follows the OTel Prometheus compatibility spec, as
+// implemented by the collector's Prometheus exporters: metric names are
+// split on anything that is not a letter or digit, get unit and _total
+// suffixes, and are joined with underscores; label names have invalid
+// characters replaced with underscores.
+
+var unitMap = map[string]string{
+	// Time
+	"d":   "days",
+	"h":   "hours",
+	"min": "minutes",
+	"s":   "seconds",
+	"ms":  "milliseconds",
+	"us":  "microseconds",
+	"ns":  "nanoseconds",
+
+	// Bytes
+	"By":   "bytes",
+	"KiBy": "kibibytes",
+	"MiBy": "mebibytes",
+	"GiBy": "gibibytes",
+	"TiBy": "tibibytes",
+	"KBy":  "kilobytes",
+	"MBy":  "megabytes",
+	"GBy":  "gigabytes",
+	"TBy":  "terabytes",
+
+	// SI
+	"m":   "meters",
+	"V":   "volts",
+	"A":   "amperes",
+	"J":   "joules",
+	"W":   "watts",
+	"g":   "grams",
+	"Cel": "celsius",
+	"Hz":  "hertz",
+	"1":   "",
+	"%":   "percent",
+}
+
+var perUnitMap = map[string]string{
+	"s":  "second",
+	"m":  "minute",
+	"h":  "hour",
+	"d":  "day",
+	"w":  "week",
+	"mo": "month",
+	"y":  "year",
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// normalizeMetricName returns the Prometheus name of an OTel metric.
+func normalizeMetricName(name, unit string, t metricType, monotonic bool) string {
+	tokens := nameTokens(name)
+
+	mainUnit, perUnit, _ := strings.Cut(unit, "/")
+	if u := strings.TrimSpace(mainUnit); u != "" && !strings.ContainsAny(u, "{}") {
+		if v, ok := unitMap[u]; ok {
+			u = v
+		}
+		if u = strings.Join(nameTokens(u), "_"); u != "" && !containsToken(tokens, u) {
+			tokens = append(tokens, u)
+		}
+	}
+	if u := strings.TrimSpace(perUnit); u != "" && !strings.ContainsAny(u, "{}") {
+		if v, ok := perUnitMap[u]; ok {
+			u = v
+		}
+		if u = strings.Join(nameTokens(u), "_"); u != "" && !containsToken(tokens, u) {
+			tokens = append(tokens, "per", u)
+		}
+	}
+
+	if t == metricTypeSum && monotonic {
+		tokens = removeToken(tokens, "total")
+		tokens = append(tokens, "total")
+	}
+	if t == metricTypeGauge && unit == "1" && !containsToken(tokens, "ratio") {
+		tokens = append(tokens, "ratio")
+	}
+
+	out := strings.Join(tokens, "_")
+	if out != "" && unicode.IsDigit(rune(out[0])) {
+		out = "_" + out
+	}
+	return out
+}
+
+func nameTokens(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func containsToken(tokens []string, t string) bool {
+	for _, tok := range tokens {
+		if tok == t {
+			return true
+		}
+	}
+	return false
+}
+
+func removeToken(tokens []string, t string) []string {
+	out := tokens[:0]
+	for _, tok := range tokens {
+		if tok != t {
+			out = append(out, tok)
+		}
+	}
+	return out
+}
+
+// sanitizeLabelName returns the Prometheus name of an attribute key.
+func sanitizeLabelName(name string) string {
+	if !translateNames || name == "" {
+		return name
+	}
+	name = invalidLabelChars.ReplaceAllString(name, "_")
+	switch {
+	case unicode.IsDigit(rune(name[0])):
+		name = "key_" + name
+	case strings.HasPrefix(name, "_") && !strings.HasPrefix(name, "__"):
+		name = "key" + name
+	}
+	return name
+}
+
+// sanitizeLabelSQL is sanitizeLabelName as a ClickHouse expression over the
+// key expression k.
+func sanitizeLabelSQL(k string) string {
+	s := fmt.Sprintf("replaceRegexpAll(%s, '[^a-zA-Z0-9_]', '_')", k)
+	return fmt.Sprintf("multiIf(match(%[1]s, '^[0-9]'), concat('key_', %[1]s), startsWith(%[1]s, '_') AND NOT startsWith(%[1]s, '__'), concat('key', %[1]s), %[1]s)", s)
+}
+
+// mapValueExpr returns the ClickHouse expression for the value label name
+// takes in mapExpr once keys are sanitized. Keys colliding on the same name
+// are joined with ';' in key order, like normalizeLabels does. A missing key
+// reads as an empty string, which is the Prometheus semantics for an absent
+// label.
+func mapValueExpr(mapExpr, name string) string {
+	// Sanitizing only ever introduces underscores, so a name without any
+	// can only come from the identical key.
+	if !translateNames || !strings.Contains(name, "_") {
+		return fmt.Sprintf("%s['%s']", mapExpr, escapeString(name))
+	}
+	return fmt.Sprintf(
+		"arrayStringConcat(arrayMap(x -> x.2, arraySort(x -> x.1, arrayFilter(x -> %s = '%s', arrayZip(mapKeys(%s), mapValues(%[3]s))))), ';')",
+		sanitizeLabelSQL("x.1"), escapeString(name), mapExpr)
+}
+
+// normalizeLabels sanitizes label names, merging the values of names that
+// collide. __name__ is left alone.
+func normalizeLabels(ls []prompb.Label) []prompb.Label {
+	if !translateNames {
+		return ls
+	}
+	sort.Slice(ls, func(i, j int) bool { return ls[i].Name < ls[j].Name })
+
+	out := ls[:0:0]
+	index := map[string]int{}
+	for _, l := range ls {
+		if l.Name != "__name__" {
+			l.Name = sanitizeLabelName(l.Name)
+		}
+		if i, ok := index[l.Name]; ok {
+			out[i].Value += ";" + l.Value
+			continue
+		}
+		index[l.Name] = len(out)
+		out = append(out, l)
+	}
+	return out
+}
+
+// exposedMetricName returns the name the series raw is exposed under.
+func exposedMetricName(exposed map[string]string, raw string) string {
+	if !translateNames {
+		return raw
+	}
+	if name, ok := exposed[raw]; ok {
+		return name
+	}
+	// Series the catalog does not know about only get their characters
+	// fixed up.
+	return normalizeMetricName(raw, "", metricTypeGauge, false)
+}
+
+// translateQuery rewrites the __name__ matchers of q, which are written
+// against exposed names, into a matcher on the raw names of every series
+// they select. It also returns the raw to exposed name mapping to hand to
+// newTranslatingAppender.
+func translateQuery(ctx context.Context, q *prompb.Query) (*prompb.Query, map[string]string, error) {
+	if !translateNames {
+		return q, nil, nil
+	}
+	snap, err := tenantFrom(ctx).catalog.lookup(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var nameMatchers, rest []*prompb.LabelMatcher
+	for _, m := range q.Matchers {
+		if m.Name == "__name__" {
+			nameMatchers = append(nameMatchers, m)
+		} else {
+			rest = append(rest, m)
+		}
+	}
+	if len(nameMatchers) == 0 {
+		return q, snap.exposed, nil
+	}
+	lms, err := toLabelMatchers(nameMatchers)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var raw []string
+	for r, name := range snap.exposed {
+		if seriesMatches([]prompb.Label{{Name: "__name__", Value: name}}, lms) {
+			raw = append(raw, regexp.QuoteMeta(r))
+		}
+	}
+	sort.Strings(raw)
+
+	if len(raw) == 0 {
+		// Nothing the catalog knows matches. Metrics last written before
+		// metricCatalogRange are looked up under their stored names.
+		return q, snap.exposed, nil
+	}
+	nameMatcher := &prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: strings.Join(raw, "|")}
+
+	qt := *q
+	qt.Matchers = append(rest, nameMatcher)
+	return &qt, snap.exposed, nil
+}
+
+// translatingAppender renames the series decoded from ClickHouse to their
+// exposed names before handing them on.
+type translatingAppender struct {
+	app       seriesAppender
+	exemplars exemplarAppender
+	exposed   map[string]string
+}
+
+// newTranslatingAppender wraps app, or returns it unchanged when names are
+// not translated.
+func newTranslatingAppender(app seriesAppender, exposed map[string]string) seriesAppender {
+	if !translateNames {
+		return app
+	}
+	ea, _ := app.(exemplarAppender)
+	return &translatingAppender{app: app, exemplars: ea, exposed: exposed}
+}
+
+func (a *translatingAppender) labels(ls []prompb.Label) []prompb.Label {
+	return translateLabels(a.exposed, ls)
+}
+
+// translateLabels renames a label set decoded from ClickHouse to its exposed
+// names.
+func translateLabels(exposed map[string]string, ls []prompb.Label) []prompb.Label {
+	if !translateNames {
+		return ls
+	}
+	ls = normalizeLabels(ls)
+	for i := range ls {
+		if ls[i].Name == "__name__" {
+			ls[i].Value = exposedMetricName(exposed, ls[i].Value)
+		}
+	}
+	return ls
+}
+
+func (a *translatingAppender) addSample(ls []prompb.Label, sample prompb.Sample) {
+	a.app.addSample(a.labels(ls), sample)
+}
+
+func (a *translatingAppender) addHistogram(ls []prompb.Label, h prompb.Histogram) {
+	a.app.addHistogram(a.labels(ls), h)
+}
+
+func (a *translatingAppender) addExemplar(ls []prompb.Label, e prompb.Exemplar) {
+	if a.exemplars != nil {
+		e.Labels = normalizeLabels(e.Labels)
+		a.exemplars.addExemplar(a.labels(ls), e)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+func TestNormalizeMetricName(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		unit      string
+		t         metricType
+		monotonic bool
+		want      string
+	}{
+		{"http.server.duration", "s", metricTypeHistogram, false, "http_server_duration_seconds"},
+		{"http.server.request.size", "By", metricTypeHistogram, false, "http_server_request_size_bytes"},
+		{"system.network.io", "By", metricTypeSum, true, "system_network_io_bytes_total"},
+		{"requests.total", "", metricTypeSum, true, "requests_total"},
+		{"requests_total", "1", metricTypeSum, false, "requests_total"},
+		{"queue.size", "", metricTypeSum, false, "queue_size"},
+		{"cpu.utilization", "1", metricTypeGauge, false, "cpu_utilization_ratio"},
+		{"error.ratio", "1", metricTypeGauge, false, "error_ratio"},
+		{"throughput", "By/s", metricTypeGauge, false, "throughput_bytes_per_second"},
+		{"latency.seconds", "s", metricTypeGauge, false, "latency_seconds"},
+		{"connections", "{connection}", metricTypeGauge, false, "connections"},
+		{"temperature", "Cel", metricTypeGauge, false, "temperature_celsius"},
+		{"memory", "custom.unit", metricTypeGauge, false, "memory_custom_unit"},
+		{"2xx.responses", "", metricTypeSum, true, "_2xx_responses_total"},
+		{"already_fine", "", metricTypeGauge, false, "already_fine"},
+	} {
+		if got := normalizeMetricName(tc.name, tc.unit, tc.t, tc.monotonic); got != tc.want {
+			t.Errorf("normalizeMetricName(%q, %q, %s, %v) = %q, want %q", tc.name, tc.unit, tc.t, tc.monotonic, got, tc.want)
+		}
+	}
+}
+
+func TestSanitizeLabelName(t *testing.T) {
+	translateNames = true
+	t.Cleanup(func() { translateNames = false })
+
+	for _, tc := range []struct {
+		name, want string
+	}{
+		{"http.method", "http_method"},
+		{"k8s.pod-name", "k8s_pod_name"},
+		{"1st", "key_1st"},
+		{"_private", "key_private"},
+		{"__name__", "__name__"},
+		{"ok_name", "ok_name"},
+		{"", ""},
+	} {
+		if got := sanitizeLabelName(tc.name); got != tc.want {
+			t.Errorf("sanitizeLabelName(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	translateNames = false
+	if got := sanitizeLabelName("http.method"); got != "http.method" {
+		t.Errorf("without translation got %q", got)
+	}
+}
+
+func TestNormalizeLabelsMergesCollisions(t *testing.T) {
+	translateNames = true
+	t.Cleanup(func() { translateNames = false })
+
+	got := normalizeLabels([]prompb.Label{
+		{Name: "host_name", Value: "b"},
+		{Name: "__name__", Value: "m"},
+		{Name: "host.name", Value: "a"},
+	})
+	want := []prompb.Label{{Name: "__name__", Value: "m"}, {Name: "host_name", Value: "a;b"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+// downsampleMode says how the points of a series inside one step bucket can
+// be thinned out without changing what PromQL computes from them.
+type downsampleMode int
+
+const (
+	downsampleNone downsampleMode = iota
+	// Keep the newest point. An instant selector evaluated at the end of a
+	// bucket picks the newest point at or before that time, which is always
+	// the newest point of some bucket.
+	downsampleLast
+	// Keep the largest or smallest point. Windows spanning whole buckets see
+	// the same extreme.
+	downsampleMax
+	downsampleMin
+)
+
+// Aggregations over an instant selector. avg_over_time is left out on
+// purpose: averaging per-bucket averages is wrong once buckets hold
+// different numbers of points. So are rate and increase, which extrapolate
+// from the first and last point of every window and the spacing of the
+// points in between.
+var (
+	instantPushdownFuncs = map[string]bool{"sum": true, "min": true, "max": true, "count": true, "avg": true}
+	rangePushdownFuncs   = map[string]downsampleMode{
+		"max_over_time": downsampleMax,
+		"min_over_time": downsampleMin,
+	}
+)
+
+// pushdownMode picks how q can be downsampled in ClickHouse for metrics of
+// type t, or downsampleNone when every raw point has to be returned.
+//
+// Buckets end at the times PromQL evaluates the selector at. The hints give
+// the first of them as StartMs plus the selector's window, less the 1ms
+// PromQL leaves out of the left-open window, and later ones follow every
+// StepMs. Subqueries evaluate at multiples of their step instead, which the
+// hints do not tell apart, so q is only downsampled when both agree.
+func pushdownMode(q *prompb.Query, t metricType) downsampleMode {
+	h := q.Hints
+	if !pushdownEnabled || h == nil || h.StepMs <= 0 {
+		return downsampleNone
+	}
+	// Instant selectors look back queryLookbackDelta, which remote-read
+	// clients must use too.
+	window := h.RangeMs
+	if window == 0 {
+		window = queryLookbackDelta.Milliseconds()
+	}
+	if (h.StartMs+window-1)%h.StepMs != 0 {
+		return downsampleNone
+	}
+
+	if h.RangeMs == 0 {
+		if instantPushdownFuncs[h.Func] {
+			return downsampleLast
+		}
+		return downsampleNone
+	}
+	// Range windows have to span whole buckets.
+	if h.RangeMs%h.StepMs != 0 {
+		return downsampleNone
+	}
+	if mode, ok := rangePushdownFuncs[h.Func]; ok {
+		return mode
+	}
+	return downsampleNone
+}
+
+// pushdownBucketEnd returns the end of the last step bucket of q, the first
+// evaluation time at or after its end. Buckets are numbered back from it, so
+// the shards and cached slices of one query share them.
+func pushdownBucketEnd(q *prompb.Query) int64 {
+	step := q.Hints.StepMs
+	end := max(q.Hints.EndMs, q.EndTimestampMs)
+	return (end + step - 1) / step * step
+}
+
+// downsampledQuery returns a query over the table of t returning the same
+// columns as the raw sum and gauge queries (MetricName, Labels, ts_ns,
+// SumValue, flags, plus AggregationTemporality, start_ns and IsMonotonic for
+// sums), with points thinned out into step buckets ending at the evaluation
+// times of q. Buckets hold (end - step, end], as PromQL windows leave out
+// their start. Delta points are never merged, since each of them is needed
+// to rebuild the running total, and neither are the points of different runs
+// of a cumulative sum, so counter restarts survive.
+func downsampledQuery(ctx context.Context, q *prompb.Query, mode downsampleMode, t metricType, whereClause, limit string) string {
+	// Points are read back at millisecond precision, so that is what
+	// places them in buckets.
+	bucket := fmt.Sprintf("intDiv(%d - toUnixTimestamp64Milli(TimeUnix), %d)", pushdownBucketEnd(q), q.Hints.StepMs)
+
+	// Range functions drop stale markers, so the modes feeding them leave
+	// those points out rather than let one win a bucket.
+	recorded := fmt.Sprintf("bitAnd(Flags, %d) = 0", flagNoRecordedValue)
+
+	var ts, value, flags string
+	switch mode {
+	case downsampleLast:
+		ts, value, flags = "max(toUnixTimestamp64Nano(TimeUnix))", "argMax(Value, TimeUnix)", "argMax(Flags, TimeUnix)"
+	case downsampleMax:
+		ts, value, flags = "argMax(toUnixTimestamp64Nano(TimeUnix), Value)", "max(Value)", "toUInt32(0)"
+		whereClause += " AND " + recorded
+	case downsampleMin:
+		ts, value, flags = "argMin(toUnixTimestamp64Nano(TimeUnix), Value)", "min(Value)", "toUInt32(0)"
+		whereClause += " AND " + recorded
+	}
+	extra, group := "", bucket
+	if t == metricTypeSum {
+		extra = ",\n  AggregationTemporality,\n  toUnixTimestamp64Nano(StartTimeUnix) AS start_ns,\n  IsMonotonic"
+		group = "AggregationTemporality, IsMonotonic, StartTimeUnix, if(AggregationTemporality = 1, TimeUnix, toDateTime64(0, 9)), " + bucket
+	}
+	return fmt.Sprintf(`
+SELECT
+  MetricName,
+  %s AS Labels,
+  %s AS ts_ns,
+  %s AS SumValue,
+  %s AS flags%s
+FROM %s
+WHERE %s
+GROUP BY MetricName, Labels, %s
+ORDER BY ts_ns
+%s
+`, labelsExpr(), ts, value, flags, extra, tableRef(ctx, t.table()), whereClause, group, limit)
+}
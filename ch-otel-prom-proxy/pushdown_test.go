@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	prompb "github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/util/annotations"
+)
+
+// pointsQueryable serves fixed series to the PromQL engine, downsampled the
+// way downsampledQuery does in ClickHouse when pushdown is on.
+type pointsQueryable struct {
+	series   []*prompb.TimeSeries
+	pushdown bool
+	pushed   *int
+}
+
+func (p pointsQueryable) Querier(mint, maxt int64) (storage.Querier, error) {
+	return p, nil
+}
+
+func (p pointsQueryable) Select(ctx context.Context, sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	q := &prompb.Query{
+		StartTimestampMs: hints.Start,
+		EndTimestampMs:   hints.End,
+		Hints: &prompb.ReadHints{
+			StepMs:   hints.Step,
+			Func:     hints.Func,
+			StartMs:  hints.Start,
+			EndMs:    hints.End,
+			Grouping: hints.Grouping,
+			By:       hints.By,
+			RangeMs:  hints.Range,
+		},
+	}
+	mode := downsampleNone
+	if p.pushdown {
+		mode = pushdownMode(q, metricTypeGauge)
+	}
+	if mode != downsampleNone {
+		*p.pushed++
+	}
+
+	var out []*prompb.TimeSeries
+	for _, s := range p.series {
+		var in []prompb.Sample
+		for _, smp := range s.Samples {
+			if smp.Timestamp >= q.StartTimestampMs && smp.Timestamp <= q.EndTimestampMs {
+				in = append(in, smp)
+			}
+		}
+		if mode != downsampleNone {
+			in = downsampleSamples(q, mode, in)
+		}
+		out = append(out, &prompb.TimeSeries{Labels: s.Labels, Samples: in})
+	}
+	return newListSeriesSet(out)
+}
+
+func (p pointsQueryable) LabelValues(ctx context.Context, name string, hints *storage.LabelHints, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	return nil, nil, nil
+}
+
+func (p pointsQueryable) LabelNames(ctx context.Context, hints *storage.LabelHints, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	return nil, nil, nil
+}
+
+func (p pointsQueryable) Close() error { return nil }
+
+// downsampleSamples keeps the points of one series that downsampledQuery
+// keeps, given samples in time order.
+func downsampleSamples(q *prompb.Query, mode downsampleMode, samples []prompb.Sample) []prompb.Sample {
+	end := pushdownBucketEnd(q)
+	var out []prompb.Sample
+	bucket := int64(-1)
+	for _, s := range samples {
+		b := (end - s.Timestamp) / q.Hints.StepMs
+		if len(out) == 0 || b != bucket {
+			out = append(out, s)
+			bucket = b
+			continue
+		}
+		last := &out[len(out)-1]
+		switch mode {
+		case downsampleLast:
+			*last = s
+		case downsampleMax:
+			if s.Value > last.Value {
+				*last = s
+			}
+		case downsampleMin:
+			if s.Value < last.Value {
+				*last = s
+			}
+		}
+	}
+	return out
+}
+
+func TestPushdownMatchesRawResults(t *testing.T) {
+	pushdownEnabled, queryLookbackDelta = true, 5*time.Minute
+	t.Cleanup(func() { pushdownEnabled = false })
+
+	// Points every 7-23s, some exactly on minute boundaries, with gaps
+	// longer than the lookback delta.
+	rnd := rand.New(rand.NewSource(1))
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+	var series []*prompb.TimeSeries
+	for i := 0; i < 3; i++ {
+		s := &prompb.TimeSeries{Labels: []prompb.Label{
+			{Name: "__name__", Value: "m"},
+			{Name: "host", Value: fmt.Sprint("h", i)},
+		}}
+		for ts := base; ts < base+int64(4*time.Hour/time.Millisecond); {
+			s.Samples = append(s.Samples, prompb.Sample{Timestamp: ts, Value: rnd.Float64() * 100})
+			switch r := rnd.Intn(40); {
+			case r == 0:
+				ts += int64(7 * time.Minute / time.Millisecond)
+			case r < 8:
+				ts = (ts/60000 + 1) * 60000
+			default:
+				ts += int64(7000 + rnd.Intn(16000))
+			}
+		}
+		series = append(series, s)
+	}
+
+	engine := promql.NewEngine(promql.EngineOpts{
+		MaxSamples:           1e7,
+		Timeout:              time.Minute,
+		LookbackDelta:        queryLookbackDelta,
+		EnableAtModifier:     true,
+		EnableNegativeOffset: true,
+	})
+
+	exprs := []string{
+		"sum(m)",
+		"max by (host) (m)",
+		"count(m offset 90s)",
+		"max_over_time(m[10m])",
+		"min_over_time(m[4m])",
+		"max_over_time(m[5m] offset 3m)",
+		"sum(max_over_time(m[10m:1m]))",
+		"max_over_time(m[7m])",
+	}
+	starts := []time.Duration{time.Hour, time.Hour + 17*time.Second, time.Hour + time.Minute}
+	steps := []time.Duration{time.Minute, 2 * time.Minute, 150 * time.Second}
+	ends := []time.Duration{2 * time.Hour, 2*time.Hour + 41*time.Second}
+
+	pushed := 0
+	for _, expr := range exprs {
+		for _, start := range starts {
+			for _, step := range steps {
+				for _, end := range ends {
+					name := fmt.Sprintf("%s/start=%s/step=%s/end=%s", expr, start, step, end)
+					run := func(q storage.Queryable) promql.Matrix {
+						t.Helper()
+						qry, err := engine.NewRangeQuery(context.Background(), q, nil, expr,
+							time.UnixMilli(base).Add(start), time.UnixMilli(base).Add(end), step)
+						if err != nil {
+							t.Fatalf("%s: %v", name, err)
+						}
+						res := qry.Exec(context.Background())
+						if res.Err != nil {
+							t.Fatalf("%s: %v", name, res.Err)
+						}
+						m, err := res.Matrix()
+						if err != nil {
+							t.Fatalf("%s: %v", name, err)
+						}
+						return m
+					}
+
+					raw := run(pointsQueryable{series: series})
+					down := run(pointsQueryable{series: series, pushdown: true, pushed: &pushed})
+					if raw.String() != down.String() {
+						t.Errorf("%s: pushdown results differ\nraw:\n%s\npushdown:\n%s", name, raw, down)
+					}
+				}
+			}
+		}
+	}
+	if pushed == 0 {
+		t.Fatal("no query was downsampled")
+	}
+	t.Logf("%d selects downsampled", pushed)
+}
+
+func TestPushdownMode(t *testing.T) {
+	pushdownEnabled, queryLookbackDelta = true, 5*time.Minute
+	t.Cleanup(func() { pushdownEnabled = false })
+
+	const minute = int64(time.Minute / time.Millisecond)
+	// hints returns the hints PromQL gives a selector with window w whose
+	// first evaluation is at first.
+	hints := func(first, w, step, rangeMs int64, fn string) *prompb.ReadHints {
+		return &prompb.ReadHints{StartMs: first - w + 1, EndMs: first + 60*step, StepMs: step, RangeMs: rangeMs, Func: fn}
+	}
+
+	for _, tc := range []struct {
+		name  string
+		hints *prompb.ReadHints
+		want  downsampleMode
+	}{
+		{"instant sum", hints(60*minute, 5*minute, minute, 0, "sum"), downsampleLast},
+		{"instant sum off step", hints(60*minute+17000, 5*minute, minute, 0, "sum"), downsampleNone},
+		{"instant rate", hints(60*minute, 5*minute, minute, 0, "abs"), downsampleNone},
+		{"max_over_time", hints(60*minute, 10*minute, minute, 10*minute, "max_over_time"), downsampleMax},
+		{"min_over_time", hints(60*minute, 10*minute, 2*minute, 10*minute, "min_over_time"), downsampleMin},
+		{"max_over_time off step", hints(61*minute, 10*minute, 2*minute, 10*minute, "max_over_time"), downsampleNone},
+		{"window not a multiple of step", hints(60*minute, 7*minute, 2*minute, 7*minute, "max_over_time"), downsampleNone},
+		{"rate", hints(60*minute, 10*minute, minute, 10*minute, "rate"), downsampleNone},
+		{"increase", hints(60*minute, 10*minute, minute, 10*minute, "increase"), downsampleNone},
+		{"avg_over_time", hints(60*minute, 10*minute, minute, 10*minute, "avg_over_time"), downsampleNone},
+		{"no step", hints(60*minute, 5*minute, 0, 0, "sum"), downsampleNone},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := &prompb.Query{StartTimestampMs: tc.hints.StartMs, EndTimestampMs: tc.hints.EndMs, Hints: tc.hints}
+			if got := pushdownMode(q, metricTypeGauge); got != tc.want {
+				t.Errorf("got mode %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
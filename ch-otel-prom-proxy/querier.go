@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+
+	"github.com/prometheus/prometheus/model/labels"
+	prompb "github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/util/annotations"
+)
+
+// chQueryable exposes the ClickHouse metric tables as Prometheus storage so
+// that the PromQL engine can evaluate queries against them directly. Every
+// Select goes through the same dispatch and SQL generation as remote read.
+type chQueryable struct{}
+
+func (chQueryable) Querier(mint, maxt int64) (storage.Querier, error) {
+	return &chQuerier{mint: mint, maxt: maxt}, nil
+}
+
+type chQuerier struct {
+	mint, maxt int64
+}
+
+func (q *chQuerier) Select(ctx context.Context, sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	pq := &prompb.Query{
+		StartTimestampMs: q.mint,
+		EndTimestampMs:   q.maxt,
+		Matchers:         toProtoMatchers(matchers),
+	}
+	if hints != nil {
+		pq.StartTimestampMs, pq.EndTimestampMs = hints.Start, hints.End
+		pq.Hints = &prompb.ReadHints{
+			StepMs:   hints.Step,
+			Func:     hints.Func,
+			StartMs:  hints.Start,
+			EndMs:    hints.End,
+			Grouping: hints.Grouping,
+			By:       hints.By,
+			RangeMs:  hints.Range,
+		}
+	}
+
+	set, err := newSeriesSet(pq.Matchers)
+	if err != nil {
+		return storage.ErrSeriesSet(err)
+	}
+	ctx, warnings := withQueryWarnings(ctx)
+	if err := dispatchQuery(ctx, pq, set); err != nil {
+		return storage.ErrSeriesSet(err)
+	}
+	// seriesSet output is always sorted by label set.
+	ss := newListSeriesSet(set.series())
+	ss.warnings = warnings.annotations()
+	return ss
+}
+
+func (q *chQuerier) LabelValues(ctx context.Context, name string, hints *storage.LabelHints, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	values, _, err := labelValues(ctx, name, q.metadataQueries(matchers), labelHintsLimit(ctx, hints))
+	return values, nil, err
+}
+
+func (q *chQuerier) LabelNames(ctx context.Context, hints *storage.LabelHints, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	names, _, err := labelNames(ctx, q.metadataQueries(matchers), labelHintsLimit(ctx, hints))
+	return names, nil, err
+}
+
+func (q *chQuerier) metadataQueries(matchers []*labels.Matcher) []*prompb.Query {
+	var selectors [][]*labels.Matcher
+	if len(matchers) > 0 {
+		selectors = append(selectors, matchers)
+	}
+	return metadataQueries(selectors, q.mint, q.maxt)
+}
+
+func labelHintsLimit(ctx context.Context, hints *storage.LabelHints) int {
+	limit := tenantFrom(ctx).limits.MetadataLimit
+	if hints != nil && hints.Limit > 0 && (limit <= 0 || hints.Limit < limit) {
+		return hints.Limit
+	}
+	return limit
+}
+
+func (q *chQuerier) Close() error {
+	return nil
+}
+
+func toProtoMatchers(ms []*labels.Matcher) []*prompb.LabelMatcher {
+	out := make([]*prompb.LabelMatcher, 0, len(ms))
+	for _, m := range ms {
+		var t prompb.LabelMatcher_Type
+		switch m.Type {
+		case labels.MatchEqual:
+			t = prompb.LabelMatcher_EQ
+		case labels.MatchNotEqual:
+			t = prompb.LabelMatcher_NEQ
+		case labels.MatchRegexp:
+			t = prompb.LabelMatcher_RE
+		case labels.MatchNotRegexp:
+			t = prompb.LabelMatcher_NRE
+		}
+		out = append(out, &prompb.LabelMatcher{Type: t, Name: m.Name, Value: m.Value})
+	}
+	return out
+}
+
+// listSeriesSet iterates over series already held in memory.
+type listSeriesSet struct {
+	series   []storage.Series
+	cur      int
+	warnings annotations.Annotations
+}
+
+func newListSeriesSet(ts []*prompb.TimeSeries) *listSeriesSet {
+	s := &listSeriesSet{cur: -1}
+	for _, t := range ts {
+		ps := promql.Series{Metric: toLabels(t.Labels)}
+		for _, smp := range t.Samples {
+			ps.Floats = append(ps.Floats, promql.FPoint{T: smp.Timestamp, F: smp.Value})
+		}
+		for _, h := range t.Histograms {
+			ps.Histograms = append(ps.Histograms, promql.HPoint{T: h.Timestamp, H: h.ToFloatHistogram()})
+		}
+		s.series = append(s.series, promql.NewStorageSeries(ps))
+	}
+	return s
+}
+
+func (s *listSeriesSet) Next() bool {
+	s.cur++
+	return s.cur < len(s.series)
+}
+
+func (s *listSeriesSet) At() storage.Series                { return s.series[s.cur] }
+func (s *listSeriesSet) Err() error                        { return nil }
+func (s *listSeriesSet) Warnings() annotations.Annotations { return s.warnings }
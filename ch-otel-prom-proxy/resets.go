@@ -0,0 +1,89 @@
+package main
+
+import (
+	"math"
+
+	"github.com/prometheus/prometheus/model/value"
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+// staleNaN is the value Prometheus uses to mark a series as stale.
+var staleNaN = math.Float64frombits(value.StaleNaN)
+
+// noRecordedValue reports whether a row's Flags mark it as carrying no
+// value. Such rows are read back as stale markers.
+func noRecordedValue(flags uint32) bool {
+	return flags&flagNoRecordedValue != 0
+}
+
+// resetTracker finds where cumulative series start over, from the
+// StartTimeUnix of their points. A zero point at the new start time lets
+// rate() and increase() count everything since the restart instead of
+// guessing from the gap, and keeps them from seeing the restart as a spike.
+// Rows must arrive in time order per series.
+type resetTracker struct {
+	minMs int64
+	index map[uint64][]*resetState
+}
+
+// resetState is what the tracker remembers about one series.
+type resetState struct {
+	labels  []prompb.Label
+	startNs int64
+	lastMs  int64
+}
+
+// newResetTracker returns a tracker for the rows of q. Series that start
+// before q only get zeros for the restarts seen inside it.
+func newResetTracker(q *prompb.Query) *resetTracker {
+	return &resetTracker{minMs: q.StartTimestampMs, index: map[uint64][]*resetState{}}
+}
+
+func (t *resetTracker) clone() *resetTracker {
+	out := &resetTracker{minMs: t.minMs, index: make(map[uint64][]*resetState, len(t.index))}
+	for fp, states := range t.index {
+		cp := make([]*resetState, len(states))
+		for i, s := range states {
+			c := *s
+			cp[i] = &c
+		}
+		out.index[fp] = cp
+	}
+	return out
+}
+
+// zeroAt returns the timestamp in milliseconds of the zero point to insert
+// ahead of the cumulative point at tsNs that started at startNs, and whether
+// one is due. A StartTimeUnix of zero means the start is unknown.
+func (t *resetTracker) zeroAt(metricName string, attributes map[string]string, startNs, tsNs int64) (int64, bool) {
+	ls, fp := seriesKey(metricName, attributes)
+
+	var st *resetState
+	for _, s := range t.index[fp] {
+		if labelsEqual(s.labels, ls) {
+			st = s
+			break
+		}
+	}
+	first := st == nil
+	if first {
+		st = &resetState{labels: ls}
+		t.index[fp] = append(t.index[fp], st)
+	}
+
+	startMs, tsMs := startNs/1e6, tsNs/1e6
+	due := startNs != 0 && startMs < tsMs
+	if first {
+		due = due && startMs >= t.minMs
+	} else {
+		// The zero has to fall strictly between the previous point and this
+		// one, or it would replace a real sample.
+		due = due && startNs > st.startNs && startMs > st.lastMs
+	}
+
+	if startNs != 0 {
+		st.startNs = startNs
+	}
+	st.lastMs = tsMs
+	return startMs, due
+}
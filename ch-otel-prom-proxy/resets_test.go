@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+func TestResetTracker(t *testing.T) {
+	const ms = int64(1e6)
+	type point struct {
+		host          string
+		startMs, tsMs int64
+		wantZero      bool
+		wantZeroAtMs  int64
+	}
+
+	for _, tc := range []struct {
+		name    string
+		queryMs int64
+		points  []point
+	}{
+		{"series starting in range", 100, []point{
+			{host: "a", startMs: 150, tsMs: 160, wantZero: true, wantZeroAtMs: 150},
+			{host: "a", startMs: 150, tsMs: 170},
+		}},
+		{"series starting before range", 100, []point{
+			{host: "a", startMs: 50, tsMs: 160},
+			{host: "a", startMs: 50, tsMs: 170},
+		}},
+		{"restart inside range", 100, []point{
+			{host: "a", startMs: 50, tsMs: 160},
+			{host: "a", startMs: 165, tsMs: 180, wantZero: true, wantZeroAtMs: 165},
+			{host: "a", startMs: 165, tsMs: 190},
+		}},
+		{"restart on the previous point", 100, []point{
+			{host: "a", startMs: 50, tsMs: 160},
+			{host: "a", startMs: 160, tsMs: 180},
+		}},
+		{"start equal to the point", 100, []point{
+			{host: "a", startMs: 160, tsMs: 160},
+		}},
+		{"unknown start", 100, []point{
+			{host: "a", tsMs: 160},
+			{host: "a", tsMs: 170},
+		}},
+		{"series tracked apart", 100, []point{
+			{host: "a", startMs: 150, tsMs: 160, wantZero: true, wantZeroAtMs: 150},
+			{host: "b", startMs: 150, tsMs: 160, wantZero: true, wantZeroAtMs: 150},
+			{host: "a", startMs: 150, tsMs: 170},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := newResetTracker(&prompb.Query{StartTimestampMs: tc.queryMs})
+			for i, p := range tc.points {
+				// A start of zero is an unknown start.
+				at, due := tr.zeroAt("m", map[string]string{"host": p.host}, p.startMs*ms, p.tsMs*ms)
+				if due != p.wantZero || (due && at != p.wantZeroAtMs) {
+					t.Errorf("point %d: got zero %v at %d, want %v at %d", i, due, at, p.wantZero, p.wantZeroAtMs)
+				}
+			}
+		})
+	}
+}
+
+func TestResetTrackerClone(t *testing.T) {
+	tr := newResetTracker(&prompb.Query{})
+	tr.zeroAt("m", nil, 10e6, 20e6)
+
+	cp := tr.clone()
+	if _, due := cp.zeroAt("m", nil, 30e6, 40e6); !due {
+		t.Error("the clone missed the restart")
+	}
+	// The original has not seen the restart the clone was fed.
+	if _, due := tr.zeroAt("m", nil, 30e6, 40e6); !due {
+		t.Error("feeding the clone changed the original")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+// Resource and scope information is turned into labels following the OTel
+// to Prometheus compatibility spec:
+//   - job is service.namespace/service.name, or service.name alone
+//   - instance is service.instance.id
+//   - otel_scope_name and otel_scope_version come from the scope
+//
+// These labels are only added when names are translated, so that turning the
+// proxy's translation on is the one change dashboards have to follow. Resource
+// attributes listed in PROMOTE_RESOURCE_ATTRIBUTES become labels under their
+// own name either way. A data point attribute of the same name wins.
+const (
+	jobExpr      = "if(ResourceAttributes['service.namespace'] != '', concat(ResourceAttributes['service.namespace'], '/', ServiceName), ServiceName)"
+	instanceExpr = "ResourceAttributes['service.instance.id']"
+
+	targetInfoMetric = "target_info"
+)
+
+type resourceLabel struct {
+	name string
+	expr string
+}
+
+func resourceLabels() []resourceLabel {
+	var out []resourceLabel
+	if translateNames {
+		out = append(out,
+			resourceLabel{name: "job", expr: jobExpr},
+			resourceLabel{name: "instance", expr: instanceExpr},
+			resourceLabel{name: "otel_scope_name", expr: "ScopeName"},
+			resourceLabel{name: "otel_scope_version", expr: "ScopeVersion"},
+		)
+	}
+	for _, attr := range promotedResourceAttributes() {
+		out = append(out, resourceLabel{name: attr, expr: resourceAttributeExpr(attr)})
+	}
+	return out
+}
+
+func promotedResourceAttributes() []string {
+	return promoteResourceAttrs
+}
+
+func resourceAttributeExpr(name string) string {
+	return fmt.Sprintf("ResourceAttributes['%s']", escapeString(name))
+}
+
+// labelExpr returns the ClickHouse expression for the value of label name,
+// covering both data point attributes and promoted resource labels.
+func labelExpr(name string) string {
+	attr := mapValueExpr("Attributes", name)
+	for _, rl := range resourceLabels() {
+		if sanitizeLabelName(rl.name) == name {
+			return fmt.Sprintf("if(%s != '', %[1]s, %s)", attr, rl.expr)
+		}
+	}
+	return attr
+}
+
+// labelsExpr returns the ClickHouse expression for the map of every label of
+// a row except __name__. Empty values are dropped, as Prometheus treats them
+// as absent.
+func labelsExpr() string {
+	attrs := "mapFilter((k, v) -> v != '', CAST(Attributes, 'Map(String, String)'))"
+	var pairs []string
+	for _, rl := range resourceLabels() {
+		pairs = append(pairs, fmt.Sprintf("'%s', %s", escapeString(rl.name), rl.expr))
+	}
+	if len(pairs) == 0 {
+		return attrs
+	}
+	return fmt.Sprintf("mapFilter((k, v) -> v != '', mapUpdate(map(%s), %s))", strings.Join(pairs, ", "), attrs)
+}
+
+// targetInfoLabelsExpr returns the labels of the target_info series for a
+// row: job, instance and every resource attribute not already turned into a
+// label.
+func targetInfoLabelsExpr() string {
+	skip := []string{"'service.name'", "'service.namespace'", "'service.instance.id'"}
+	for _, attr := range promotedResourceAttributes() {
+		skip = append(skip, fmt.Sprintf("'%s'", escapeString(attr)))
+	}
+	return fmt.Sprintf(
+		"mapFilter((k, v) -> v != '' AND k NOT IN (%s), mapUpdate(CAST(ResourceAttributes, 'Map(String, String)'), map('job', %s, 'instance', %s)))",
+		strings.Join(skip, ", "), jobExpr, instanceExpr)
+}
+
+// wantsTargetInfo reports whether the __name__ matchers of q select the
+// synthesized target_info series.
+func wantsTargetInfo(q *prompb.Query) (bool, error) {
+	if !targetInfoEnabled {
+		return false, nil
+	}
+	var nameMatchers []*prompb.LabelMatcher
+	for _, m := range q.Matchers {
+		if m.Name == "__name__" {
+			nameMatchers = append(nameMatchers, m)
+		}
+	}
+	lms, err := toLabelMatchers(nameMatchers)
+	if err != nil {
+		return false, err
+	}
+	return seriesMatches([]prompb.Label{{Name: "__name__", Value: targetInfoMetric}}, lms), nil
+}
+
+// processQueryTargetInfo synthesizes target_info with a value of 1 for every
+// resource that reported any metric, one sample per minute it was active.
+// Only the tables the metric catalog could read are searched.
+func processQueryTargetInfo(ctx context.Context, q *prompb.Query, app seriesAppender) error {
+	snap, err := tenantFrom(ctx).catalog.lookup(ctx)
+	if err != nil {
+		return err
+	}
+	startMs := q.StartTimestampMs
+	endMs := q.EndTimestampMs
+	if endMs == 0 {
+		endMs = time.Now().UnixNano() / 1e6
+	}
+	where := []string{timeRangeCondition}
+	var args []interface{}
+	for _, m := range q.Matchers {
+		var expr string
+		switch m.Name {
+		case "__name__":
+			continue
+		case "job":
+			expr = jobExpr
+		case "instance":
+			expr = instanceExpr
+		default:
+			expr = mapValueExpr("ResourceAttributes", m.Name)
+		}
+		pred, a, err := matcherSQL(m, expr)
+		if err != nil {
+			return err
+		}
+		where = append(where, pred)
+		args = append(args, a...)
+	}
+	whereClause := strings.Join(where, " AND ")
+
+	var selects []string
+	var allArgs []interface{}
+	for _, t := range snap.types {
+		selects = append(selects, fmt.Sprintf("SELECT %s AS Labels, TimeUnix FROM %s WHERE %s",
+			targetInfoLabelsExpr(), tableRef(ctx, t.table()), whereClause))
+		allArgs = append(allArgs, startMs, endMs+1)
+		allArgs = append(allArgs, args...)
+	}
+
+	query := fmt.Sprintf(`
+SELECT
+  Labels,
+  toUnixTimestamp64Nano(max(TimeUnix)) AS ts_ns
+FROM
+(
+%s
+)
+GROUP BY Labels, toStartOfMinute(TimeUnix)
+ORDER BY ts_ns
+%s
+`, strings.Join(selects, "\nUNION ALL\n"), limitClause(ctx))
+
+	rows, err := queryLimited(ctx, query, allArgs...)
+	if err != nil {
+		return fmt.Errorf("ClickHouse query error: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var attributes map[string]string
+		var tsNs int64
+		if err := rows.Scan(&attributes, &tsNs); err != nil {
+			logScanError(ctx, err)
+			continue
+		}
+
+		labels := []prompb.Label{{Name: "__name__", Value: targetInfoMetric}}
+		for k, v := range attributes {
+			labels = append(labels, prompb.Label{Name: k, Value: v})
+		}
+		app.addSample(labels, prompb.Sample{Timestamp: tsNs / 1e6, Value: 1})
+	}
+	return rows.Err()
+}
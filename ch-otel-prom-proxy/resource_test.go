@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+func TestWantsTargetInfo(t *testing.T) {
+	name := func(typ prompb.LabelMatcher_Type, v string) *prompb.LabelMatcher {
+		return &prompb.LabelMatcher{Type: typ, Name: "__name__", Value: v}
+	}
+	host := &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "host", Value: "a"}
+
+	for _, tc := range []struct {
+		name     string
+		enabled  bool
+		matchers []*prompb.LabelMatcher
+		want     bool
+	}{
+		{"by name", true, []*prompb.LabelMatcher{name(prompb.LabelMatcher_EQ, "target_info"), host}, true},
+		{"by regex", true, []*prompb.LabelMatcher{name(prompb.LabelMatcher_RE, "target_.*")}, true},
+		{"another name", true, []*prompb.LabelMatcher{name(prompb.LabelMatcher_EQ, "cpu")}, false},
+		{"excluded", true, []*prompb.LabelMatcher{name(prompb.LabelMatcher_NEQ, "target_info")}, false},
+		{"excluded by regex", true, []*prompb.LabelMatcher{name(prompb.LabelMatcher_NRE, "target.*")}, false},
+		{"no name matcher", true, []*prompb.LabelMatcher{host}, true},
+		{"disabled", false, []*prompb.LabelMatcher{name(prompb.LabelMatcher_EQ, "target_info")}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			applyTestConfig(t, func(c *config) { c.Labels.TargetInfo = tc.enabled })
+			got, err := wantsTargetInfo(&prompb.Query{Matchers: tc.matchers})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	applyTestConfig(t, func(c *config) { c.Labels.TargetInfo = true })
+	if _, err := wantsTargetInfo(&prompb.Query{Matchers: []*prompb.LabelMatcher{name(prompb.LabelMatcher_RE, "(")}}); err == nil {
+		t.Error("an invalid regex must fail")
+	}
+}
+
+func TestLabelsExpr(t *testing.T) {
+	const attrs = "mapFilter((k, v) -> v != '', CAST(Attributes, 'Map(String, String)'))"
+	for _, tc := range []struct {
+		name      string
+		translate bool
+		promote   []string
+		want      string
+	}{
+		{"attributes only", false, nil, attrs},
+		{
+			"promoted attributes",
+			false, []string{"deployment.environment", "it's"},
+			"mapFilter((k, v) -> v != '', mapUpdate(map(" +
+				"'deployment.environment', ResourceAttributes['deployment.environment'], " +
+				`'it\'s', ResourceAttributes['it\'s']), ` + attrs + "))",
+		},
+		{
+			"translated names",
+			true, []string{"region"},
+			"mapFilter((k, v) -> v != '', mapUpdate(map(" +
+				"'job', " + jobExpr + ", " +
+				"'instance', " + instanceExpr + ", " +
+				"'otel_scope_name', ScopeName, " +
+				"'otel_scope_version', ScopeVersion, " +
+				"'region', ResourceAttributes['region']), " + attrs + "))",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			applyTestConfig(t, func(c *config) {
+				c.Labels.TranslateNames = tc.translate
+				c.Labels.PromoteResourceAttributes = tc.promote
+			})
+			if got := labelsExpr(); got != tc.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"sort"
+
+	"github.com/prometheus/prometheus/model/labels"
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+// seriesAppender receives the samples the query handlers decode from
+// ClickHouse rows. Label sets that do not satisfy the query's matchers are
+// dropped by the appender.
+type seriesAppender interface {
+	addSample(ls []prompb.Label, sample prompb.Sample)
+	addHistogram(ls []prompb.Label, h prompb.Histogram)
+}
+
+// seriesSet groups samples into one time series per unique label set.
+type seriesSet struct {
+	matchers []*labels.Matcher
+	index    map[uint64][]*prompb.TimeSeries
+	order    []*prompb.TimeSeries
+}
+
+func newSeriesSet(ms []*prompb.LabelMatcher) (*seriesSet, error) {
+	lms, err := toLabelMatchers(ms)
+	if err != nil {
+		return nil, err
+	}
+	return &seriesSet{matchers: lms, index: map[uint64][]*prompb.TimeSeries{}}, nil
+}
+
+// get returns the series for ls, creating it if needed, or nil when ls does
+// not satisfy the set's matchers.
+func (s *seriesSet) get(ls []prompb.Label) *prompb.TimeSeries {
+	sortLabels(ls)
+	if !seriesMatches(ls, s.matchers) {
+		return nil
+	}
+
+	fp := fingerprint(ls)
+	for _, ts := range s.index[fp] {
+		if labelsEqual(ts.Labels, ls) {
+			return ts
+		}
+	}
+
+	ts := &prompb.TimeSeries{Labels: ls}
+	s.index[fp] = append(s.index[fp], ts)
+	s.order = append(s.order, ts)
+	return ts
+}
+
+func (s *seriesSet) addSample(ls []prompb.Label, sample prompb.Sample) {
+	ts := s.get(ls)
+	if ts == nil {
+		return
+	}
+	ts.Samples = append(ts.Samples, sample)
+}
+
+func (s *seriesSet) addHistogram(ls []prompb.Label, h prompb.Histogram) {
+	ts := s.get(ls)
+	if ts == nil {
+		return
+	}
+	ts.Histograms = append(ts.Histograms, h)
+}
+
+func (s *seriesSet) addExemplar(ls []prompb.Label, e prompb.Exemplar) {
+	ts := s.get(ls)
+	if ts == nil {
+		return
+	}
+	ts.Exemplars = append(ts.Exemplars, e)
+}
+
+// series returns the grouped series sorted by label set, each with its
+// samples, histograms and exemplars ordered by time. When several rows share a
+// timestamp the last one wins.
+func (s *seriesSet) series() []*prompb.TimeSeries {
+	telemetry.seriesEmitted.Add(context.Background(), int64(len(s.order)))
+	for _, ts := range s.order {
+		sort.SliceStable(ts.Samples, func(i, j int) bool {
+			return ts.Samples[i].Timestamp < ts.Samples[j].Timestamp
+		})
+		ts.Samples = dedupeSamples(ts.Samples)
+
+		sort.SliceStable(ts.Histograms, func(i, j int) bool {
+			return ts.Histograms[i].Timestamp < ts.Histograms[j].Timestamp
+		})
+		ts.Histograms = dedupeHistograms(ts.Histograms)
+
+		sort.SliceStable(ts.Exemplars, func(i, j int) bool {
+			return ts.Exemplars[i].Timestamp < ts.Exemplars[j].Timestamp
+		})
+	}
+
+	sort.Slice(s.order, func(i, j int) bool {
+		return compareLabels(s.order[i].Labels, s.order[j].Labels) < 0
+	})
+	return s.order
+}
+
+func dedupeSamples(samples []prompb.Sample) []prompb.Sample {
+	if len(samples) < 2 {
+		return samples
+	}
+	out := samples[:1]
+	for _, smp := range samples[1:] {
+		if smp.Timestamp == out[len(out)-1].Timestamp {
+			out[len(out)-1] = smp
+			continue
+		}
+		out = append(out, smp)
+	}
+	return out
+}
+
+func dedupeHistograms(hs []prompb.Histogram) []prompb.Histogram {
+	if len(hs) < 2 {
+		return hs
+	}
+	out := hs[:1]
+	for _, h := range hs[1:] {
+		if h.Timestamp == out[len(out)-1].Timestamp {
+			out[len(out)-1] = h
+			continue
+		}
+		out = append(out, h)
+	}
+	return out
+}
+
+// sortLabels sorts ls by name so that equal sets built in a different order
+// compare and hash the same.
+func sortLabels(ls []prompb.Label) {
+	sort.Slice(ls, func(i, j int) bool { return ls[i].Name < ls[j].Name })
+}
+
+func fingerprint(ls []prompb.Label) uint64 {
+	return toLabels(ls).Hash()
+}
+
+func toLabels(ls []prompb.Label) labels.Labels {
+	b := labels.NewScratchBuilder(len(ls))
+	for _, l := range ls {
+		b.Add(l.Name, l.Value)
+	}
+	b.Sort()
+	return b.Labels()
+}
+
+// compareLabels orders two sorted label sets the same way labels.Compare does.
+func compareLabels(a, b []prompb.Label) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].Name != b[i].Name {
+			if a[i].Name < b[i].Name {
+				return -1
+			}
+			return 1
+		}
+		if a[i].Value != b[i].Value {
+			if a[i].Value < b[i].Value {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+func labelsEqual(a, b []prompb.Label) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Value != b[i].Value {
+			return false
+		}
+	}
+	return true
+}
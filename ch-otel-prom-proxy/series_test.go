@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+func TestSeriesSet(t *testing.T) {
+	type row struct {
+		labels []prompb.Label
+		t      int64
+		v      float64
+	}
+	lbl := func(kv ...string) []prompb.Label {
+		var ls []prompb.Label
+		for i := 0; i < len(kv); i += 2 {
+			ls = append(ls, prompb.Label{Name: kv[i], Value: kv[i+1]})
+		}
+		return ls
+	}
+
+	for _, tc := range []struct {
+		name     string
+		matchers []*prompb.LabelMatcher
+		rows     []row
+		want     []string
+	}{
+		{
+			name: "grouped regardless of label order",
+			rows: []row{
+				{lbl("__name__", "m", "host", "a"), 1, 1},
+				{lbl("host", "a", "__name__", "m"), 2, 2},
+			},
+			want: []string{`{__name__="m", host="a"} [1=1 2=2]`},
+		},
+		{
+			name: "sorted by time, last row wins",
+			rows: []row{
+				{lbl("__name__", "m"), 3, 3},
+				{lbl("__name__", "m"), 1, 1},
+				{lbl("__name__", "m"), 3, 30},
+				{lbl("__name__", "m"), 2, 2},
+				{lbl("__name__", "m"), 1, 10},
+			},
+			want: []string{`{__name__="m"} [1=10 2=2 3=30]`},
+		},
+		{
+			name: "series sorted by label set",
+			rows: []row{
+				{lbl("__name__", "m", "host", "b"), 1, 1},
+				{lbl("__name__", "m"), 1, 1},
+				{lbl("__name__", "m", "host", "a"), 1, 1},
+				{lbl("__name__", "l", "host", "z"), 1, 1},
+			},
+			want: []string{
+				`{__name__="l", host="z"} [1=1]`,
+				`{__name__="m"} [1=1]`,
+				`{__name__="m", host="a"} [1=1]`,
+				`{__name__="m", host="b"} [1=1]`,
+			},
+		},
+		{
+			name:     "series the matchers do not select are dropped",
+			matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "le", Value: "1"}},
+			rows: []row{
+				{lbl("__name__", "h_bucket", "le", "1"), 1, 1},
+				{lbl("__name__", "h_bucket", "le", "+Inf"), 1, 2},
+			},
+			want: []string{`{__name__="h_bucket", le="1"} [1=1]`},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := newSeriesSet(tc.matchers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range tc.rows {
+				s.addSample(r.labels, prompb.Sample{Timestamp: r.t, Value: r.v})
+			}
+			var got []string
+			for _, ts := range s.series() {
+				var samples []string
+				for _, smp := range ts.Samples {
+					samples = append(samples, fmt.Sprintf("%d=%g", smp.Timestamp, smp.Value))
+				}
+				got = append(got, fmt.Sprintf("%s %v", toLabels(ts.Labels), samples))
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got\n%q\nwant\n%q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSeriesSetHistogramsAndExemplars(t *testing.T) {
+	s, err := newSeriesSet(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := func() []prompb.Label { return []prompb.Label{{Name: "__name__", Value: "h"}} }
+	for _, ts := range []int64{2, 1, 2} {
+		s.addHistogram(ls(), prompb.Histogram{Timestamp: ts, Sum: float64(ts * 10)})
+	}
+	s.addHistogram(ls(), prompb.Histogram{Timestamp: 2, Sum: 99})
+	for _, ts := range []int64{5, 3, 3} {
+		s.addExemplar(ls(), prompb.Exemplar{Timestamp: ts, Value: float64(ts)})
+	}
+
+	series := s.series()
+	if len(series) != 1 {
+		t.Fatalf("got %d series", len(series))
+	}
+	var hs []string
+	for _, h := range series[0].Histograms {
+		hs = append(hs, fmt.Sprintf("%d=%g", h.Timestamp, h.Sum))
+	}
+	if want := []string{"1=10", "2=99"}; !reflect.DeepEqual(hs, want) {
+		t.Errorf("got histograms %v, want %v", hs, want)
+	}
+	// Exemplars at the same time are distinct and all kept.
+	var es []int64
+	for _, e := range series[0].Exemplars {
+		es = append(es, e.Timestamp)
+	}
+	if want := []int64{3, 3, 5}; !reflect.DeepEqual(es, want) {
+		t.Errorf("got exemplars at %v, want %v", es, want)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+// shardQuery splits q at every multiple of shardInterval inside its range,
+// so that each shard reads a single daily partition. The shards cover
+// [start, edge-1] and [edge, end] so a point on an edge is read once.
+func shardQuery(q *prompb.Query) []*prompb.Query {
+	interval := shardInterval.Milliseconds()
+	if interval <= 0 || q.StartTimestampMs < 0 || q.EndTimestampMs < q.StartTimestampMs {
+		return []*prompb.Query{q}
+	}
+
+	var shards []*prompb.Query
+	start := q.StartTimestampMs
+	for edge := (start/interval + 1) * interval; edge <= q.EndTimestampMs; edge += interval {
+		shard := *q
+		shard.StartTimestampMs, shard.EndTimestampMs = start, edge-1
+		shards = append(shards, &shard)
+		start = edge
+	}
+	if len(shards) == 0 {
+		return []*prompb.Query{q}
+	}
+	last := *q
+	last.StartTimestampMs = start
+	return append(shards, &last)
+}
+
+// shardTurn orders one shard of a query after the shard before it. Shards
+// take their query slots in order, so that a shard holding a slot never
+// waits on one still queued for a slot, and handle their rows in order, so
+// that rows reach the handler's per-series state and the appender in time
+// order as if the query had not been split.
+type shardTurn struct {
+	prevStarted, prevDone <-chan struct{}
+
+	started   chan struct{}
+	startOnce sync.Once
+	done      chan struct{}
+}
+
+type shardTurnKey struct{}
+
+func (t *shardTurn) start() {
+	t.startOnce.Do(func() { close(t.started) })
+}
+
+// query runs query once the shard before has its query slot, and returns its
+// rows once that shard is done with its rows. ClickHouse reads the shards in
+// parallel meanwhile. A nil turn runs query right away.
+func (t *shardTurn) query(ctx context.Context, query string, args ...interface{}) (*queryRows, error) {
+	if t == nil {
+		return queryContext(ctx, query, args...)
+	}
+	if err := waitFor(ctx, t.prevStarted); err != nil {
+		return nil, err
+	}
+	release, err := acquireQuerySlot(ctx)
+	t.start()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := startQuery(ctx, release, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	if err := waitFor(ctx, t.prevDone); err != nil {
+		rows.Close()
+		return nil, err
+	}
+	return rows, nil
+}
+
+func waitFor(ctx context.Context, ch <-chan struct{}) error {
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runSharded runs h for q, split by shardQuery into shards read
+// readConcurrency at a time.
+func runSharded(ctx context.Context, h queryHandler, q *prompb.Query, app seriesAppender) error {
+	shards := shardQuery(q)
+	if len(shards) == 1 {
+		return h(ctx, q, app)
+	}
+	// The shards carry one state through the whole range, so running
+	// totals and restarts continue across their edges.
+	if _, ok := ctx.Value(seriesStateKey{}).(*seriesState); !ok {
+		ctx = withSeriesState(ctx, newSeriesState(q))
+	}
+
+	first := make(chan struct{})
+	close(first)
+	turns := make([]*shardTurn, len(shards))
+	prevStarted, prevDone := first, first
+	for i := range turns {
+		turns[i] = &shardTurn{
+			prevStarted: prevStarted,
+			prevDone:    prevDone,
+			started:     make(chan struct{}),
+			done:        make(chan struct{}),
+		}
+		prevStarted, prevDone = turns[i].started, turns[i].done
+	}
+
+	return runOrdered(ctx, len(shards), readConcurrency, func(ctx context.Context, i int) error {
+		turn := turns[i]
+		defer turn.start()
+		if err := h(context.WithValue(ctx, shardTurnKey{}, turn), shards[i], app); err != nil {
+			// The shards after never get their turn, and give up once
+			// the error cancels ctx.
+			return err
+		}
+		close(turn.done)
+		return nil
+	}, func(int) error { return nil })
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+func TestShardQuery(t *testing.T) {
+	shardInterval = 24 * time.Hour
+	t.Cleanup(func() { shardInterval = 0 })
+
+	const day = int64(24 * time.Hour / time.Millisecond)
+	for _, tc := range []struct {
+		name       string
+		start, end int64
+		want       [][2]int64
+	}{
+		{"within a day", 2*day + 5, 3*day - 1, [][2]int64{{2*day + 5, 3*day - 1}}},
+		{"ends on an edge", 2*day + 5, 3 * day, [][2]int64{{2*day + 5, 3*day - 1}, {3 * day, 3 * day}}},
+		{"starts on an edge", 2 * day, 3*day + 7, [][2]int64{{2 * day, 3*day - 1}, {3 * day, 3*day + 7}}},
+		{"several days", day / 2, 3*day + day/2, [][2]int64{
+			{day / 2, day - 1}, {day, 2*day - 1}, {2 * day, 3*day - 1}, {3 * day, 3*day + day/2},
+		}},
+		{"single point", 2 * day, 2 * day, [][2]int64{{2 * day, 2 * day}}},
+		{"negative start", -5, day + 5, [][2]int64{{-5, day + 5}}},
+		{"end before start", 2 * day, day, [][2]int64{{2 * day, day}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := &prompb.Query{StartTimestampMs: tc.start, EndTimestampMs: tc.end, Hints: &prompb.ReadHints{StepMs: 60000}}
+			var got [][2]int64
+			for _, s := range shardQuery(q) {
+				got = append(got, [2]int64{s.StartTimestampMs, s.EndTimestampMs})
+				if s.Hints != q.Hints {
+					t.Error("shards must keep the query's hints")
+				}
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got shards %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	shardInterval = 0
+	q := &prompb.Query{StartTimestampMs: 0, EndTimestampMs: 10 * day}
+	if got := shardQuery(q); len(got) != 1 || got[0] != q {
+		t.Errorf("sharding off: got %d shards", len(got))
+	}
+}
+
+func TestRowBudgetIsSharedAcrossShards(t *testing.T) {
+	ctx := withTenant(context.Background(), newTenant("", nil, "otel_metrics", nil, limitsConfig{MaxRows: 100}))
+	q := &prompb.Query{Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "m"}}}
+	key := cacheKey(ctx, metricTypeGauge, q)
+
+	ctx = withRowBudget(ctx)
+	b := ctx.Value(rowBudgetKey{}).(*rowBudget)
+	// The exemplar pass of a remote read picks up the budget of its samples.
+	if withRowBudget(ctx) != ctx {
+		t.Error("withRowBudget replaced the budget already in ctx")
+	}
+	for _, tc := range []struct {
+		read int64
+		want string
+	}{
+		{0, "LIMIT 101"},
+		{60, "LIMIT 41"},
+		{40, "LIMIT 1"},
+		{1, "LIMIT 1"},
+	} {
+		b.used.Add(tc.read)
+		if got := limitClause(ctx); got != tc.want {
+			t.Errorf("after %d rows: got %q, want %q", b.used.Load(), got, tc.want)
+		}
+	}
+	if got := cacheKey(ctx, metricTypeGauge, q); got != key {
+		t.Errorf("cache key depends on the rows read: %q != %q", got, key)
+	}
+
+	unlimited := withTenant(context.Background(), newTenant("", nil, "otel_metrics", nil, limitsConfig{}))
+	if got := limitClause(withRowBudget(unlimited)); got != "" {
+		t.Errorf("no row limit: got %q", got)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	prompb "github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+const (
+	// Cut chunks at the same size the Prometheus TSDB head does.
+	samplesPerChunk = 120
+
+	// Upper bound on the chunk data sent in a single ChunkedReadResponse
+	// frame; Prometheus uses the same default for its own streamed reads.
+	maxBytesInFrame = 1024 * 1024
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// chunkedWriter frames each write with a uvarint length and a big-endian
+// CRC32C of the payload, as expected by Prometheus for STREAMED_XOR_CHUNKS.
+type chunkedWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+	crc     hash.Hash32
+	written int
+}
+
+func newChunkedWriter(w io.Writer, f http.Flusher) *chunkedWriter {
+	return &chunkedWriter{w: w, flusher: f, crc: crc32.New(castagnoliTable)}
+}
+
+func (c *chunkedWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	var buf [binary.MaxVarintLen64 + 4]byte
+	n := binary.PutUvarint(buf[:], uint64(len(b)))
+	c.crc.Reset()
+	_, _ = c.crc.Write(b)
+	binary.BigEndian.PutUint32(buf[n:], c.crc.Sum32())
+	if _, err := c.w.Write(buf[:n+4]); err != nil {
+		return 0, err
+	}
+
+	written, err := c.w.Write(b)
+	c.written += written
+	if err != nil {
+		return written, err
+	}
+	if c.flusher != nil {
+		c.flusher.Flush()
+	}
+	return written, nil
+}
+
+// streamChunkedResponse answers rr with one or more framed
+// ChunkedReadResponses per series. Rows of a query come from ClickHouse in
+// time order rather than series by series, so a series is only complete once
+// its query has run: each query's response is buffered until then, and only
+// the frames of finished queries stream. Samples are encoded into compressed
+// chunks as rows arrive, so the buffer holds chunk data rather than samples.
+//
+// Warnings go out as Warning headers with the first frame, like those of the
+// SAMPLES response. Warnings of later queries come after the headers, and go
+// out as Warning trailers instead.
+func streamChunkedResponse(ctx context.Context, w http.ResponseWriter, rr *prompb.ReadRequest) {
+	w.Header().Set("Content-Type", "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse")
+	flusher, _ := w.(http.Flusher)
+	cw := newChunkedWriter(w, flusher)
+	ctx, warnings := withQueryWarnings(ctx)
+	sent := map[string]bool{}
+
+	sets := make([]*chunkedSeriesSet, len(rr.Queries))
+	for i, q := range rr.Queries {
+		var err error
+		if sets[i], err = newChunkedSeriesSet(q.Matchers); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Queries run concurrently, but their frames go out in query order.
+	err := runOrdered(ctx, len(rr.Queries), readConcurrency, func(ctx context.Context, i int) error {
+		return dispatchQuery(ctx, rr.Queries[i], sets[i])
+	}, func(i int) error {
+		if cw.written == 0 {
+			addWarningHeaders(w.Header(), "Warning", warnings, sent)
+		}
+		err := sets[i].writeTo(cw, int64(i))
+		sets[i] = nil
+		return err
+	})
+	if err == nil {
+		if cw.written == 0 {
+			addWarningHeaders(w.Header(), "Warning", warnings, sent)
+		} else {
+			addWarningHeaders(w.Header(), http.TrailerPrefix+"Warning", warnings, sent)
+		}
+		return
+	}
+	if cw.written == 0 {
+		writeReadError(w, err)
+		return
+	}
+	// Headers are gone once the first frame is out, so all we can do is cut
+	// the stream short.
+	log.Printf("streamed response error: %v", err)
+}
+
+// addWarningHeaders adds the warnings not yet in sent to h under key, and
+// records them as sent.
+func addWarningHeaders(h http.Header, key string, warnings *queryWarnings, sent map[string]bool) {
+	for _, warning := range warnings.annotations().AsErrors() {
+		v := fmt.Sprintf("299 - %q", warning.Error())
+		if !sent[v] {
+			h.Add(key, v)
+			sent[v] = true
+		}
+	}
+}
+
+// chunkedSeries encodes the samples of one series into XOR or histogram
+// chunks.
+type chunkedSeries struct {
+	labels []prompb.Label
+	chunks []prompb.Chunk
+
+	chunk      chunkenc.Chunk
+	app        chunkenc.Appender
+	minT, maxT int64
+
+	// The newest sample is held back until a later timestamp shows up, so
+	// that duplicate rows resolve last-wins like the SAMPLES response.
+	hasPending bool
+	pendingT   int64
+	pendingV   float64
+	pendingH   *histogram.Histogram
+
+	// late holds samples older than one already added, such as those of a
+	// series found in two tables, for finish to merge in.
+	late []chunkSample
+}
+
+type chunkSample struct {
+	t int64
+	v float64
+	h *histogram.Histogram
+}
+
+func (s *chunkedSeries) add(t int64, v float64, h *histogram.Histogram) error {
+	if s.hasPending {
+		if t < s.pendingT {
+			s.late = append(s.late, chunkSample{t: t, v: v, h: h})
+			return nil
+		}
+		if t > s.pendingT {
+			if err := s.commit(); err != nil {
+				return err
+			}
+		}
+	}
+	s.hasPending, s.pendingT, s.pendingV, s.pendingH = true, t, v, h
+	return nil
+}
+
+func (s *chunkedSeries) commit() error {
+	if !s.hasPending {
+		return nil
+	}
+	s.hasPending = false
+	t, h := s.pendingT, s.pendingH
+
+	enc := chunkenc.EncXOR
+	if h != nil {
+		enc = chunkenc.EncHistogram
+	}
+	if s.chunk == nil || s.chunk.Encoding() != enc || s.chunk.NumSamples() >= samplesPerChunk {
+		s.cut()
+		if h != nil {
+			s.chunk = chunkenc.NewHistogramChunk()
+		} else {
+			s.chunk = chunkenc.NewXORChunk()
+		}
+		app, err := s.chunk.Appender()
+		if err != nil {
+			return err
+		}
+		s.app, s.minT = app, t
+	}
+
+	if h == nil {
+		s.app.Append(t, s.pendingV)
+	} else {
+		c, recoded, app, err := s.app.AppendHistogram(nil, t, h, false)
+		if err != nil {
+			return err
+		}
+		if c != nil {
+			// A bucket layout change either recodes the current chunk or
+			// starts a new one holding just this sample.
+			if !recoded {
+				s.cut()
+				s.minT = t
+			}
+			s.chunk = c
+		}
+		s.app = app
+	}
+	s.maxT = t
+	return nil
+}
+
+// finish encodes the held back sample and merges in late ones, so that the
+// chunks hold every sample in time order with the last row winning on equal
+// timestamps, like the SAMPLES response.
+func (s *chunkedSeries) finish() error {
+	if err := s.commit(); err != nil {
+		return err
+	}
+	s.cut()
+	if len(s.late) == 0 {
+		return nil
+	}
+
+	samples, err := decodeChunks(s.chunks)
+	if err != nil {
+		return err
+	}
+	// Late samples arrived after every sample in the chunks, so they go
+	// last among equal timestamps.
+	samples = append(samples, s.late...)
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].t < samples[j].t })
+
+	s.chunks, s.late = nil, nil
+	for _, smp := range samples {
+		if err := s.add(smp.t, smp.v, smp.h); err != nil {
+			return err
+		}
+	}
+	if err := s.commit(); err != nil {
+		return err
+	}
+	s.cut()
+	return nil
+}
+
+func decodeChunks(chunks []prompb.Chunk) ([]chunkSample, error) {
+	var out []chunkSample
+	for _, c := range chunks {
+		chunk, err := chunkenc.FromData(chunkenc.Encoding(c.Type), c.Data)
+		if err != nil {
+			return nil, err
+		}
+		it := chunk.Iterator(nil)
+		for vt := it.Next(); vt != chunkenc.ValNone; vt = it.Next() {
+			switch vt {
+			case chunkenc.ValFloat:
+				t, v := it.At()
+				out = append(out, chunkSample{t: t, v: v})
+			case chunkenc.ValHistogram:
+				t, h := it.AtHistogram(nil)
+				out = append(out, chunkSample{t: t, h: h})
+			}
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (s *chunkedSeries) cut() {
+	if s.chunk == nil || s.chunk.NumSamples() == 0 {
+		return
+	}
+	s.chunks = append(s.chunks, prompb.Chunk{
+		MinTimeMs: s.minT,
+		MaxTimeMs: s.maxT,
+		Type:      prompb.Chunk_Encoding(s.chunk.Encoding()),
+		Data:      s.chunk.Bytes(),
+	})
+	s.chunk, s.app = nil, nil
+}
+
+// chunkedSeriesSet is the seriesAppender behind STREAMED_XOR_CHUNKS
+// responses.
+type chunkedSeriesSet struct {
+	matchers []*labels.Matcher
+	index    map[uint64][]*chunkedSeries
+	order    []*chunkedSeries
+	err      error
+}
+
+func newChunkedSeriesSet(ms []*prompb.LabelMatcher) (*chunkedSeriesSet, error) {
+	lms, err := toLabelMatchers(ms)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkedSeriesSet{matchers: lms, index: map[uint64][]*chunkedSeries{}}, nil
+}
+
+func (s *chunkedSeriesSet) get(ls []prompb.Label) *chunkedSeries {
+	sortLabels(ls)
+	if !seriesMatches(ls, s.matchers) {
+		return nil
+	}
+
+	fp := fingerprint(ls)
+	for _, cs := range s.index[fp] {
+		if labelsEqual(cs.labels, ls) {
+			return cs
+		}
+	}
+
+	cs := &chunkedSeries{labels: ls}
+	s.index[fp] = append(s.index[fp], cs)
+	s.order = append(s.order, cs)
+	return cs
+}
+
+func (s *chunkedSeriesSet) addSample(ls []prompb.Label, sample prompb.Sample) {
+	if cs := s.get(ls); cs != nil && s.err == nil {
+		s.err = cs.add(sample.Timestamp, sample.Value, nil)
+	}
+}
+
+func (s *chunkedSeriesSet) addHistogram(ls []prompb.Label, h prompb.Histogram) {
+	if cs := s.get(ls); cs != nil && s.err == nil {
+		s.err = cs.add(h.Timestamp, 0, h.ToIntHistogram())
+	}
+}
+
+// writeTo sends every series, sorted by label set as Prometheus expects, as
+// one or more frames on w.
+func (s *chunkedSeriesSet) writeTo(w io.Writer, queryIndex int64) error {
+	if s.err != nil {
+		return fmt.Errorf("encode chunks: %w", s.err)
+	}
+	for _, cs := range s.order {
+		if err := cs.finish(); err != nil {
+			return fmt.Errorf("encode chunks: %w", err)
+		}
+	}
+	sort.Slice(s.order, func(i, j int) bool {
+		return compareLabels(s.order[i].labels, s.order[j].labels) < 0
+	})
+	telemetry.seriesEmitted.Add(context.Background(), int64(len(s.order)))
+
+	for _, cs := range s.order {
+		budget := maxBytesInFrame
+		for _, l := range cs.labels {
+			budget -= l.Size()
+		}
+
+		chunks := cs.chunks
+		for len(chunks) > 0 {
+			n, left := 0, budget
+			for n < len(chunks) && (n == 0 || left > 0) {
+				left -= chunks[n].Size()
+				n++
+			}
+
+			resp := &prompb.ChunkedReadResponse{
+				ChunkedSeries: []*prompb.ChunkedSeries{{Labels: cs.labels, Chunks: chunks[:n]}},
+				QueryIndex:    queryIndex,
+			}
+			b, err := resp.Marshal()
+			if err != nil {
+				return fmt.Errorf("marshal ChunkedReadResponse: %w", err)
+			}
+			if _, err := w.Write(b); err != nil {
+				return fmt.Errorf("write to stream: %w", err)
+			}
+			chunks = chunks[n:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	prompb "github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+var errChecksum = errors.New("checksum mismatch")
+
+// frameReader reads the frames chunkedWriter writes, the way Prometheus'
+// remote.ChunkedReader does.
+type frameReader struct {
+	r *bufio.Reader
+}
+
+func newFrameReader(r io.Reader) *frameReader {
+	return &frameReader{r: bufio.NewReader(r)}
+}
+
+func (f *frameReader) next() ([]byte, error) {
+	size, err := binary.ReadUvarint(f.r)
+	if err != nil {
+		return nil, err
+	}
+	var crc [4]byte
+	if _, err := io.ReadFull(f.r, crc[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(f.r, b); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(b, castagnoliTable) != binary.BigEndian.Uint32(crc[:]) {
+		return nil, errChecksum
+	}
+	return b, nil
+}
+
+func TestChunkedWriterFraming(t *testing.T) {
+	var buf bytes.Buffer
+	cw := newChunkedWriter(&buf, nil)
+	payloads := [][]byte{[]byte("first frame"), bytes.Repeat([]byte{0xab}, 300), {}}
+	for _, p := range payloads {
+		if n, err := cw.Write(p); err != nil || n != len(p) {
+			t.Fatalf("Write: got %d, %v", n, err)
+		}
+	}
+	if cw.written != len(payloads[0])+len(payloads[1]) {
+		t.Errorf("written = %d", cw.written)
+	}
+
+	data := buf.Bytes()
+	r := newFrameReader(bytes.NewReader(data))
+	for _, want := range payloads[:2] {
+		got, err := r.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("got frame %q, want %q", got, want)
+		}
+	}
+	if _, err := r.next(); err != io.EOF {
+		t.Errorf("got %v after the last frame, want EOF; empty writes must not produce a frame", err)
+	}
+
+	// A flipped payload byte no longer matches the CRC32C.
+	corrupt := bytes.Clone(data)
+	corrupt[len(corrupt)-1] ^= 1
+	r = newFrameReader(bytes.NewReader(corrupt))
+	if _, err := r.next(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.next(); err != errChecksum {
+		t.Errorf("got %v, want a checksum mismatch", err)
+	}
+}
+
+type streamRow struct {
+	series string
+	t      int64
+	v      float64
+	h      *histogram.Histogram
+}
+
+func TestChunkedSeriesSetMatchesSamples(t *testing.T) {
+	ordered := func(series string, n int) []streamRow {
+		var rows []streamRow
+		for i := 0; i < n; i++ {
+			rows = append(rows, streamRow{series: series, t: int64(i) * 1000, v: float64(i)})
+		}
+		return rows
+	}
+	hist := func(count uint64) *histogram.Histogram {
+		return &histogram.Histogram{
+			Count:           count,
+			Sum:             float64(count),
+			Schema:          0,
+			ZeroThreshold:   1e-128,
+			PositiveSpans:   []histogram.Span{{Offset: 0, Length: 1}},
+			PositiveBuckets: []int64{int64(count)},
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		rows []streamRow
+	}{
+		{"in order", ordered("a", 10)},
+		{"several chunks", ordered("a", 3*samplesPerChunk+7)},
+		{"duplicates", []streamRow{{"a", 1, 1, nil}, {"a", 1, 2, nil}, {"a", 2, 3, nil}, {"a", 2, 4, nil}}},
+		{"out of order", []streamRow{{"a", 5, 5, nil}, {"a", 9, 9, nil}, {"a", 1, 1, nil}, {"a", 7, 7, nil}, {"a", 12, 12, nil}}},
+		{"late duplicate wins", []streamRow{{"a", 1, 1, nil}, {"a", 2, 2, nil}, {"a", 3, 3, nil}, {"a", 1, 10, nil}, {"a", 2, 20, nil}}},
+		{"second table", append(ordered("a", 200), ordered("a", 150)...)},
+		{"series sorted", append(ordered("b", 3), ordered("a", 3)...)},
+		{"histograms out of order", []streamRow{{"a", 2, 0, hist(2)}, {"a", 3, 0, hist(3)}, {"a", 1, 0, hist(1)}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ss, err := newSeriesSet(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cs, err := newChunkedSeriesSet(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, row := range tc.rows {
+				for _, app := range []seriesAppender{ss, cs} {
+					ls := []prompb.Label{{Name: "__name__", Value: "m"}, {Name: "s", Value: row.series}}
+					if row.h != nil {
+						app.addHistogram(ls, prompb.FromIntHistogram(row.t, row.h))
+					} else {
+						app.addSample(ls, prompb.Sample{Timestamp: row.t, Value: row.v})
+					}
+				}
+			}
+
+			var buf bytes.Buffer
+			if err := cs.writeTo(newChunkedWriter(&buf, nil), 3); err != nil {
+				t.Fatal(err)
+			}
+			got := readChunkedSeries(t, &buf)
+
+			var want []string
+			for _, ts := range ss.series() {
+				var samples []string
+				for _, s := range ts.Samples {
+					samples = append(samples, fmt.Sprintf("%d=%g", s.Timestamp, s.Value))
+				}
+				for _, h := range ts.Histograms {
+					samples = append(samples, fmt.Sprintf("%d=%s", h.Timestamp, h.ToIntHistogram()))
+				}
+				want = append(want, fmt.Sprintf("%v %v", ts.Labels, samples))
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("chunked response differs from samples\ngot:  %v\nwant: %v", got, want)
+			}
+		})
+	}
+}
+
+// readChunkedSeries decodes a STREAMED_XOR_CHUNKS response into one line per
+// series, merging the frames a series was split into.
+func readChunkedSeries(t *testing.T, buf *bytes.Buffer) []string {
+	t.Helper()
+	r := newFrameReader(buf)
+	var out []string
+	var last []prompb.Label
+	var samples []string
+	flush := func() {
+		if last != nil {
+			out = append(out, fmt.Sprintf("%v %v", last, samples))
+		}
+	}
+	for {
+		b, err := r.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp prompb.ChunkedReadResponse
+		if err := resp.Unmarshal(b); err != nil {
+			t.Fatal(err)
+		}
+		if resp.QueryIndex != 3 {
+			t.Errorf("got query index %d", resp.QueryIndex)
+		}
+		for _, s := range resp.ChunkedSeries {
+			if !reflect.DeepEqual(s.Labels, last) {
+				flush()
+				last, samples = s.Labels, nil
+			}
+			for _, c := range s.Chunks {
+				chunk, err := chunkenc.FromData(chunkenc.Encoding(c.Type), c.Data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if chunk.NumSamples() > samplesPerChunk {
+					t.Errorf("chunk holds %d samples", chunk.NumSamples())
+				}
+				it := chunk.Iterator(nil)
+				var prev int64
+				for vt := it.Next(); vt != chunkenc.ValNone; vt = it.Next() {
+					switch vt {
+					case chunkenc.ValFloat:
+						ts, v := it.At()
+						samples = append(samples, fmt.Sprintf("%d=%g", ts, v))
+						prev = ts
+					case chunkenc.ValHistogram:
+						ts, h := it.AtHistogram(nil)
+						samples = append(samples, fmt.Sprintf("%d=%s", ts, h))
+						prev = ts
+					}
+					if prev < c.MinTimeMs || prev > c.MaxTimeMs {
+						t.Errorf("sample at %d outside chunk [%d, %d]", prev, c.MinTimeMs, c.MaxTimeMs)
+					}
+				}
+			}
+		}
+	}
+	flush()
+	return out
+}
+
+// firstWriteRecorder closes written on its first write.
+type firstWriteRecorder struct {
+	*httptest.ResponseRecorder
+	once    sync.Once
+	written chan struct{}
+}
+
+func (r *firstWriteRecorder) Write(b []byte) (int, error) {
+	r.once.Do(func() { close(r.written) })
+	return r.ResponseRecorder.Write(b)
+}
+
+func TestStreamChunkedResponseWarnings(t *testing.T) {
+	applyTestConfig(t, nil)
+	w := &firstWriteRecorder{ResponseRecorder: httptest.NewRecorder(), written: make(chan struct{})}
+	f := newFakeClickHouse(func(query string, args []interface{}) (fakeResult, error) {
+		if strings.Contains(query, "GROUP BY MetricName") {
+			if strings.Contains(query, ".otel_metrics_gauge\n") {
+				return fakeResult{columns: []string{"MetricName", "unit", "monotonic"}, rows: [][]interface{}{{"cpu", "", uint8(0)}, {"mem", "", uint8(0)}}}, nil
+			}
+			return fakeResult{columns: []string{"MetricName", "unit", "monotonic"}}, nil
+		}
+		name := "cpu"
+		for _, a := range args {
+			if a == "mem" {
+				name = "mem"
+			}
+		}
+		n := 3
+		if name == "mem" {
+			// The mem query is cut short after the frames of cpu are out.
+			<-w.written
+			n = 5
+		}
+		var rows [][]interface{}
+		for i := 0; i < n; i++ {
+			rows = append(rows, []interface{}{name, map[string]string{}, int64(i+1) * 1e9, float64(i), uint32(0)})
+		}
+		return fakeResult{columns: []string{"MetricName", "Labels", "ts_ns", "SumValue", "Flags"}, rows: rows}, nil
+	})
+	ctx := f.context(limitsConfig{PartialResponse: true})
+	query := func(name string) *prompb.Query {
+		return &prompb.Query{
+			StartTimestampMs: 0,
+			EndTimestampMs:   10000,
+			Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: name}},
+		}
+	}
+	rr := &prompb.ReadRequest{Queries: []*prompb.Query{query("cpu"), query("mem")}}
+	streamChunkedResponse(withRowLimit(ctx, 4), w, rr)
+
+	resp := w.Result()
+	if got := resp.Header.Values("Warning"); len(got) != 0 {
+		t.Errorf("got Warning headers %q before any query was cut short", got)
+	}
+	got := resp.Trailer.Values("Warning")
+	if len(got) != 1 || !strings.Contains(got[0], "limit of 4 rows") {
+		t.Errorf("got Warning trailers %q, want the row limit", got)
+	}
+
+	// Both queries streamed, the second one cut at the limit.
+	samples := map[int64]int{}
+	fr := newFrameReader(resp.Body)
+	for {
+		b, err := fr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cr prompb.ChunkedReadResponse
+		if err := cr.Unmarshal(b); err != nil {
+			t.Fatal(err)
+		}
+		for _, cs := range cr.ChunkedSeries {
+			for _, c := range cs.Chunks {
+				chunk, err := chunkenc.FromData(chunkenc.Encoding(c.Type), c.Data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				samples[cr.QueryIndex] += chunk.NumSamples()
+			}
+		}
+	}
+	if samples[0] != 3 || samples[1] != 4 {
+		t.Errorf("got samples per query %v, want 3 and 4", samples)
+	}
+}
+
+func TestStreamChunkedResponseWarningHeaders(t *testing.T) {
+	applyTestConfig(t, nil)
+	f := newFakeClickHouse(func(query string, args []interface{}) (fakeResult, error) {
+		if strings.Contains(query, "GROUP BY MetricName") {
+			if strings.Contains(query, ".otel_metrics_gauge\n") {
+				return fakeResult{columns: []string{"MetricName", "unit", "monotonic"}, rows: [][]interface{}{{"cpu", "", uint8(0)}}}, nil
+			}
+			return fakeResult{columns: []string{"MetricName", "unit", "monotonic"}}, nil
+		}
+		var rows [][]interface{}
+		for i := 0; i < 5; i++ {
+			rows = append(rows, []interface{}{"cpu", map[string]string{}, int64(i+1) * 1e9, float64(i), uint32(0)})
+		}
+		return fakeResult{columns: []string{"MetricName", "Labels", "ts_ns", "SumValue", "Flags"}, rows: rows}, nil
+	})
+	rr := &prompb.ReadRequest{Queries: []*prompb.Query{{
+		EndTimestampMs: 10000,
+		Matchers:       []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "cpu"}},
+	}}}
+
+	// A warning known before the first frame goes out as a header.
+	w := httptest.NewRecorder()
+	streamChunkedResponse(withRowLimit(f.context(limitsConfig{PartialResponse: true}), 4), w, rr)
+	resp := w.Result()
+	if got := resp.Header.Values("Warning"); len(got) != 1 || !strings.Contains(got[0], "limit of 4 rows") {
+		t.Errorf("got Warning headers %q, want the row limit", got)
+	}
+	if got := resp.Trailer.Values("Warning"); len(got) != 0 {
+		t.Errorf("got Warning trailers %q for a warning already sent", got)
+	}
+
+	// Without partial responses, the query fails before anything streams.
+	w = httptest.NewRecorder()
+	streamChunkedResponse(withRowLimit(f.context(limitsConfig{}), 4), w, rr)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+}
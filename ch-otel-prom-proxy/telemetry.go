@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	otelprom "go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+const serviceName = "ch-otel-prom-proxy"
+
+// proxyMetrics are the instruments the proxy reports about itself.
+type proxyMetrics struct {
+	requests      metric.Int64Counter
+	requestTime   metric.Float64Histogram
+	responseBytes metric.Int64Counter
+
+	queryTime       metric.Float64Histogram
+	queryErrors     metric.Int64Counter
+	rowsScanned     metric.Int64Counter
+	rowsReturned    metric.Int64Counter
+	scanErrors      metric.Int64Counter
+	queriesRejected metric.Int64Counter
+
+	seriesEmitted metric.Int64Counter
+	cacheRequests metric.Int64Counter
+}
+
+// telemetry starts out recording nowhere, until setupTelemetry replaces it.
+var telemetry = newProxyMetrics(noop.NewMeterProvider().Meter(serviceName))
+
+func newProxyMetrics(m metric.Meter) *proxyMetrics {
+	var errs []error
+	counter := func(name, unit, desc string) metric.Int64Counter {
+		c, err := m.Int64Counter(name, metric.WithUnit(unit), metric.WithDescription(desc))
+		errs = append(errs, err)
+		return c
+	}
+	histogram := func(name, desc string) metric.Float64Histogram {
+		h, err := m.Float64Histogram(name, metric.WithUnit("s"), metric.WithDescription(desc),
+			metric.WithExplicitBucketBoundaries(0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60))
+		errs = append(errs, err)
+		return h
+	}
+
+	pm := &proxyMetrics{
+		requests:      counter("proxy.http.requests", "{request}", "HTTP requests served, by handler and status code."),
+		requestTime:   histogram("proxy.http.request.duration", "Time taken to serve HTTP requests, by handler."),
+		responseBytes: counter("proxy.http.response.size", "By", "Bytes written in HTTP responses, by handler."),
+
+		queryTime:       histogram("proxy.clickhouse.query.duration", "Time from sending a ClickHouse query to having read all of its rows."),
+		queryErrors:     counter("proxy.clickhouse.query.errors", "{query}", "ClickHouse queries that failed."),
+		rowsScanned:     counter("proxy.clickhouse.rows.scanned", "{row}", "Rows ClickHouse read to answer queries."),
+		rowsReturned:    counter("proxy.clickhouse.rows.returned", "{row}", "Rows ClickHouse returned to the proxy."),
+		scanErrors:      counter("proxy.clickhouse.scan.errors", "{row}", "Returned rows that could not be decoded and were skipped."),
+		queriesRejected: counter("proxy.clickhouse.queries.rejected", "{query}", "ClickHouse queries turned away by the concurrency limiter, by reason."),
+
+		seriesEmitted: counter("proxy.series.emitted", "{series}", "Series sent back in query results."),
+		cacheRequests: counter("proxy.cache.requests", "{request}", "Handler queries looked up in the result cache, by result: hit, partial, miss or bypass."),
+	}
+	for _, err := range errs {
+		if err != nil {
+			log.Printf("telemetry instrument error: %v", err)
+		}
+	}
+	return pm
+}
+
+// setupTelemetry starts recording the proxy's own metrics. It returns the
+// handler serving them in the Prometheus format and a function flushing
+// and stopping the OTLP export, if any.
+func setupTelemetry(c telemetryConfig) (http.Handler, func(context.Context) error, error) {
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(serviceName)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	registry := prometheus.NewRegistry()
+	promExporter, err := otelprom.New(otelprom.WithRegisterer(registry), otelprom.WithoutScopeInfo())
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := []sdkmetric.Option{sdkmetric.WithResource(res), sdkmetric.WithReader(promExporter)}
+
+	if c.OTLP.Enabled {
+		// Anything left unset is read from the standard OTEL_EXPORTER_OTLP_*
+		// environment variables.
+		var expOpts []otlpmetricgrpc.Option
+		if c.OTLP.Endpoint != "" {
+			expOpts = append(expOpts, otlpmetricgrpc.WithEndpoint(c.OTLP.Endpoint))
+		}
+		if c.OTLP.Insecure {
+			expOpts = append(expOpts, otlpmetricgrpc.WithInsecure())
+		}
+		exp, err := otlpmetricgrpc.New(context.Background(), expOpts...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("OTLP exporter: %w", err)
+		}
+		opts = append(opts, sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exp,
+			sdkmetric.WithInterval(time.Duration(c.OTLP.Interval)))))
+	}
+
+	provider := sdkmetric.NewMeterProvider(opts...)
+	telemetry = newProxyMetrics(provider.Meter(serviceName))
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{}), provider.Shutdown, nil
+}
+
+// handle registers h for pattern on the default mux, recording its requests
+// under the pattern.
+func handle(pattern string, h http.HandlerFunc) {
+	handler := attribute.String("handler", pattern)
+	http.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &instrumentedWriter{ResponseWriter: w, code: http.StatusOK}
+		h(rw, r)
+
+		ctx := r.Context()
+		attrs := metric.WithAttributes(handler, attribute.String("code", strconv.Itoa(rw.code)))
+		telemetry.requests.Add(ctx, 1, attrs)
+		telemetry.requestTime.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(handler))
+		telemetry.responseBytes.Add(ctx, rw.bytes, metric.WithAttributes(handler))
+	})
+}
+
+// instrumentedWriter notes the status code and size of a response. It keeps
+// http.Flusher, which streamed remote-read responses rely on.
+type instrumentedWriter struct {
+	http.ResponseWriter
+	code        int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (w *instrumentedWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.code, w.wroteHeader = code, true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *instrumentedWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *instrumentedWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// queryRows are the rows of a ClickHouse query, recording the query's
+// duration, rows and outcome once closed.
+type queryRows struct {
+	*sql.Rows
+	ctx      context.Context
+	attrs    metric.MeasurementOption
+	start    time.Time
+	returned int64
+	release  func()
+	once     sync.Once
+
+	// budget is the row budget of queries run with queryLimited. Rows past
+	// it are not handed out; Err reports them.
+	budget    *rowBudget
+	truncated bool
+}
+
+func (r *queryRows) Next() bool {
+	if r.budget != nil && r.budget.remaining() == 0 {
+		r.truncated = r.truncated || r.Rows.Next()
+		return false
+	}
+	if r.Rows.Next() {
+		r.returned++
+		if r.budget != nil {
+			r.budget.used.Add(1)
+		}
+		return true
+	}
+	return false
+}
+
+func (r *queryRows) Err() error {
+	if err := r.Rows.Err(); err != nil || !r.truncated {
+		return err
+	}
+	markTruncated(r.ctx)
+	return exceeded(r.ctx, &limitError{"rows", r.budget.limit})
+}
+
+func (r *queryRows) Close() error {
+	err := r.Rows.Close()
+	r.once.Do(func() {
+		r.release()
+		telemetry.queryTime.Record(r.ctx, time.Since(r.start).Seconds(), r.attrs)
+		telemetry.rowsReturned.Add(r.ctx, r.returned, r.attrs)
+		if r.Rows.Err() != nil {
+			telemetry.queryErrors.Add(r.ctx, 1, r.attrs)
+		}
+	})
+	return err
+}
+
+// withScanProgress makes ClickHouse report the rows it reads for the queries
+// run with ctx.
+func withScanProgress(ctx context.Context, attrs metric.MeasurementOption) context.Context {
+	return clickhouse.Context(ctx, clickhouse.WithProgress(func(p *clickhouse.Progress) {
+		telemetry.rowsScanned.Add(ctx, int64(p.Rows), attrs)
+	}))
+}
+
+// logScanError logs a row that could not be decoded, which is then skipped.
+func logScanError(ctx context.Context, err error) {
+	telemetry.scanErrors.Add(ctx, 1)
+	log.Printf("row scan error: %v", err)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// recordTelemetry makes the proxy record its metrics for the rest of the
+// test, and returns the reader collecting them.
+func recordTelemetry(t *testing.T) *sdkmetric.ManualReader {
+	reader := sdkmetric.NewManualReader()
+	prev := telemetry
+	telemetry = newProxyMetrics(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter(serviceName))
+	t.Cleanup(func() { telemetry = prev })
+	return reader
+}
+
+// collected returns the total of counter name, or the number of values
+// recorded by histogram name.
+func collected(t *testing.T, reader *sdkmetric.ManualReader, name string) int64 {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != name {
+				continue
+			}
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				for _, dp := range data.DataPoints {
+					total += dp.Value
+				}
+			case metricdata.Histogram[float64]:
+				for _, dp := range data.DataPoints {
+					total += int64(dp.Count)
+				}
+			}
+		}
+	}
+	return total
+}
+
+// readRows reads the rows of a query limited to limit rows, and returns how
+// many it got and the error of the rows.
+func readRows(t *testing.T, ctx context.Context, limit int) (int, error) {
+	t.Helper()
+	rows, err := queryLimited(withRowLimit(ctx, limit), "SELECT v FROM t "+limitClause(withRowLimit(ctx, limit)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		var v int64
+		if err := rows.Scan(&v); err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+func fiveRows() *fakeClickHouse {
+	return newFakeClickHouse(func(query string, args []interface{}) (fakeResult, error) {
+		res := fakeResult{columns: []string{"v"}}
+		for i := int64(0); i < 5; i++ {
+			res.rows = append(res.rows, []interface{}{i})
+		}
+		return res, nil
+	})
+}
+
+func TestQueryRowsTruncation(t *testing.T) {
+	applyTestConfig(t, nil)
+
+	t.Run("under the limit", func(t *testing.T) {
+		reader := recordTelemetry(t)
+		n, err := readRows(t, fiveRows().context(limitsConfig{}), 5)
+		if n != 5 || err != nil {
+			t.Errorf("got %d rows, %v, want 5 rows", n, err)
+		}
+		if got := collected(t, reader, "proxy.clickhouse.rows.returned"); got != 5 {
+			t.Errorf("got %d rows returned recorded, want 5", got)
+		}
+	})
+
+	t.Run("error policy", func(t *testing.T) {
+		reader := recordTelemetry(t)
+		ctx, cut := withTruncation(fiveRows().context(limitsConfig{}))
+		ctx, warnings := withQueryWarnings(ctx)
+		n, err := readRows(t, ctx, 3)
+		var limitErr *limitError
+		if n != 3 || !errors.As(err, &limitErr) || limitErr.limit != 3 {
+			t.Errorf("got %d rows, %v, want 3 rows and the row limit error", n, err)
+		}
+		if !cut.Load() {
+			t.Error("the truncation was not recorded")
+		}
+		if got := len(warnings.annotations()); got != 0 {
+			t.Errorf("got %d warnings, want the error alone", got)
+		}
+		if got := collected(t, reader, "proxy.clickhouse.rows.returned"); got != 3 {
+			t.Errorf("got %d rows returned recorded, want 3", got)
+		}
+		if got := collected(t, reader, "proxy.clickhouse.query.duration"); got != 1 {
+			t.Errorf("got %d query durations recorded, want 1", got)
+		}
+	})
+
+	t.Run("warn policy", func(t *testing.T) {
+		reader := recordTelemetry(t)
+		ctx, cut := withTruncation(fiveRows().context(limitsConfig{PartialResponse: true}))
+		ctx, warnings := withQueryWarnings(ctx)
+		n, err := readRows(t, ctx, 3)
+		if n != 3 || err != nil {
+			t.Errorf("got %d rows, %v, want 3 rows and no error", n, err)
+		}
+		if !cut.Load() {
+			t.Error("the truncation was not recorded")
+		}
+		if got := warnings.annotations().AsErrors(); len(got) != 1 || !errors.As(got[0], new(*limitError)) {
+			t.Errorf("got warnings %v, want the row limit", got)
+		}
+		if got := collected(t, reader, "proxy.clickhouse.rows.returned"); got != 3 {
+			t.Errorf("got %d rows returned recorded, want 3", got)
+		}
+	})
+
+	t.Run("shared budget", func(t *testing.T) {
+		ctx := withRowBudget(withRowLimit(fiveRows().context(limitsConfig{}), 7))
+		if n, err := readRows(t, ctx, 7); n != 5 || err != nil {
+			t.Fatalf("first query: got %d rows, %v, want 5 rows", n, err)
+		}
+		// The second query only gets what the first left of the budget.
+		if n, err := readRows(t, ctx, 7); n != 2 || !errors.As(err, new(*limitError)) {
+			t.Errorf("second query: got %d rows, %v, want 2 rows and the row limit error", n, err)
+		}
+	})
+}
+
+func TestQueryErrorTelemetry(t *testing.T) {
+	applyTestConfig(t, nil)
+	reader := recordTelemetry(t)
+	f := newFakeClickHouse(func(query string, args []interface{}) (fakeResult, error) {
+		return fakeResult{}, errors.New("Table otel_metrics.t does not exist")
+	})
+	if _, err := queryLimited(f.context(limitsConfig{}), "SELECT v FROM t"); err == nil {
+		t.Fatal("want the error of the query")
+	}
+	if got := collected(t, reader, "proxy.clickhouse.query.errors"); got != 1 {
+		t.Errorf("got %d query errors recorded, want 1", got)
+	}
+
+	logScanError(context.Background(), errors.New("converting NULL to string is unsupported"))
+	if got := collected(t, reader, "proxy.clickhouse.scan.errors"); got != 1 {
+		t.Errorf("got %d scan errors recorded, want 1", got)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"sort"
+
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+// AggregationTemporality values from the OTel data model.
+const aggregationTemporalityDelta int32 = 1
+
+// deltaAccumulator turns delta points into the running totals Prometheus
+// expects from counters and histograms. Totals start at the first point in
+// the queried range, which rate() and increase() do not care about. Rows
+// must arrive in time order per series.
+type deltaAccumulator struct {
+	index map[uint64][]*deltaState
+}
+
+// deltaState is the running total of one series.
+type deltaState struct {
+	labels []prompb.Label
+	lastNs int64
+
+	value float64
+
+	sum    float64
+	count  uint64
+	bounds []float64
+	counts []uint64
+
+	scale     int32
+	zeroCount uint64
+	pos, neg  map[int32]uint64
+}
+
+func newDeltaAccumulator() *deltaAccumulator {
+	return &deltaAccumulator{index: map[uint64][]*deltaState{}}
+}
+
+// clone returns a copy of a that can be fed rows without changing a.
+func (a *deltaAccumulator) clone() *deltaAccumulator {
+	out := newDeltaAccumulator()
+	for fp, states := range a.index {
+		cp := make([]*deltaState, len(states))
+		for i, s := range states {
+			c := *s
+			c.bounds = append([]float64(nil), s.bounds...)
+			c.counts = append([]uint64(nil), s.counts...)
+			if s.pos != nil {
+				c.pos = maps.Clone(s.pos)
+				c.neg = maps.Clone(s.neg)
+			}
+			cp[i] = &c
+		}
+		out.index[fp] = cp
+	}
+	return out
+}
+
+// seriesState is what a handler keeps about each series across the rows of a
+// query. Queries answered in several time slices carry it from one slice to
+// the next, so running totals and restarts continue where they left off.
+type seriesState struct {
+	deltas *deltaAccumulator
+	resets *resetTracker
+}
+
+func newSeriesState(q *prompb.Query) *seriesState {
+	return &seriesState{deltas: newDeltaAccumulator(), resets: newResetTracker(q)}
+}
+
+func (s *seriesState) clone() *seriesState {
+	return &seriesState{deltas: s.deltas.clone(), resets: s.resets.clone()}
+}
+
+type seriesStateKey struct{}
+
+// withSeriesState makes the handlers run with ctx continue from st.
+func withSeriesState(ctx context.Context, st *seriesState) context.Context {
+	return context.WithValue(ctx, seriesStateKey{}, st)
+}
+
+// seriesStateFor returns the state carried in ctx, or a fresh one for q.
+func seriesStateFor(ctx context.Context, q *prompb.Query) (*deltaAccumulator, *resetTracker) {
+	st, ok := ctx.Value(seriesStateKey{}).(*seriesState)
+	if !ok {
+		st = newSeriesState(q)
+	}
+	return st.deltas, st.resets
+}
+
+// state returns the running total for a series, starting a fresh one when
+// the point at [startNs, tsNs] overlaps the previous one, which means the
+// producer restarted.
+func (a *deltaAccumulator) state(metricName string, attributes map[string]string, startNs, tsNs int64) *deltaState {
+	ls, fp := seriesKey(metricName, attributes)
+
+	var st *deltaState
+	for _, s := range a.index[fp] {
+		if labelsEqual(s.labels, ls) {
+			st = s
+			break
+		}
+	}
+	if st == nil {
+		st = &deltaState{labels: ls}
+		a.index[fp] = append(a.index[fp], st)
+	} else if startNs < st.lastNs {
+		*st = deltaState{labels: ls}
+	}
+	st.lastNs = tsNs
+	return st
+}
+
+// seriesKey returns the sorted labels of a row and their fingerprint, for
+// keeping per-series state across rows.
+func seriesKey(metricName string, attributes map[string]string) ([]prompb.Label, uint64) {
+	ls := []prompb.Label{{Name: "__name__", Value: metricName}}
+	for k, v := range attributes {
+		ls = append(ls, prompb.Label{Name: k, Value: v})
+	}
+	sortLabels(ls)
+	return ls, fingerprint(ls)
+}
+
+// sum adds a delta sum point and returns the running total.
+func (a *deltaAccumulator) sum(metricName string, attributes map[string]string, startNs, tsNs int64, v float64) float64 {
+	st := a.state(metricName, attributes, startNs, tsNs)
+	st.value += v
+	return st.value
+}
+
+// histogram adds a delta explicit-bucket histogram point and returns the
+// running sum, count and bucket counts. A change of bucket bounds starts the
+// totals over, as the old buckets cannot be carried across.
+func (a *deltaAccumulator) histogram(metricName string, attributes map[string]string, startNs, tsNs int64, sum float64, count uint64, bucketCounts []uint64, bounds []float64) (float64, uint64, []uint64) {
+	st := a.state(metricName, attributes, startNs, tsNs)
+	if len(st.counts) != len(bucketCounts) || !equalBounds(st.bounds, bounds) {
+		st.sum, st.count = 0, 0
+		st.counts = make([]uint64, len(bucketCounts))
+		st.bounds = append([]float64(nil), bounds...)
+	}
+
+	st.sum += sum
+	st.count += count
+	for i, c := range bucketCounts {
+		st.counts[i] += c
+	}
+	return st.sum, st.count, append([]uint64(nil), st.counts...)
+}
+
+func equalBounds(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// expHistogram adds a delta exponential histogram point and returns the
+// running total. Points at different scales are merged at the coarser one.
+func (a *deltaAccumulator) expHistogram(metricName string, attributes map[string]string, startNs, tsNs int64, r expHistogramRow) expHistogramRow {
+	st := a.state(metricName, attributes, startNs, tsNs)
+	if st.pos == nil {
+		st.scale = r.scale
+		st.pos, st.neg = map[int32]uint64{}, map[int32]uint64{}
+	}
+
+	if r.scale < st.scale {
+		st.pos = downscaleBuckets(st.pos, st.scale-r.scale)
+		st.neg = downscaleBuckets(st.neg, st.scale-r.scale)
+		st.scale = r.scale
+	}
+	scaleDown := r.scale - st.scale
+	for i, c := range r.posCounts {
+		st.pos[(r.posOffset+int32(i))>>scaleDown] += c
+	}
+	for i, c := range r.negCounts {
+		st.neg[(r.negOffset+int32(i))>>scaleDown] += c
+	}
+	st.zeroCount += r.zeroCount
+	st.sum += r.sum
+	st.count += r.count
+
+	out := expHistogramRow{scale: st.scale, zeroCount: st.zeroCount, sum: st.sum, count: st.count}
+	out.posOffset, out.posCounts = denseBuckets(st.pos)
+	out.negOffset, out.negCounts = denseBuckets(st.neg)
+	return out
+}
+
+func downscaleBuckets(buckets map[int32]uint64, by int32) map[int32]uint64 {
+	out := make(map[int32]uint64, len(buckets))
+	for idx, c := range buckets {
+		out[idx>>by] += c
+	}
+	return out
+}
+
+// denseBuckets lays sparse bucket counts out as an OTel offset and counts.
+func denseBuckets(buckets map[int32]uint64) (int32, []uint64) {
+	if len(buckets) == 0 {
+		return 0, nil
+	}
+	idxs := make([]int32, 0, len(buckets))
+	for idx := range buckets {
+		idxs = append(idxs, idx)
+	}
+	sort.Slice(idxs, func(i, j int) bool { return idxs[i] < idxs[j] })
+
+	offset := idxs[0]
+	counts := make([]uint64, idxs[len(idxs)-1]-offset+1)
+	for _, idx := range idxs {
+		counts[idx-offset] = buckets[idx]
+	}
+	return offset, counts
+}
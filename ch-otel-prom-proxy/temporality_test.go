@@ -0,0 +1,123 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeltaAccumulatorSum(t *testing.T) {
+	type point struct {
+		attrs          map[string]string
+		startNs, tsNs  int64
+		v, wantRunning float64
+	}
+	a := map[string]string{"host": "a"}
+	b := map[string]string{"host": "b"}
+
+	for _, tc := range []struct {
+		name   string
+		points []point
+	}{
+		{"running total", []point{
+			{a, 0, 10, 1, 1},
+			{a, 10, 20, 2, 3},
+			{a, 20, 30, 4, 7},
+		}},
+		{"series kept apart", []point{
+			{a, 0, 10, 1, 1},
+			{b, 0, 10, 5, 5},
+			{a, 10, 20, 1, 2},
+			{b, 10, 20, 5, 10},
+		}},
+		{"gap between points", []point{
+			{a, 0, 10, 1, 1},
+			{a, 50, 60, 1, 2},
+		}},
+		{"overlap means a restart", []point{
+			{a, 0, 10, 1, 1},
+			{a, 10, 20, 2, 3},
+			{a, 5, 25, 7, 7},
+			{a, 25, 30, 1, 8},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			acc := newDeltaAccumulator()
+			for i, p := range tc.points {
+				if got := acc.sum("m", p.attrs, p.startNs, p.tsNs, p.v); got != p.wantRunning {
+					t.Errorf("point %d: got %g, want %g", i, got, p.wantRunning)
+				}
+			}
+		})
+	}
+}
+
+func TestDeltaAccumulatorHistogram(t *testing.T) {
+	acc := newDeltaAccumulator()
+	bounds := []float64{1, 5}
+
+	sum, count, counts := acc.histogram("h", nil, 0, 10, 2, 3, []uint64{1, 1, 1}, bounds)
+	if sum != 2 || count != 3 || !reflect.DeepEqual(counts, []uint64{1, 1, 1}) {
+		t.Fatalf("first point: got %g %d %v", sum, count, counts)
+	}
+	sum, count, counts = acc.histogram("h", nil, 10, 20, 4, 2, []uint64{0, 2, 0}, bounds)
+	if sum != 6 || count != 5 || !reflect.DeepEqual(counts, []uint64{1, 3, 1}) {
+		t.Fatalf("second point: got %g %d %v", sum, count, counts)
+	}
+	// The returned counts are a copy.
+	counts[0] = 100
+
+	// New bounds start the totals over.
+	sum, count, counts = acc.histogram("h", nil, 20, 30, 1, 1, []uint64{1, 0, 0}, []float64{1, 10})
+	if sum != 1 || count != 1 || !reflect.DeepEqual(counts, []uint64{1, 0, 0}) {
+		t.Fatalf("after a bounds change: got %g %d %v", sum, count, counts)
+	}
+}
+
+func TestDeltaAccumulatorExpHistogram(t *testing.T) {
+	acc := newDeltaAccumulator()
+	got := acc.expHistogram("h", nil, 0, 10, expHistogramRow{
+		scale: 2, zeroCount: 1, posOffset: 4, posCounts: []uint64{1, 2}, sum: 3, count: 4,
+	})
+	want := expHistogramRow{scale: 2, zeroCount: 1, posOffset: 4, posCounts: []uint64{1, 2}, sum: 3, count: 4}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("first point: got %+v, want %+v", got, want)
+	}
+
+	// A coarser point merges the totals at its scale: buckets 4 and 5 at
+	// scale 2 are bucket 2 at scale 1.
+	got = acc.expHistogram("h", nil, 10, 20, expHistogramRow{
+		scale: 1, posOffset: 2, posCounts: []uint64{1, 0, 1}, negOffset: -1, negCounts: []uint64{2}, sum: 1, count: 4,
+	})
+	want = expHistogramRow{scale: 1, zeroCount: 1, posOffset: 2, posCounts: []uint64{4, 0, 1}, negOffset: -1, negCounts: []uint64{2}, sum: 4, count: 8}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("coarser point: got %+v, want %+v", got, want)
+	}
+
+	// A finer point is merged in at the coarser scale kept so far.
+	got = acc.expHistogram("h", nil, 20, 30, expHistogramRow{
+		scale: 3, posOffset: 8, posCounts: []uint64{1, 1, 1, 1}, count: 4,
+	})
+	want = expHistogramRow{scale: 1, zeroCount: 1, posOffset: 2, posCounts: []uint64{8, 0, 1}, negOffset: -1, negCounts: []uint64{2}, sum: 4, count: 12}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("finer point: got %+v, want %+v", got, want)
+	}
+}
+
+func TestDeltaAccumulatorClone(t *testing.T) {
+	acc := newDeltaAccumulator()
+	acc.sum("m", nil, 0, 10, 1)
+	acc.histogram("h", nil, 0, 10, 1, 1, []uint64{1}, nil)
+
+	cp := acc.clone()
+	if got := cp.sum("m", nil, 10, 20, 1); got != 2 {
+		t.Errorf("clone continues from %g, want 2", got-1)
+	}
+	cp.histogram("h", nil, 10, 20, 1, 1, []uint64{1}, nil)
+
+	if got := acc.sum("m", nil, 10, 20, 1); got != 2 {
+		t.Errorf("feeding the clone changed the original sum to %g", got-1)
+	}
+	if _, _, counts := acc.histogram("h", nil, 10, 20, 0, 0, []uint64{0}, nil); counts[0] != 1 {
+		t.Errorf("feeding the clone changed the original buckets to %v", counts)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/prometheus/promql"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// tenant is one team sharing the proxy. Each has its own database, or a row
+// filter on a resource attribute, or its own ClickHouse credentials, along
+// with its own limits. Without tenancy every request runs as baseTenant.
+type tenant struct {
+	id       string
+	db       *sql.DB
+	database string
+	filter   *resourceFilter
+	limits   limitsConfig
+	catalog  *metricCatalog
+	engine   *promql.Engine
+	// tokens are the bearer tokens that authenticate as this tenant.
+	tokens []string
+}
+
+var (
+	baseTenant *tenant
+	tenants    map[string]*tenant
+	tenancy    tenancyConfig
+)
+
+var (
+	errNoTenant = errors.New("no tenant given")
+	// errTenantMismatch rejects a request naming another tenant than the
+	// one its credentials belong to.
+	errTenantMismatch = errors.New("tenant header does not match the authenticated tenant")
+	// errUnboundToken rejects a request naming a tenant with a bearer
+	// token that does not belong to one, as anyone holding the token could
+	// name any tenant.
+	errUnboundToken = errors.New("bearer token is not bound to a tenant")
+)
+
+type tenantKey struct{}
+
+func withTenant(ctx context.Context, t *tenant) context.Context {
+	return context.WithValue(ctx, tenantKey{}, t)
+}
+
+// tenantFrom returns the tenant the queries run with ctx belong to.
+func tenantFrom(ctx context.Context) *tenant {
+	if t, ok := ctx.Value(tenantKey{}).(*tenant); ok {
+		return t
+	}
+	return baseTenant
+}
+
+func newTenant(id string, db *sql.DB, database string, filter *resourceFilter, limits limitsConfig) *tenant {
+	return &tenant{
+		id:       id,
+		db:       db,
+		database: database,
+		filter:   filter,
+		limits:   limits,
+		catalog:  &metricCatalog{},
+		engine:   newEngine(limits.MaxSamples),
+	}
+}
+
+// setupTenants builds the tenants of c. base is the connection made from the
+// top-level ClickHouse settings, which tenants share unless they have
+// credentials of their own.
+func setupTenants(c *config, base *sql.DB) error {
+	baseTenant = newTenant("", base, c.ClickHouse.Database, nil, c.Limits)
+	tenancy = c.Tenancy
+	tenants = map[string]*tenant{}
+	if !tenancy.Enabled {
+		return nil
+	}
+
+	for id, tc := range c.Tenancy.Tenants {
+		db := base
+		if ch := tc.ClickHouse; ch != nil {
+			conn := c.ClickHouse
+			if ch.Address != "" {
+				conn.Address = ch.Address
+			}
+			conn.Username, conn.Password = ch.Username, ch.Password
+			var err error
+			if db, err = openClickHouse(conn); err != nil {
+				return err
+			}
+			if err := db.Ping(); err != nil {
+				log.Printf("tenant %s: clickhouse ping: %v", id, err)
+			}
+		}
+		database := c.ClickHouse.Database
+		if tc.Database != "" {
+			database = tc.Database
+		}
+		t := newTenant(id, db, database, tc.ResourceFilter, tc.Limits.apply(c.Limits))
+		t.tokens = tc.BearerTokens
+		tenants[id] = t
+	}
+	return nil
+}
+
+// resolveTenant picks the tenant of r. Requests whose credentials belong to
+// a tenant run as that tenant, and may only name it in the tenant header;
+// other requests run as the tenant the header names, or the default tenant.
+// Bearer tokens that belong to no tenant cannot name one.
+func resolveTenant(r *http.Request) (*tenant, error) {
+	if !tenancy.Enabled {
+		return baseTenant, nil
+	}
+
+	named := ""
+	if tenancy.Header != "" {
+		named = r.Header.Get(tenancy.Header)
+	}
+	id, bound := authenticatedTenant(r)
+	_, hasToken := bearerToken(r)
+	switch {
+	case bound:
+		if named != "" && named != id {
+			return nil, errTenantMismatch
+		}
+	case named != "" && hasToken:
+		return nil, errUnboundToken
+	case named != "":
+		id = named
+	default:
+		id = tenancy.DefaultTenant
+	}
+	if id == "" {
+		return nil, errNoTenant
+	}
+
+	t, ok := tenants[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown tenant %q", id)
+	}
+	return t, nil
+}
+
+// authenticatedTenant returns the tenant the credentials of r belong to, if
+// any. The authenticator has checked them by the time tenants are resolved.
+func authenticatedTenant(r *http.Request) (string, bool) {
+	if token, ok := bearerToken(r); ok {
+		for id, t := range tenants {
+			if tokenIn(token, t.tokens) {
+				return id, true
+			}
+		}
+		return "", false
+	}
+	if !tenancy.FromBasicAuth {
+		return "", false
+	}
+	user, _, ok := r.BasicAuth()
+	return user, ok
+}
+
+// withTenants resolves the tenant of every request before handing it to
+// next, rejecting requests that do not name a known tenant.
+func withTenants(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, err := resolveTenant(r)
+		if err != nil {
+			status := http.StatusUnauthorized
+			if errors.Is(err, errTenantMismatch) || errors.Is(err, errUnboundToken) {
+				status = http.StatusForbidden
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withTenant(r.Context(), t)))
+	})
+}
+
+// queryContext runs query on the ClickHouse connection of the tenant of ctx,
+// once the limiter lets it. The query holds its slot until its rows are
+// closed.
+func queryContext(ctx context.Context, query string, args ...interface{}) (*queryRows, error) {
+	release, err := acquireQuerySlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return startQuery(ctx, release, query, args...)
+}
+
+// acquireQuerySlot waits for the limiter, if there is one, and returns the
+// function giving the slot back.
+func acquireQuerySlot(ctx context.Context) (func(), error) {
+	if clickHouseLimiter == nil {
+		return func() {}, nil
+	}
+	return clickHouseLimiter.acquire(ctx)
+}
+
+// startQuery runs query in the slot released by release.
+func startQuery(ctx context.Context, release func(), query string, args ...interface{}) (*queryRows, error) {
+	t := tenantFrom(ctx)
+	attrs := metric.WithAttributes(attribute.String("tenant", t.id))
+	start := time.Now()
+	rows, err := t.db.QueryContext(withScanProgress(ctx, attrs), query, args...)
+	if err != nil {
+		release()
+		telemetry.queryErrors.Add(ctx, 1, attrs)
+		return nil, err
+	}
+	return &queryRows{Rows: rows, ctx: ctx, attrs: attrs, start: start, release: release}, nil
+}
+
+// tableRef returns what to select from to read table for the tenant of ctx:
+// the table in the tenant's database, narrowed to the tenant's rows when it
+// has a row filter.
+func tableRef(ctx context.Context, table string) string {
+	t := tenantFrom(ctx)
+	ref := t.database + "." + table
+	if t.filter == nil {
+		return ref
+	}
+	return fmt.Sprintf("(SELECT * FROM %s WHERE %s = '%s')", ref, resourceAttributeExpr(t.filter.Attribute), escapeString(t.filter.Value))
+}
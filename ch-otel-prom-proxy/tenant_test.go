@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// setupTestTenants serves teams a and b from one database, each narrowed to
+// its own rows.
+func setupTestTenants(t *testing.T, configure func(c *tenancyConfig)) {
+	t.Helper()
+	c := defaultConfig()
+	c.Tenancy.Enabled = true
+	c.Tenancy.Tenants = map[string]tenantConfig{
+		"a": {ResourceFilter: &resourceFilter{Attribute: "service.namespace", Value: "a"}},
+		"b": {ResourceFilter: &resourceFilter{Attribute: "service.namespace", Value: "b"}, BearerTokens: []string{"b-token"}},
+	}
+	configure(&c.Tenancy)
+	if err := setupTenants(c, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := setupTenants(defaultConfig(), nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestResolveTenant(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		configure func(c *tenancyConfig)
+		user      string
+		token     string
+		header    string
+		want      string
+		wantErr   error
+	}{
+		{
+			name:      "header",
+			configure: func(c *tenancyConfig) {},
+			header:    "b",
+			want:      "b",
+		},
+		{
+			name:      "default tenant",
+			configure: func(c *tenancyConfig) { c.DefaultTenant = "a" },
+			want:      "a",
+		},
+		{
+			name:      "header over default tenant",
+			configure: func(c *tenancyConfig) { c.DefaultTenant = "a" },
+			header:    "b",
+			want:      "b",
+		},
+		{
+			name:      "no tenant",
+			configure: func(c *tenancyConfig) {},
+			wantErr:   errNoTenant,
+		},
+		{
+			name:      "basic-auth user",
+			configure: func(c *tenancyConfig) { c.Header, c.FromBasicAuth = "", true },
+			user:      "a",
+			want:      "a",
+		},
+		{
+			name:      "basic-auth user ignores default tenant",
+			configure: func(c *tenancyConfig) { c.Header, c.FromBasicAuth, c.DefaultTenant = "", true, "b" },
+			user:      "a",
+			want:      "a",
+		},
+		{
+			name:      "basic-auth user naming itself",
+			configure: func(c *tenancyConfig) { c.FromBasicAuth = true },
+			user:      "a",
+			header:    "a",
+			want:      "a",
+		},
+		{
+			name:      "basic-auth user naming another tenant",
+			configure: func(c *tenancyConfig) { c.FromBasicAuth = true },
+			user:      "a",
+			header:    "b",
+			wantErr:   errTenantMismatch,
+		},
+		{
+			name:      "tenant token",
+			configure: func(c *tenancyConfig) {},
+			token:     "b-token",
+			want:      "b",
+		},
+		{
+			name:      "tenant token naming itself",
+			configure: func(c *tenancyConfig) {},
+			token:     "b-token",
+			header:    "b",
+			want:      "b",
+		},
+		{
+			name:      "tenant token naming another tenant",
+			configure: func(c *tenancyConfig) {},
+			token:     "b-token",
+			header:    "a",
+			wantErr:   errTenantMismatch,
+		},
+		{
+			name:      "tenant token over basic-auth tenancy",
+			configure: func(c *tenancyConfig) { c.Header, c.FromBasicAuth = "", true },
+			token:     "b-token",
+			want:      "b",
+		},
+		{
+			name:      "unbound token naming a tenant",
+			configure: func(c *tenancyConfig) {},
+			token:     "shared-token",
+			header:    "a",
+			wantErr:   errUnboundToken,
+		},
+		{
+			name:      "unbound token on the default tenant",
+			configure: func(c *tenancyConfig) { c.DefaultTenant = "a" },
+			token:     "shared-token",
+			want:      "a",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setupTestTenants(t, tc.configure)
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			if tc.user != "" {
+				r.SetBasicAuth(tc.user, "secret")
+			}
+			if tc.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			if tc.header != "" {
+				r.Header.Set("X-Scope-OrgID", tc.header)
+			}
+
+			got, err := resolveTenant(r)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.id != tc.want {
+				t.Errorf("got tenant %q, want %q", got.id, tc.want)
+			}
+		})
+	}
+}
+
+func TestTenantCannotSelectOtherTenantsRows(t *testing.T) {
+	// Even with a header configured, which validate refuses, the header
+	// cannot pick another tenant than the logged-in user.
+	setupTestTenants(t, func(c *tenancyConfig) { c.FromBasicAuth = true })
+
+	var tables []string
+	h := withTenants(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tables = append(tables, tableRef(r.Context(), chTable))
+	}))
+
+	for _, header := range []string{"", "a", "b"} {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+		r.SetBasicAuth("a", "secret")
+		if header != "" {
+			r.Header.Set("X-Scope-OrgID", header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		wantStatus := http.StatusOK
+		if header == "b" {
+			wantStatus = http.StatusForbidden
+		}
+		if w.Code != wantStatus {
+			t.Errorf("header %q: got status %d, want %d", header, w.Code, wantStatus)
+		}
+	}
+
+	if len(tables) != 2 {
+		t.Fatalf("handler ran %d times, want 2", len(tables))
+	}
+	for _, table := range tables {
+		if !strings.Contains(table, "= 'a'") || strings.Contains(table, "'b'") {
+			t.Errorf("tenant a reads %s", table)
+		}
+	}
+}
+
+func TestAuthenticatorAcceptsTenantTokens(t *testing.T) {
+	c := defaultConfig()
+	c.Web.BearerTokens = []string{"shared-token"}
+	c.Tenancy.Tenants = map[string]tenantConfig{"b": {BearerTokens: []string{"b-token"}}}
+
+	for _, tc := range []struct {
+		tenancy bool
+		token   string
+		want    bool
+	}{
+		{false, "shared-token", true},
+		{false, "b-token", false},
+		{true, "b-token", true},
+		{true, "other", false},
+	} {
+		c.Tenancy.Enabled = tc.tenancy
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+		r.Header.Set("Authorization", "Bearer "+tc.token)
+		if got := newAuthenticator(c).authenticate(r); got != tc.want {
+			t.Errorf("tenancy %v, token %q: got %v, want %v", tc.tenancy, tc.token, got, tc.want)
+		}
+	}
+}
+
+func TestValidateRejectsHeaderWithBasicAuthTenancy(t *testing.T) {
+	c := defaultConfig()
+	c.Tenancy.Enabled = true
+	c.Tenancy.FromBasicAuth = true
+	c.Tenancy.Tenants = map[string]tenantConfig{"a": {}}
+	c.Web.BasicAuthUsers = map[string]string{"a": dummyBcryptHash}
+
+	if err := c.validate(); err == nil || !strings.Contains(err.Error(), "tenancy.header and tenancy.from_basic_auth") {
+		t.Fatalf("got %v, want the header to be refused", err)
+	}
+	c.Tenancy.Header = ""
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/value"
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	aggregationTemporalityCumulative int32 = 2
+
+	// OTel data point flag marking a point with no recorded value, which is
+	// how Prometheus stale markers are stored.
+	flagNoRecordedValue uint32 = 1
+)
+
+func handleRemoteWrite(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	if ct := r.Header.Get("Content-Type"); strings.Contains(ct, "io.prometheus.write.v2.Request") {
+		http.Error(w, "remote write 2.0 is not supported", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	compBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed read body", http.StatusBadRequest)
+		return
+	}
+	reqBuf, err := snappy.Decode(nil, compBody)
+	if err != nil {
+		http.Error(w, "failed snappy decode", http.StatusBadRequest)
+		return
+	}
+	var wr prompb.WriteRequest
+	if err := proto.Unmarshal(reqBuf, &wr); err != nil {
+		http.Error(w, "failed proto unmarshal", http.StatusBadRequest)
+		return
+	}
+
+	b := newWriteBatch(&wr)
+	b.filter = tenantFrom(ctx).filter
+	for i := range wr.Timeseries {
+		b.add(&wr.Timeseries[i])
+	}
+	if err := b.flush(ctx); err != nil {
+		log.Printf("remote write error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pointMeta holds the identifying columns shared by every metric table.
+type pointMeta struct {
+	name        string
+	description string
+	unit        string
+	attributes  map[string]string
+	serviceName string
+	resource    map[string]string
+	t           time.Time
+	flags       uint32
+}
+
+// values returns the columns of pointMetaColumns. Remote write carries no
+// start times, so StartTimeUnix is left at the epoch, which the read paths
+// take as unknown: counter restarts then only show up as drops in the
+// cumulative value, as they do in Prometheus itself.
+func (m pointMeta) values() []interface{} {
+	return []interface{}{
+		m.resource, m.serviceName, m.name, m.description, m.unit,
+		m.attributes, time.Unix(0, 0), m.t, m.flags,
+	}
+}
+
+var pointMetaColumns = []string{
+	"ResourceAttributes", "ServiceName", "MetricName", "MetricDescription", "MetricUnit",
+	"Attributes", "StartTimeUnix", "TimeUnix", "Flags",
+}
+
+// classicHistogramPoint collects the _bucket, _sum and _count samples of one
+// classic histogram at one timestamp.
+type classicHistogramPoint struct {
+	meta     pointMeta
+	buckets  map[float64]float64
+	sum      float64
+	count    float64
+	hasCount bool
+}
+
+// writeBatch maps remote-write series onto rows of the OTel metric tables.
+type writeBatch struct {
+	metadata   map[string]prompb.MetricMetadata
+	histograms map[string]bool
+
+	sums          [][]interface{}
+	gauges        [][]interface{}
+	expHistograms [][]interface{}
+
+	classic      map[string]*classicHistogramPoint
+	classicOrder []*classicHistogramPoint
+
+	// filter is the row filter of the writing tenant, whose resource
+	// attribute is set on every point so the tenant can read it back.
+	filter *resourceFilter
+}
+
+func newWriteBatch(wr *prompb.WriteRequest) *writeBatch {
+	b := &writeBatch{
+		metadata:   map[string]prompb.MetricMetadata{},
+		histograms: map[string]bool{},
+		classic:    map[string]*classicHistogramPoint{},
+	}
+	for _, md := range wr.Metadata {
+		b.metadata[md.MetricFamilyName] = md
+		if md.Type == prompb.MetricMetadata_HISTOGRAM || md.Type == prompb.MetricMetadata_GAUGEHISTOGRAM {
+			b.histograms[md.MetricFamilyName] = true
+		}
+	}
+	// A _bucket series with an le label marks its family as a classic
+	// histogram even when the sender does not ship metadata.
+	for _, ts := range wr.Timeseries {
+		name, hasLe := "", false
+		for _, l := range ts.Labels {
+			switch l.Name {
+			case "__name__":
+				name = l.Value
+			case "le":
+				hasLe = true
+			}
+		}
+		if hasLe && strings.HasSuffix(name, "_bucket") {
+			b.histograms[strings.TrimSuffix(name, "_bucket")] = true
+		}
+	}
+	return b
+}
+
+func (b *writeBatch) add(ts *prompb.TimeSeries) {
+	meta := pointMeta{attributes: map[string]string{}, resource: map[string]string{}}
+	le := ""
+	for _, l := range ts.Labels {
+		switch l.Name {
+		case "__name__":
+			meta.name = l.Value
+		case "le":
+			le = l.Value
+		default:
+			meta.attributes[l.Name] = l.Value
+		}
+	}
+	if job := meta.attributes["job"]; job != "" {
+		meta.serviceName = job
+		meta.resource["service.name"] = job
+	}
+	if instance := meta.attributes["instance"]; instance != "" {
+		meta.resource["service.instance.id"] = instance
+	}
+	if b.filter != nil {
+		meta.resource[b.filter.Attribute] = b.filter.Value
+	}
+
+	family, suffix := meta.name, ""
+	for _, s := range histogramSuffixes {
+		if base := strings.TrimSuffix(meta.name, s); base != meta.name && b.histograms[base] {
+			family, suffix = base, s
+			break
+		}
+	}
+	md := b.metadata[family]
+	meta.description, meta.unit = md.Help, md.Unit
+
+	for _, h := range ts.Histograms {
+		b.addNativeHistogram(meta, h)
+	}
+
+	if suffix != "" {
+		for _, s := range ts.Samples {
+			b.addClassicSample(family, suffix, le, meta, s)
+		}
+		return
+	}
+	if le != "" {
+		meta.attributes["le"] = le
+	}
+
+	monotonic := md.Type == prompb.MetricMetadata_COUNTER ||
+		(md.Type == prompb.MetricMetadata_UNKNOWN && strings.HasSuffix(meta.name, "_total"))
+	for _, s := range ts.Samples {
+		m := meta
+		m.t = time.UnixMilli(s.Timestamp)
+		if value.IsStaleNaN(s.Value) {
+			m.flags = flagNoRecordedValue
+		}
+		if monotonic {
+			b.sums = append(b.sums, append(m.values(), s.Value, aggregationTemporalityCumulative, true))
+		} else {
+			b.gauges = append(b.gauges, append(m.values(), s.Value))
+		}
+	}
+}
+
+// addClassicSample adds a sample of one of the sub-series of a classic
+// histogram to the point of its family at the sample's timestamp. A stale
+// marker on any of them marks the whole point as having no recorded value,
+// which is read back as a stale marker on every sub-series.
+func (b *writeBatch) addClassicSample(family, suffix, le string, meta pointMeta, s prompb.Sample) {
+	stale := value.IsStaleNaN(s.Value)
+	if !stale && suffix == "_bucket" && le == "" {
+		return
+	}
+
+	key := family + "\xff" + strconv.FormatInt(s.Timestamp, 10) + "\xff" + attributesKey(meta.attributes)
+	p := b.classic[key]
+	if p == nil {
+		meta.name = family
+		meta.t = time.UnixMilli(s.Timestamp)
+		p = &classicHistogramPoint{meta: meta, buckets: map[float64]float64{}}
+		b.classic[key] = p
+		b.classicOrder = append(b.classicOrder, p)
+	}
+	if stale {
+		p.meta.flags = flagNoRecordedValue
+		return
+	}
+
+	switch suffix {
+	case "_bucket":
+		bound, err := strconv.ParseFloat(le, 64)
+		if err != nil {
+			log.Printf("%s: invalid le %q: %v", family, le, err)
+			return
+		}
+		p.buckets[bound] = s.Value
+	case "_sum":
+		p.sum = s.Value
+	case "_count":
+		p.count, p.hasCount = s.Value, true
+	}
+}
+
+// attributesKey renders attrs in a stable order for use as a map key.
+func attributesKey(attrs map[string]string) string {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, k := range keys {
+		sb.WriteString(k)
+		sb.WriteByte('\xfe')
+		sb.WriteString(attrs[k])
+		sb.WriteByte('\xff')
+	}
+	return sb.String()
+}
+
+// row converts the cumulative le buckets of a classic histogram back into
+// OTel BucketCounts/ExplicitBounds.
+func (p *classicHistogramPoint) row() []interface{} {
+	bounds := make([]float64, 0, len(p.buckets))
+	for le := range p.buckets {
+		if !math.IsInf(le, 1) {
+			bounds = append(bounds, le)
+		}
+	}
+	sort.Float64s(bounds)
+
+	total, ok := p.buckets[math.Inf(1)]
+	if !ok {
+		total = p.count
+	}
+	count := p.count
+	if !p.hasCount {
+		count = total
+	}
+
+	counts := make([]uint64, 0, len(bounds)+1)
+	prev := 0.0
+	for _, le := range append(bounds, math.Inf(1)) {
+		cum := total
+		if !math.IsInf(le, 1) {
+			cum = p.buckets[le]
+		}
+		counts = append(counts, uint64(math.Max(cum-prev, 0)))
+		prev = math.Max(cum, prev)
+	}
+
+	return append(p.meta.values(), uint64(count), p.sum, counts, bounds, aggregationTemporalityCumulative)
+}
+
+func (b *writeBatch) addNativeHistogram(meta pointMeta, h prompb.Histogram) {
+	if h.Schema < minNativeHistogramSchema || h.Schema > maxNativeHistogramSchema {
+		log.Printf("%s: native histogram schema %d has no exponential equivalent, dropping", meta.name, h.Schema)
+		return
+	}
+
+	meta.t = time.UnixMilli(h.Timestamp)
+	if value.IsStaleNaN(h.Sum) {
+		meta.flags = flagNoRecordedValue
+	}
+
+	var count, zeroCount uint64
+	var posCounts, negCounts []uint64
+	var posOffset, negOffset int32
+	if h.IsFloatHistogram() {
+		count = uint64(math.Round(h.GetCountFloat()))
+		zeroCount = uint64(math.Round(h.GetZeroCountFloat()))
+		posOffset, posCounts = otelBuckets(h.PositiveSpans, h.PositiveCounts, false)
+		negOffset, negCounts = otelBuckets(h.NegativeSpans, h.NegativeCounts, false)
+	} else {
+		count = h.GetCountInt()
+		zeroCount = h.GetZeroCountInt()
+		posOffset, posCounts = otelBuckets(h.PositiveSpans, deltasToFloats(h.PositiveDeltas), true)
+		negOffset, negCounts = otelBuckets(h.NegativeSpans, deltasToFloats(h.NegativeDeltas), true)
+	}
+
+	b.expHistograms = append(b.expHistograms, append(meta.values(),
+		count, h.Sum, h.Schema, zeroCount,
+		posOffset, posCounts, negOffset, negCounts,
+		aggregationTemporalityCumulative,
+	))
+}
+
+func deltasToFloats(deltas []int64) []float64 {
+	out := make([]float64, len(deltas))
+	for i, d := range deltas {
+		out[i] = float64(d)
+	}
+	return out
+}
+
+// otelBuckets expands native histogram spans into a dense OTel bucket array.
+// It is the inverse of bucketSpans: Prometheus bucket j is OTel bucket j-1.
+func otelBuckets(spans []prompb.BucketSpan, values []float64, deltas bool) (int32, []uint64) {
+	if len(spans) == 0 || len(values) == 0 {
+		return 0, nil
+	}
+
+	offset := spans[0].Offset - 1
+	var counts []uint64
+	idx, vi, cur := spans[0].Offset, 0, 0.0
+	for si, span := range spans {
+		if si > 0 {
+			idx += span.Offset
+			for int32(len(counts)) < idx-offset-1 {
+				counts = append(counts, 0)
+			}
+		}
+		for j := uint32(0); j < span.Length && vi < len(values); j++ {
+			if deltas {
+				cur += values[vi]
+			} else {
+				cur = values[vi]
+			}
+			counts = append(counts, uint64(math.Max(math.Round(cur), 0)))
+			vi++
+			idx++
+		}
+	}
+	return offset, counts
+}
+
+func (b *writeBatch) flush(ctx context.Context) error {
+	var histograms [][]interface{}
+	for _, p := range b.classicOrder {
+		histograms = append(histograms, p.row())
+	}
+
+	inserts := []struct {
+		table   string
+		columns []string
+		rows    [][]interface{}
+	}{
+		{chTable, []string{"Value", "AggregationTemporality", "IsMonotonic"}, b.sums},
+		{chGaugeTable, []string{"Value"}, b.gauges},
+		{chHistogramTable, []string{"Count", "Sum", "BucketCounts", "ExplicitBounds", "AggregationTemporality"}, histograms},
+		{chExponentialHistogramTable, []string{
+			"Count", "Sum", "Scale", "ZeroCount",
+			"PositiveOffset", "PositiveBucketCounts", "NegativeOffset", "NegativeBucketCounts",
+			"AggregationTemporality",
+		}, b.expHistograms},
+	}
+	for _, ins := range inserts {
+		columns := append(append([]string{}, pointMetaColumns...), ins.columns...)
+		if err := insertRows(ctx, ins.table, columns, ins.rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertRows batch-inserts rows into table within a single transaction, which
+// clickhouse-go sends as one native block.
+func insertRows(ctx context.Context, table string, columns []string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	t := tenantFrom(ctx)
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin insert into %s: %w", table, err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf("INSERT INTO %s.%s (%s)", t.database, table, strings.Join(columns, ", ")))
+	if err != nil {
+		return fmt.Errorf("prepare insert into %s: %w", table, err)
+	}
+	defer stmt.Close()
+
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			return fmt.Errorf("insert into %s: %w", table, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit insert into %s: %w", table, err)
+	}
+	return nil
+}
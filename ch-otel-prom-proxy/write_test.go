@@ -0,0 +1,288 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/value"
+	prompb "github.com/prometheus/prometheus/prompb"
+)
+
+func TestClassicHistogramRow(t *testing.T) {
+	inf := math.Inf(1)
+	for _, tc := range []struct {
+		name       string
+		p          classicHistogramPoint
+		wantCount  uint64
+		wantCounts []uint64
+		wantBounds []float64
+	}{
+		{
+			name:       "cumulative buckets",
+			p:          classicHistogramPoint{buckets: map[float64]float64{1: 2, 5: 5, inf: 9}, count: 9, hasCount: true},
+			wantCount:  9,
+			wantCounts: []uint64{2, 3, 4},
+			wantBounds: []float64{1, 5},
+		},
+		{
+			name:       "no +Inf bucket",
+			p:          classicHistogramPoint{buckets: map[float64]float64{1: 2, 5: 5}, count: 7, hasCount: true},
+			wantCount:  7,
+			wantCounts: []uint64{2, 3, 2},
+			wantBounds: []float64{1, 5},
+		},
+		{
+			name:       "no _count",
+			p:          classicHistogramPoint{buckets: map[float64]float64{1: 2, inf: 4}},
+			wantCount:  4,
+			wantCounts: []uint64{2, 2},
+			wantBounds: []float64{1},
+		},
+		{
+			name:       "decreasing cumulative counts",
+			p:          classicHistogramPoint{buckets: map[float64]float64{1: 3, 2: 2, inf: 4}, count: 4, hasCount: true},
+			wantCount:  4,
+			wantCounts: []uint64{3, 0, 1},
+			wantBounds: []float64{1, 2},
+		},
+		{
+			name:       "only +Inf",
+			p:          classicHistogramPoint{buckets: map[float64]float64{inf: 3}, count: 3, hasCount: true},
+			wantCount:  3,
+			wantCounts: []uint64{3},
+			wantBounds: []float64{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.p.sum = 1.5
+			row := tc.p.row()
+			n := len(pointMetaColumns)
+			if len(row) != n+5 {
+				t.Fatalf("got %d values, want %d", len(row), n+5)
+			}
+			if row[n] != tc.wantCount || row[n+1] != 1.5 {
+				t.Errorf("got count %v sum %v, want %d 1.5", row[n], row[n+1], tc.wantCount)
+			}
+			if !reflect.DeepEqual(row[n+2], tc.wantCounts) || !reflect.DeepEqual(row[n+3], tc.wantBounds) {
+				t.Errorf("got counts %v bounds %v, want %v %v", row[n+2], row[n+3], tc.wantCounts, tc.wantBounds)
+			}
+		})
+	}
+}
+
+// writeSeries builds a remote-write series of name with labels given as
+// name, value pairs.
+func writeSeries(name string, lv []string, samples ...prompb.Sample) prompb.TimeSeries {
+	ls := []prompb.Label{{Name: "__name__", Value: name}}
+	for i := 0; i < len(lv); i += 2 {
+		ls = append(ls, prompb.Label{Name: lv[i], Value: lv[i+1]})
+	}
+	return prompb.TimeSeries{Labels: ls, Samples: samples}
+}
+
+func TestWriteBatchFamilies(t *testing.T) {
+	at := func(v float64) prompb.Sample { return prompb.Sample{Timestamp: 1000, Value: v} }
+	for _, tc := range []struct {
+		name                               string
+		wr                                 prompb.WriteRequest
+		wantSums, wantGauges, wantClassics []string
+	}{
+		{
+			name: "histogram from metadata",
+			wr: prompb.WriteRequest{
+				Metadata: []prompb.MetricMetadata{{MetricFamilyName: "lat", Type: prompb.MetricMetadata_HISTOGRAM}},
+				Timeseries: []prompb.TimeSeries{
+					writeSeries("lat_bucket", []string{"le", "1"}, at(1)),
+					writeSeries("lat_sum", nil, at(2)),
+					writeSeries("lat_count", nil, at(1)),
+				},
+			},
+			wantClassics: []string{"lat"},
+		},
+		{
+			name: "histogram from an le label",
+			wr: prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+				writeSeries("lat_count", nil, at(1)),
+				writeSeries("lat_bucket", []string{"le", "+Inf"}, at(1)),
+			}},
+			wantClassics: []string{"lat"},
+		},
+		{
+			name: "_count and _sum without a _bucket family",
+			wr: prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+				writeSeries("rpc_count", nil, at(1)),
+				writeSeries("rpc_sum", nil, at(1)),
+			}},
+			wantGauges: []string{"rpc_count", "rpc_sum"},
+		},
+		{
+			name: "counters",
+			wr: prompb.WriteRequest{
+				Metadata: []prompb.MetricMetadata{{MetricFamilyName: "hits", Type: prompb.MetricMetadata_COUNTER}},
+				Timeseries: []prompb.TimeSeries{
+					writeSeries("hits", nil, at(1)),
+					writeSeries("errors_total", nil, at(1)),
+				},
+			},
+			wantSums: []string{"hits", "errors_total"},
+		},
+		{
+			name: "_total of a gauge",
+			wr: prompb.WriteRequest{
+				Metadata:   []prompb.MetricMetadata{{MetricFamilyName: "queue_total", Type: prompb.MetricMetadata_GAUGE}},
+				Timeseries: []prompb.TimeSeries{writeSeries("queue_total", nil, at(1))},
+			},
+			wantGauges: []string{"queue_total"},
+		},
+		{
+			name: "le on a series outside a histogram",
+			wr: prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+				writeSeries("slo", []string{"le", "0.5"}, at(1)),
+			}},
+			wantGauges: []string{"slo"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newWriteBatch(&tc.wr)
+			for i := range tc.wr.Timeseries {
+				b.add(&tc.wr.Timeseries[i])
+			}
+			names := func(rows [][]interface{}) []string {
+				var out []string
+				for _, r := range rows {
+					out = append(out, r[2].(string))
+				}
+				return out
+			}
+			var classics []string
+			for _, p := range b.classicOrder {
+				classics = append(classics, p.meta.name)
+			}
+			if got := names(b.sums); !reflect.DeepEqual(got, tc.wantSums) {
+				t.Errorf("sums: got %v, want %v", got, tc.wantSums)
+			}
+			if got := names(b.gauges); !reflect.DeepEqual(got, tc.wantGauges) {
+				t.Errorf("gauges: got %v, want %v", got, tc.wantGauges)
+			}
+			if !reflect.DeepEqual(classics, tc.wantClassics) {
+				t.Errorf("classic histograms: got %v, want %v", classics, tc.wantClassics)
+			}
+		})
+	}
+}
+
+func TestWriteBatchStaleMarkers(t *testing.T) {
+	stale := math.Float64frombits(value.StaleNaN)
+	wr := prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		writeSeries("temp", nil, prompb.Sample{Timestamp: 1000, Value: 20}, prompb.Sample{Timestamp: 2000, Value: stale}),
+		writeSeries("lat_bucket", []string{"le", "1"}, prompb.Sample{Timestamp: 1000, Value: 1}, prompb.Sample{Timestamp: 2000, Value: stale}),
+		writeSeries("lat_bucket", []string{"le", "+Inf"}, prompb.Sample{Timestamp: 1000, Value: 2}, prompb.Sample{Timestamp: 2000, Value: stale}),
+		writeSeries("lat_count", nil, prompb.Sample{Timestamp: 1000, Value: 2}, prompb.Sample{Timestamp: 2000, Value: stale}),
+	}}
+	b := newWriteBatch(&wr)
+	for i := range wr.Timeseries {
+		b.add(&wr.Timeseries[i])
+	}
+
+	flags := len(pointMetaColumns) - 1
+	var gaugeFlags []interface{}
+	for _, r := range b.gauges {
+		gaugeFlags = append(gaugeFlags, r[flags])
+	}
+	if want := []interface{}{uint32(0), flagNoRecordedValue}; !reflect.DeepEqual(gaugeFlags, want) {
+		t.Errorf("gauge flags: got %v, want %v", gaugeFlags, want)
+	}
+
+	if len(b.classicOrder) != 2 {
+		t.Fatalf("got %d histogram points, want 2", len(b.classicOrder))
+	}
+	live, gone := b.classicOrder[0], b.classicOrder[1]
+	if live.meta.flags != 0 || !reflect.DeepEqual(live.buckets, map[float64]float64{1: 1, math.Inf(1): 2}) {
+		t.Errorf("live point: got flags %d buckets %v", live.meta.flags, live.buckets)
+	}
+	if gone.meta.flags != flagNoRecordedValue || len(gone.buckets) != 0 || gone.meta.t != time.UnixMilli(2000) {
+		t.Errorf("stale point: got flags %d buckets %v at %v", gone.meta.flags, gone.buckets, gone.meta.t)
+	}
+}
+
+func TestWriteBatchFlush(t *testing.T) {
+	applyTestConfig(t, nil)
+	f := newFakeClickHouse(nil)
+	ctx := f.context(limitsConfig{})
+
+	wr := prompb.WriteRequest{
+		Metadata: []prompb.MetricMetadata{{MetricFamilyName: "hits", Type: prompb.MetricMetadata_COUNTER, Help: "Hits.", Unit: "1"}},
+		Timeseries: []prompb.TimeSeries{
+			writeSeries("hits", []string{"job", "web", "instance", "a:80"}, prompb.Sample{Timestamp: 1000, Value: 3}),
+			writeSeries("temp", nil, prompb.Sample{Timestamp: 1000, Value: 20}),
+			writeSeries("lat_bucket", []string{"le", "+Inf"}, prompb.Sample{Timestamp: 1000, Value: 2}),
+			{
+				Labels:     []prompb.Label{{Name: "__name__", Value: "size"}},
+				Histograms: []prompb.Histogram{{Timestamp: 1000, Schema: 0, Count: &prompb.Histogram_CountInt{CountInt: 1}, Sum: 4}},
+			},
+		},
+	}
+	b := newWriteBatch(&wr)
+	for i := range wr.Timeseries {
+		b.add(&wr.Timeseries[i])
+	}
+	if err := b.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// columns returns the values inserted into table by column name.
+	columns := func(table string) map[string]interface{} {
+		t.Helper()
+		for stmt, rows := range f.inserts {
+			if !strings.HasPrefix(stmt, "INSERT INTO otel_metrics."+table+" (") {
+				continue
+			}
+			names := strings.Split(strings.TrimSuffix(strings.SplitN(stmt, "(", 2)[1], ")"), ", ")
+			if len(rows) != 1 || len(rows[0]) != len(names) {
+				t.Fatalf("%s: %d rows of %v for columns %v", table, len(rows), rows, names)
+			}
+			out := map[string]interface{}{}
+			for i, name := range names {
+				out[name] = rows[0][i]
+			}
+			return out
+		}
+		t.Fatalf("nothing inserted into %s", table)
+		return nil
+	}
+
+	for _, tc := range []struct {
+		table  string
+		column string
+		want   interface{}
+	}{
+		{"otel_metrics_sum", "MetricName", "hits"},
+		{"otel_metrics_sum", "MetricDescription", "Hits."},
+		{"otel_metrics_sum", "MetricUnit", "1"},
+		{"otel_metrics_sum", "ServiceName", "web"},
+		{"otel_metrics_sum", "ResourceAttributes", map[string]string{"service.name": "web", "service.instance.id": "a:80"}},
+		{"otel_metrics_sum", "Value", 3.0},
+		{"otel_metrics_sum", "IsMonotonic", true},
+		{"otel_metrics_sum", "AggregationTemporality", aggregationTemporalityCumulative},
+		{"otel_metrics_sum", "StartTimeUnix", time.Unix(0, 0)},
+		{"otel_metrics_sum", "TimeUnix", time.UnixMilli(1000)},
+		{"otel_metrics_gauge", "MetricName", "temp"},
+		{"otel_metrics_gauge", "Value", 20.0},
+		{"otel_metrics_gauge", "Flags", uint32(0)},
+		{"otel_metrics_histogram", "MetricName", "lat"},
+		{"otel_metrics_histogram", "Count", uint64(2)},
+		{"otel_metrics_histogram", "BucketCounts", []uint64{2}},
+		{"otel_metrics_histogram", "ExplicitBounds", []float64{}},
+		{"otel_metrics_exponential_histogram", "MetricName", "size"},
+		{"otel_metrics_exponential_histogram", "Count", uint64(1)},
+		{"otel_metrics_exponential_histogram", "Sum", 4.0},
+		{"otel_metrics_exponential_histogram", "Scale", int32(0)},
+	} {
+		if got := columns(tc.table)[tc.column]; !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s.%s: got %#v, want %#v", tc.table, tc.column, got, tc.want)
+		}
+	}
+}
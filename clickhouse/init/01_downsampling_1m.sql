@@ -18,6 +18,8 @@ CREATE TABLE IF NOT EXISTS otel_metrics.otel_metrics_1m
     total_sum Float64,
     min_value Float64,
     max_value Float64,
+    -- Points with a Value, which weigh avg_value when buckets are merged.
+    point_count UInt64,
 
     BucketCounts Array(UInt64),
     ExplicitBounds Array(Float64),
@@ -48,8 +50,16 @@ ORDER BY (ServiceName, MetricName, truncated_time)
 SETTINGS index_granularity = 8192;
 
 
+-- Tables created before point_count was added get it here. Their
+-- existing rows keep 0: they weigh nothing next to newer rows, and coarser
+-- buckets made only of them take their plain average.
+ALTER TABLE otel_metrics.otel_metrics_1m
+    ADD COLUMN IF NOT EXISTS point_count UInt64 AFTER max_value;
+
 -- 1-minute materialized view
-CREATE MATERIALIZED VIEW IF NOT EXISTS otel_metrics.mv_otel_metrics_1m
+-- Recreated so that a view from before point_count fills it in.
+DROP VIEW IF EXISTS otel_metrics.mv_otel_metrics_1m;
+CREATE MATERIALIZED VIEW otel_metrics.mv_otel_metrics_1m
 TO otel_metrics.otel_metrics_1m
 AS
 SELECT
@@ -70,6 +80,7 @@ SELECT
     sum(Sum) AS total_sum,
     min(Min) AS min_value,
     max(Max) AS max_value,
+    count(Value) AS point_count,
 
     arrayFlatten(groupArray(BucketCounts)) AS BucketCounts,
     arrayFlatten(groupArray(ExplicitBounds)) AS ExplicitBounds,
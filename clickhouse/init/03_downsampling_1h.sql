@@ -6,8 +6,16 @@ PARTITION BY toDate(truncated_time)
 ORDER BY (ServiceName, MetricName, truncated_time)
 SETTINGS index_granularity = 8192;
 
+-- Tables created before point_count was added get it here. Their
+-- existing rows keep 0: they weigh nothing next to newer rows, and coarser
+-- buckets made only of them take their plain average.
+ALTER TABLE otel_metrics.otel_metrics_1h
+    ADD COLUMN IF NOT EXISTS point_count UInt64 AFTER max_value;
+
 -- 1-hour materialized view
-CREATE MATERIALIZED VIEW IF NOT EXISTS otel_metrics.mv_otel_metrics_1h
+-- Recreated so that a view from before point_count fills it in.
+DROP VIEW IF EXISTS otel_metrics.mv_otel_metrics_1h;
+CREATE MATERIALIZED VIEW otel_metrics.mv_otel_metrics_1h
 TO otel_metrics.otel_metrics_1h
 AS
 SELECT
@@ -23,11 +31,12 @@ SELECT
     min(StartTimeUnix) AS StartTimeUnix,
     toStartOfHour(truncated_time) AS truncated_time,
 
-    avg(avg_value) AS avg_value,
+    if(sum(point_count) > 0, sum(avg_value * point_count) / sum(point_count), avg(avg_value)) AS avg_value,
     sum(total_count) AS total_count,
     sum(total_sum) AS total_sum,
     min(min_value) AS min_value,
     max(max_value) AS max_value,
+    sum(point_count) AS point_count,
 
     arrayFlatten(groupArray(BucketCounts)) AS BucketCounts,
     arrayFlatten(groupArray(ExplicitBounds)) AS ExplicitBounds,